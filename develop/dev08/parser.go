@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Операторы командной строки
+const (
+	opPipe       = "|"
+	opAnd        = "&&"
+	opOr         = "||"
+	opSeq        = ";"
+	opIn         = "<"   // stdin из файла
+	opOut        = ">"   // вывод в файл с перезаписью
+	opAppend     = ">>"  // вывод в конец файла
+	opDup        = ">&"  // вывод в копию другого дескриптора: 2>&1
+	opHereStr    = "<<<" // stdin из строки
+	opBackground = "&"
+)
+
+// Redirect перенаправление потока Fd команды. Для opDup Target — номер
+// дескриптора, копию которого получает Fd.
+type Redirect struct {
+	Fd     int
+	Op     string
+	Target string
+}
+
+// Command простая команда: аргументы и перенаправления в порядке записи
+type Command struct {
+	Args      []string
+	Redirects []Redirect
+}
+
+// Pipeline конвейер команд, соединенных через |. Код завершения конвейера —
+// код последней команды.
+type Pipeline struct {
+	Commands []Command
+}
+
+// AndOr цепочка конвейеров, соединенных через && и ||; Ops[i] стоит между
+// Pipelines[i] и Pipelines[i+1]. Конвейер после && выполняется, только если
+// предыдущий код равен 0, после || — только если он ненулевой.
+type AndOr struct {
+	Pipelines []Pipeline
+	Ops       []string
+}
+
+// List последовательность цепочек, разделенных ; или переводом строки
+type List []AndOr
+
+// token лексема командной строки: слово или оператор. Для операторов
+// перенаправления Fd — явно указанный номер дескриптора или -1.
+type token struct {
+	word bool
+	text string
+	fd   int
+}
+
+// operators операторы в порядке проверки: длинные раньше коротких
+var operators = []string{opHereStr, opAppend, opDup, opAnd, opOr, "<<", opPipe, opSeq, opIn, opOut, opBackground}
+
+// tokenize разбивает строку на слова и операторы. Поддерживаются одинарные
+// кавычки, двойные кавычки с экранированием \" \\ \$ \` и обратная косая
+// черта вне кавычек.
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	var word strings.Builder
+	inWord, quoted := false, false
+
+	flush := func() {
+		if inWord {
+			tokens = append(tokens, token{word: true, text: word.String(), fd: -1})
+		}
+		word.Reset()
+		inWord, quoted = false, false
+	}
+
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t':
+			flush()
+			i++
+		case c == '\n':
+			flush()
+			tokens = append(tokens, token{text: opSeq, fd: -1})
+			i++
+		case c == '\\':
+			if i+1 >= len(input) {
+				return nil, fmt.Errorf("unexpected end of input after \\")
+			}
+			word.WriteByte(input[i+1])
+			inWord, quoted = true, true
+			i += 2
+		case c == '\'':
+			end := strings.IndexByte(input[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(input[i+1 : i+1+end])
+			inWord, quoted = true, true
+			i += end + 2
+		case c == '"':
+			i++
+			for ; i < len(input) && input[i] != '"'; i++ {
+				if input[i] == '\\' && i+1 < len(input) && strings.IndexByte("\"\\$`", input[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(input[i])
+			}
+			if i >= len(input) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inWord, quoted = true, true
+			i++
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(input[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				word.WriteByte(c)
+				inWord = true
+				i++
+				continue
+			}
+			if op == "<<" {
+				return nil, fmt.Errorf("here-documents are not supported")
+			}
+
+			// Число вплотную перед < или > — номер дескриптора: 2>file. Слова
+			// со знаком вроде -1 и +2 остаются аргументами.
+			fd := -1
+			if inWord && !quoted && (op[0] == '<' || op[0] == '>') && isDigits(word.String()) {
+				if n, err := strconv.Atoi(word.String()); err == nil {
+					fd = n
+					word.Reset()
+					inWord = false
+				}
+			}
+			flush()
+			tokens = append(tokens, token{text: op, fd: fd})
+			i += len(op)
+		}
+	}
+	flush()
+	return tokens, nil
+}
+
+// isDigits проверяет, что непустая строка состоит только из цифр
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parser разбирает лексемы по грамматике:
+//
+//	list     = and_or { ";" and_or } [ ";" ]
+//	and_or   = pipeline { ( "&&" | "||" ) pipeline }
+//	pipeline = command { "|" command }
+//	command  = ( word | redirect ) { word | redirect }
+//	redirect = [fd] ( "<" | ">" | ">>" | "<<<" ) word | [fd] ">&" fd
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parseCommandLine строит синтаксическое дерево командной строки
+func parseCommandLine(input string) (List, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	return p.list()
+}
+
+// peek возвращает текущую лексему; ok false в конце ввода
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// isOp проверяет, что текущая лексема — оператор op
+func (p *parser) isOp(op string) bool {
+	t, ok := p.peek()
+	return ok && !t.word && t.text == op
+}
+
+// unexpected возвращает ошибку для текущей лексемы
+func (p *parser) unexpected() error {
+	t, ok := p.peek()
+	if !ok {
+		return fmt.Errorf("syntax error: unexpected end of input")
+	}
+	return fmt.Errorf("syntax error near unexpected token %q", t.text)
+}
+
+func (p *parser) list() (List, error) {
+	var list List
+	for {
+		for p.isOp(opSeq) {
+			p.pos++
+		}
+		if _, ok := p.peek(); !ok {
+			return list, nil
+		}
+		andOr, err := p.andOr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, andOr)
+		if _, ok := p.peek(); ok && !p.isOp(opSeq) {
+			if p.isOp(opBackground) {
+				return nil, fmt.Errorf("background jobs are not supported")
+			}
+			return nil, p.unexpected()
+		}
+	}
+}
+
+func (p *parser) andOr() (AndOr, error) {
+	var andOr AndOr
+	for {
+		pipeline, err := p.pipeline()
+		if err != nil {
+			return AndOr{}, err
+		}
+		andOr.Pipelines = append(andOr.Pipelines, pipeline)
+		if !p.isOp(opAnd) && !p.isOp(opOr) {
+			return andOr, nil
+		}
+		andOr.Ops = append(andOr.Ops, p.tokens[p.pos].text)
+		p.pos++
+	}
+}
+
+func (p *parser) pipeline() (Pipeline, error) {
+	var pipeline Pipeline
+	for {
+		command, err := p.command()
+		if err != nil {
+			return Pipeline{}, err
+		}
+		pipeline.Commands = append(pipeline.Commands, command)
+		if !p.isOp(opPipe) {
+			return pipeline, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) command() (Command, error) {
+	var command Command
+	for {
+		t, ok := p.peek()
+		switch {
+		case ok && t.word:
+			command.Args = append(command.Args, t.text)
+			p.pos++
+		case ok && (t.text == opIn || t.text == opOut || t.text == opAppend || t.text == opDup || t.text == opHereStr):
+			redirect, err := p.redirect()
+			if err != nil {
+				return Command{}, err
+			}
+			command.Redirects = append(command.Redirects, redirect)
+		default:
+			if len(command.Args) == 0 && len(command.Redirects) == 0 {
+				return Command{}, p.unexpected()
+			}
+			return command, nil
+		}
+	}
+}
+
+func (p *parser) redirect() (Redirect, error) {
+	t := p.tokens[p.pos]
+	p.pos++
+	redirect := Redirect{Fd: t.fd, Op: t.text}
+	if redirect.Fd < 0 {
+		redirect.Fd = 1
+		if t.text == opIn || t.text == opHereStr {
+			redirect.Fd = 0
+		}
+	}
+	if redirect.Fd > 2 {
+		return Redirect{}, fmt.Errorf("unsupported file descriptor %d", redirect.Fd)
+	}
+
+	target, ok := p.peek()
+	if !ok || !target.word {
+		return Redirect{}, p.unexpected()
+	}
+	p.pos++
+	redirect.Target = target.text
+	if t.text == opDup {
+		if n, err := strconv.Atoi(target.text); err != nil || n < 1 || n > 2 {
+			return Redirect{}, fmt.Errorf("%s%s: must be 1 or 2", opDup, target.text)
+		}
+	}
+	return redirect, nil
+}
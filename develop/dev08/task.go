@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,11 +13,19 @@ import (
 	"syscall"
 )
 
-// Обработчик команд cd
-func cd(args []string) error {
+// Обработчик команд cd. В подоболочке (конвейер из нескольких команд)
+// каталог только проверяется, а рабочий каталог шелла не меняется, как в sh.
+func cd(args []string, subshell bool) error {
 	if len(args) < 2 {
 		return fmt.Errorf("cd: missing argument")
 	}
+	if subshell {
+		info, err := os.Stat(args[1])
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("cd: %s: not a directory", args[1])
+		}
+		return err
+	}
 	return os.Chdir(args[1])
 }
 
@@ -43,10 +52,11 @@ func kill(args []string) error {
 }
 
 // Обработчик команд ps
-func ps() error {
+func ps(std stdio) error {
 	cmd := exec.Command("ps")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdin = std.in
+	cmd.Stdout = std.out
+	cmd.Stderr = std.err
 	return cmd.Run()
 }
 
@@ -61,101 +71,239 @@ func handleInterrupt() {
 	}()
 }
 
-// Выполнение команды
-func executeCommand(input string) {
-	// Разделяем команды по пайпам
-	commands := strings.Split(input, "|")
-	numCommands := len(commands)
+// stdio стандартные потоки команды
+type stdio struct {
+	in       io.Reader
+	out, err io.Writer
+}
 
-	var prevCmd *exec.Cmd
-	var prevStdout io.ReadCloser
+// isBuiltin проверяет, что команда выполняется самим шеллом
+func isBuiltin(name string) bool {
+	switch name {
+	case "cd", "pwd", "echo", "kill", "ps":
+		return true
+	}
+	return false
+}
 
-	for i, command := range commands {
-		command = strings.TrimSpace(command)
-		args := strings.Fields(command)
-		if len(args) == 0 {
-			continue
+// runBuiltin выполняет встроенную команду и возвращает код завершения.
+// subshell означает, что команда не должна менять состояние шелла.
+func runBuiltin(args []string, std stdio, subshell bool) int {
+	var err error
+	switch args[0] {
+	case "cd":
+		err = cd(args, subshell)
+	case "pwd":
+		var dir string
+		if dir, err = pwd(); err == nil {
+			fmt.Fprintln(std.out, dir)
 		}
+	case "echo":
+		fmt.Fprintln(std.out, echo(args))
+	case "kill":
+		err = kill(args)
+	case "ps":
+		err = ps(std)
+	}
+	if err != nil {
+		fmt.Fprintln(std.err, err)
+		return 1
+	}
+	return 0
+}
 
-		var cmd *exec.Cmd
+// exitStatus возвращает код завершения внешней команды: 128+N при
+// завершении сигналом N, как в sh
+func exitStatus(err error) int {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 1
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
 
-		switch args[0] {
-		case "cd":
-			if err := cd(args); err != nil {
-				fmt.Println(err)
-			}
-			return
-		case "pwd":
-			dir, err := pwd()
+// applyRedirects применяет перенаправления команды по порядку записи, так что
+// "> out 2>&1" отправляет оба потока в файл, а "2>&1 > out" — только stdout.
+// Открытые файлы возвращаются для закрытия после завершения команды.
+func applyRedirects(redirects []Redirect, std stdio) (stdio, []*os.File, error) {
+	var files []*os.File
+	for _, r := range redirects {
+		var target io.Writer
+		switch r.Op {
+		case opIn:
+			f, err := os.Open(r.Target)
 			if err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println(dir)
+				return std, files, err
+			}
+			files = append(files, f)
+			std.in = f
+			continue
+		case opHereStr:
+			std.in = strings.NewReader(r.Target + "\n")
+			continue
+		case opOut, opAppend:
+			flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			if r.Op == opAppend {
+				flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
 			}
-			return
-		case "echo":
-			fmt.Println(echo(args))
-			return
-		case "kill":
-			if err := kill(args); err != nil {
-				fmt.Println(err)
+			f, err := os.OpenFile(r.Target, flags, 0o644)
+			if err != nil {
+				return std, files, err
 			}
-			return
-		case "ps":
-			if err := ps(); err != nil {
-				fmt.Println(err)
+			files = append(files, f)
+			target = f
+		case opDup:
+			target = std.out
+			if r.Target == "2" {
+				target = std.err
 			}
-			return
-		default:
-			// Обработка остальных команд через exec.Command
-			cmd = exec.Command(args[0], args[1:]...)
 		}
 
-		if prevCmd != nil {
-			stdinPipe, err := cmd.StdinPipe()
-			if err != nil {
-				fmt.Println("Error creating stdin pipe:", err)
-				return
-			}
-			go func() {
-				defer stdinPipe.Close()
-				io.Copy(stdinPipe, prevStdout)
-			}()
+		switch r.Fd {
+		case 0:
+			return std, files, fmt.Errorf("%d%s: file descriptor 0 is not writable", r.Fd, r.Op)
+		case 1:
+			std.out = target
+		case 2:
+			std.err = target
 		}
+	}
+	return std, files, nil
+}
 
-		if i < numCommands-1 {
-			var err error
-			prevStdout, err = cmd.StdoutPipe()
-			if err != nil {
-				fmt.Println("Error creating stdout pipe:", err)
-				return
-			}
-			cmd.Stderr = os.Stderr
-		} else {
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
+// startCommand запускает команду и возвращает функцию ожидания ее кода
+// завершения. Концы каналов pipes закрываются, как только они больше не
+// нужны шеллу: для внешней команды — сразу после запуска, для встроенной —
+// после ее завершения. Встроенная команда в подоболочке (subshell) не меняет
+// состояние шелла.
+func startCommand(c Command, std stdio, pipes []*os.File, subshell bool) func() int {
+	closeAll := func(files []*os.File) {
+		for _, f := range files {
+			f.Close()
 		}
+	}
+	done := func(status int) func() int {
+		return func() int { return status }
+	}
+
+	std, files, err := applyRedirects(c.Redirects, std)
+	if err != nil {
+		fmt.Fprintln(std.err, err)
+		closeAll(files)
+		closeAll(pipes)
+		return done(1)
+	}
+	if len(c.Args) == 0 {
+		closeAll(files)
+		closeAll(pipes)
+		return done(0)
+	}
 
-		if err := cmd.Start(); err != nil {
-			fmt.Println("Error starting command:", err)
-			return
+	if isBuiltin(c.Args[0]) {
+		result := make(chan int, 1)
+		go func() {
+			result <- runBuiltin(c.Args, std, subshell)
+			closeAll(files)
+			closeAll(pipes)
+		}()
+		return func() int { return <-result }
+	}
+
+	cmd := exec.Command(c.Args[0], c.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = std.in, std.out, std.err
+	err = cmd.Start()
+	closeAll(pipes)
+	if err != nil {
+		closeAll(files)
+		if errors.Is(err, exec.ErrNotFound) {
+			fmt.Fprintf(std.err, "%s: command not found\n", c.Args[0])
+			return done(127)
 		}
+		fmt.Fprintln(std.err, err)
+		return done(126)
+	}
+	return func() int {
+		err := cmd.Wait()
+		closeAll(files)
+		if err != nil {
+			return exitStatus(err)
+		}
+		return 0
+	}
+}
+
+// runPipeline выполняет команды конвейера одновременно, соединяя их
+// каналами, и возвращает код завершения последней
+func runPipeline(p Pipeline, std stdio) int {
+	// Одиночная встроенная команда выполняется в шелле, чтобы cd менял его
+	// рабочий каталог до следующей команды. Команды конвейера, как в sh,
+	// выполняются как в подоболочке.
+	if len(p.Commands) == 1 {
+		return startCommand(p.Commands[0], std, nil, false)()
+	}
 
-		if prevCmd != nil {
-			if err := prevCmd.Wait(); err != nil {
-				fmt.Println("Error waiting for previous command:", err)
-				return
+	waits := make([]func() int, len(p.Commands))
+	in := std.in
+	var prev *os.File
+	for i, c := range p.Commands {
+		stageStd := stdio{in: in, out: std.out, err: std.err}
+		var pipes []*os.File
+		if prev != nil {
+			pipes = append(pipes, prev)
+		}
+		var next *os.File
+		if i < len(p.Commands)-1 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				fmt.Fprintln(std.err, "Error creating pipe:", err)
+				for _, wait := range waits[:i] {
+					wait()
+				}
+				return 1
 			}
+			stageStd.out = w
+			pipes = append(pipes, w)
+			next = r
 		}
+		waits[i] = startCommand(c, stageStd, pipes, true)
+		in, prev = next, next
+	}
 
-		prevCmd = cmd
+	status := 0
+	for _, wait := range waits {
+		status = wait()
 	}
+	return status
+}
 
-	if prevCmd != nil {
-		if err := prevCmd.Wait(); err != nil {
-			fmt.Println("Error waiting for command:", err)
+// runList выполняет цепочки по порядку и возвращает код последнего
+// выполненного конвейера
+func runList(list List, std stdio) int {
+	status := 0
+	for _, andOr := range list {
+		status = runPipeline(andOr.Pipelines[0], std)
+		for i, op := range andOr.Ops {
+			if (op == opAnd) == (status == 0) {
+				status = runPipeline(andOr.Pipelines[i+1], std)
+			}
 		}
 	}
+	return status
+}
+
+// Выполнение командной строки. Возвращает код завершения: код последнего
+// выполненного конвейера или 2 при синтаксической ошибке.
+func executeCommand(input string) int {
+	std := stdio{in: os.Stdin, out: os.Stdout, err: os.Stderr}
+	list, err := parseCommandLine(input)
+	if err != nil {
+		fmt.Fprintln(std.err, err)
+		return 2
+	}
+	return runList(list, std)
 }
 
 // Главная функция, которая запускает шелл
@@ -4,6 +4,8 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -121,3 +123,152 @@ func TestShellCommands(t *testing.T) {
 		}
 	})
 }
+
+func TestParseCommandLine(t *testing.T) {
+	cmd := func(args ...string) Command {
+		return Command{Args: args}
+	}
+
+	tests := []struct {
+		input string
+		want  List
+	}{
+		{"", nil},
+		{"ls -l", List{{Pipelines: []Pipeline{{Commands: []Command{cmd("ls", "-l")}}}}}},
+		{"make && ./app > out.log 2>&1", List{{
+			Pipelines: []Pipeline{
+				{Commands: []Command{cmd("make")}},
+				{Commands: []Command{{Args: []string{"./app"}, Redirects: []Redirect{{Fd: 1, Op: ">", Target: "out.log"}, {Fd: 2, Op: ">&", Target: "1"}}}}},
+			},
+			Ops: []string{"&&"},
+		}}},
+		{"a | b || c; d", List{
+			{Pipelines: []Pipeline{{Commands: []Command{cmd("a"), cmd("b")}}, {Commands: []Command{cmd("c")}}}, Ops: []string{"||"}},
+			{Pipelines: []Pipeline{{Commands: []Command{cmd("d")}}}},
+		}},
+		{`grep x<in.txt>>log 2>err <<< 'a b'`, List{{Pipelines: []Pipeline{{Commands: []Command{{
+			Args: []string{"grep", "x"},
+			Redirects: []Redirect{
+				{Fd: 0, Op: "<", Target: "in.txt"},
+				{Fd: 1, Op: ">>", Target: "log"},
+				{Fd: 2, Op: ">", Target: "err"},
+				{Fd: 0, Op: "<<<", Target: "a b"},
+			},
+		}}}}}}},
+		{`echo "a  \"b\"" 'c|d' e\;f "2">x`, List{{Pipelines: []Pipeline{{Commands: []Command{{
+			Args:      []string{"echo", `a  "b"`, "c|d", "e;f", "2"},
+			Redirects: []Redirect{{Fd: 1, Op: ">", Target: "x"}},
+		}}}}}}},
+		{"echo -1>f", List{{Pipelines: []Pipeline{{Commands: []Command{{
+			Args:      []string{"echo", "-1"},
+			Redirects: []Redirect{{Fd: 1, Op: ">", Target: "f"}},
+		}}}}}}},
+		{"echo +2>f", List{{Pipelines: []Pipeline{{Commands: []Command{{
+			Args:      []string{"echo", "+2"},
+			Redirects: []Redirect{{Fd: 1, Op: ">", Target: "f"}},
+		}}}}}}},
+		{"a;\nb;", List{
+			{Pipelines: []Pipeline{{Commands: []Command{cmd("a")}}}},
+			{Pipelines: []Pipeline{{Commands: []Command{cmd("b")}}}},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := parseCommandLine(tt.input)
+		if err != nil {
+			t.Errorf("%q: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q:\ngot  %+v\nwant %+v", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{"&& a", "a &&", "a | | b", "a >", "a > | b", "a 2>&x", "a 3>f", `echo "x`, "echo 'x", "sleep 1 &", "cat << EOF"} {
+		if _, err := parseCommandLine(input); err == nil {
+			t.Errorf("%q: expected syntax error", input)
+		}
+	}
+}
+
+func TestCommandLists(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	read := func(name string) string {
+		data, _ := os.ReadFile(path(name))
+		return string(data)
+	}
+	run := func(input string) (string, int) {
+		var status int
+		output, _ := captureOutput(func() error {
+			status = executeCommand(input)
+			return nil
+		})
+		return output, status
+	}
+
+	tests := []struct {
+		input  string
+		output string
+		status int
+	}{
+		{"true && echo yes", "yes\n", 0},
+		{"false && echo yes", "", 1},
+		{"false || echo no", "no\n", 0},
+		{"true || echo no", "", 0},
+		{"false && echo a || echo b", "b\n", 0},
+		{"true && false; echo next", "next\n", 0},
+		{"echo a; false", "a\n", 1},
+		{"sh -c 'exit 3' || sh -c 'exit 4'", "", 4},
+		{"false | true", "", 0},
+		{"true | false", "", 1},
+		{"echo hello | tr a-z A-Z", "HELLO\n", 0},
+		{"tr a-z A-Z <<< 'here string'", "HERE STRING\n", 0},
+		{"no-such-command-xyz", "", 127},
+		{"cd", "", 1},
+		{"echo 'a &&'", "a &&\n", 0},
+		{"echo a &&", "", 2},
+	}
+	for _, tt := range tests {
+		output, status := run(tt.input)
+		if output != tt.output || status != tt.status {
+			t.Errorf("%q: got %q, status %d; want %q, status %d", tt.input, output, status, tt.output, tt.status)
+		}
+	}
+
+	// Перенаправления применяются по порядку записи
+	both := "sh -c 'echo out; echo err >&2'"
+	if output, _ := run(both + " > " + path("both") + " 2>&1"); output != "" || read("both") != "out\nerr\n" {
+		t.Errorf("> file 2>&1: stdout %q, file %q", output, read("both"))
+	}
+	if output, _ := run(both + " 2>" + path("err") + " >>" + path("both")); output != "" || read("err") != "err\n" || read("both") != "out\nerr\nout\n" {
+		t.Errorf("2> and >>: stdout %q, files %q %q", output, read("err"), read("both"))
+	}
+	if output, _ := run("sh -c 'echo err >&2' 2>&1 > " + path("none") + " | tr a-z A-Z"); output != "ERR\n" || read("none") != "" {
+		t.Errorf("2>&1 > file: stdout %q, file %q", output, read("none"))
+	}
+	if output, status := run("cat < " + path("err") + " && echo done"); output != "err\ndone\n" || status != 0 {
+		t.Errorf("< file: got %q, status %d", output, status)
+	}
+	if _, status := run("cat < " + path("missing")); status != 1 {
+		t.Errorf("missing input file: status %d", status)
+	}
+
+	// cd в конвейере, как в sh, не меняет каталог шелла
+	before, _ := os.Getwd()
+	if output, status := run("cd / | cat"); output != "" || status != 0 {
+		t.Errorf("cd in a pipeline: got %q, status %d", output, status)
+	}
+	if after, _ := os.Getwd(); after != before {
+		t.Errorf("cd in a pipeline changed the directory to %s", after)
+	}
+	if _, status := run("true | cd " + path("missing")); status != 1 {
+		t.Errorf("cd to a missing directory in a pipeline: status %d", status)
+	}
+
+	// Встроенные команды тоже перенаправляются
+	if output, _ := run("echo builtin > " + path("builtin") + "; pwd | cat > " + path("pwd")); output != "" || read("builtin") != "builtin\n" || read("pwd") == "" {
+		t.Errorf("builtin redirect: stdout %q, files %q %q", output, read("builtin"), read("pwd"))
+	}
+}
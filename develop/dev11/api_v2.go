@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	v2UsersPrefix   = "/v2/users/"
+	maxV2RequestLen = 1 << 20
+)
+
+// eventInput тело запроса API v2. Поля-указатели позволяют отличить
+// отсутствующее поле от пустого при частичном обновлении (PATCH).
+type eventInput struct {
+	Title      *string      `json:"title"`
+	StartTime  *time.Time   `json:"start_time"`
+	EndTime    *time.Time   `json:"end_time"`
+	CalendarID *string      `json:"calendar_id"`
+	RRule      *string      `json:"rrule"`
+	ExDates    *[]time.Time `json:"exdates"`
+	TimeZone   *string      `json:"time_zone"`
+	Reminders  *[]Duration  `json:"reminders"`
+}
+
+// applyTo переносит заданные поля в событие
+func (in eventInput) applyTo(event *Event) {
+	if in.Title != nil {
+		event.Title = *in.Title
+	}
+	if in.StartTime != nil {
+		event.StartTime = *in.StartTime
+	}
+	if in.EndTime != nil {
+		event.EndTime = *in.EndTime
+	}
+	if in.CalendarID != nil {
+		event.CalendarID = *in.CalendarID
+	}
+	if in.RRule != nil {
+		event.RRule = *in.RRule
+	}
+	if in.ExDates != nil {
+		event.ExDates = *in.ExDates
+	}
+	if in.TimeZone != nil {
+		event.TimeZone = *in.TimeZone
+	}
+	if in.Reminders != nil {
+		event.Reminders = *in.Reminders
+	}
+}
+
+// decodeEventInput читает JSON-тело запроса, отвергая неизвестные поля
+func decodeEventInput(w http.ResponseWriter, r *http.Request) (eventInput, error) {
+	var in eventInput
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxV2RequestLen))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&in); err != nil {
+		return in, fmt.Errorf("invalid request body: %v", err)
+	}
+	if decoder.More() {
+		return in, fmt.Errorf("invalid request body: unexpected data after JSON object")
+	}
+	return in, nil
+}
+
+// eventETag вычисляет сильный ETag текущего состояния события
+func eventETag(event Event) string {
+	data, _ := toJSON(event)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// ifMatch проверяет заголовок If-Match относительно текущего события.
+// Отсутствующий заголовок разрешает изменение.
+func ifMatch(r *http.Request, event Event) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return true
+	}
+	etag := eventETag(event)
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEvent отправляет событие вместе с его ETag
+func writeEvent(w http.ResponseWriter, status int, event Event) {
+	w.Header().Set("ETag", eventETag(event))
+	writeJSON(w, status, event)
+}
+
+// parseV2Path разбирает путь /v2/users/{user_id}/events[/{id}]
+func parseV2Path(path string) (userID, eventID string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, v2UsersPrefix), "/")
+	switch {
+	case len(parts) == 2 && parts[0] != "" && parts[1] == "events":
+		return parts[0], "", true
+	case len(parts) == 3 && parts[0] != "" && parts[1] == "events" && parts[2] != "":
+		return parts[0], parts[2], true
+	default:
+		return "", "", false
+	}
+}
+
+// methodNotAllowed отправляет 405 со списком допустимых методов
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
+
+// apiV2Handler маршрутизирует ресурсные запросы API v2:
+//
+//	GET, POST                 /v2/users/{user_id}/events
+//	GET, PUT, PATCH, DELETE   /v2/users/{user_id}/events/{id}
+func apiV2Handler(w http.ResponseWriter, r *http.Request) {
+	userID, eventID, ok := parseV2Path(r.URL.Path)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+
+	// Создавать и удалять события пользователя может только он сам, изменять
+	// — также редакторы события; чтение чужого календаря ограничено
+	// событиями, в которых участвует пользователь запроса
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		if err := authorizeUser(r, userID); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+
+	if eventID == "" {
+		switch r.Method {
+		case http.MethodGet:
+			listEventsV2(w, r, userID)
+		case http.MethodPost:
+			createEventV2(w, r, userID)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getEventV2(w, r, userID, eventID)
+	case http.MethodPut, http.MethodPatch:
+		updateEventV2(w, r, userID, eventID)
+	case http.MethodDelete:
+		deleteEventV2(w, r, userID, eventID)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// userEvent возвращает событие, только если оно принадлежит пользователю и
+// доступно пользователю запроса
+func userEvent(r *http.Request, userID, eventID string) (Event, error) {
+	event, err := store.Get(r.Context(), eventID)
+	if err != nil {
+		return Event{}, err
+	}
+	if event.UserID != userID || !canRead(r.Context(), event) {
+		return Event{}, ErrEventNotFound
+	}
+	return event, nil
+}
+
+// listEventsV2 возвращает события пользователя. С параметрами from и to
+// повторяющиеся события разворачиваются в повторения внутри [from, to).
+func listEventsV2(w http.ResponseWriter, r *http.Request, userID string) {
+	query := r.URL.Query()
+	fromStr, toStr := query.Get("from"), query.Get("to")
+
+	var results []Event
+	var err error
+	switch {
+	case fromStr == "" && toStr == "":
+		results, err = store.ListByUser(r.Context(), userID)
+		sortEvents(results)
+	case fromStr == "" || toStr == "":
+		writeError(w, http.StatusBadRequest, fmt.Errorf("from and to must be used together"))
+		return
+	default:
+		from, ferr := time.Parse(time.RFC3339, fromStr)
+		to, terr := time.Parse(time.RFC3339, toStr)
+		if ferr != nil || terr != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("from and to must be RFC 3339 timestamps"))
+			return
+		}
+		if !to.After(from) {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("to must be after from"))
+			return
+		}
+		results, err = eventsBetween(r.Context(), userID, from, to)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	results = readableEvents(r.Context(), results)
+	if len(results) == 0 {
+		results = []Event{}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// createEventV2 создает событие из JSON-тела запроса
+func createEventV2(w http.ResponseWriter, r *http.Request, userID string) {
+	in, err := decodeEventInput(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	rejectOverlap, err := parseRejectOverlap(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	event := Event{ID: newEventID(), UserID: userID}
+	in.applyTo(&event)
+	if err := validateEvent(event); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	unlock := userLocks.lock(userID)
+	defer unlock()
+
+	if err := validateCalendar(event); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !checkConflicts(w, r, event, rejectOverlap) {
+		return
+	}
+	if err := store.Create(r.Context(), event); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", v2UsersPrefix+userID+"/events/"+event.ID)
+	writeEvent(w, http.StatusCreated, event)
+}
+
+// getEventV2 возвращает событие; поддерживает If-None-Match
+func getEventV2(w http.ResponseWriter, r *http.Request, userID, eventID string) {
+	event, err := userEvent(r, userID, eventID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	if r.Header.Get("If-None-Match") == eventETag(event) {
+		w.Header().Set("ETag", eventETag(event))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeEvent(w, http.StatusOK, event)
+}
+
+// updateEventV2 заменяет (PUT) или частично изменяет (PATCH) событие.
+// Заголовок If-Match защищает от потери параллельных изменений.
+func updateEventV2(w http.ResponseWriter, r *http.Request, userID, eventID string) {
+	in, err := decodeEventInput(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	rejectOverlap, err := parseRejectOverlap(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	unlock := userLocks.lock(userID)
+	defer unlock()
+
+	existing, err := userEvent(r, userID, eventID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !canModify(r.Context(), existing) {
+		writeStoreError(w, ErrForbidden)
+		return
+	}
+	if !ifMatch(r, existing) {
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("event has been modified"))
+		return
+	}
+
+	event := existing
+	if r.Method == http.MethodPut {
+		event = Event{ID: existing.ID, UserID: userID}
+	}
+	in.applyTo(&event)
+	keepServerFields(&event, existing)
+	if err := validateEvent(event); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if err := validateCalendar(event); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	if !checkConflicts(w, r, event, rejectOverlap) {
+		return
+	}
+	err = store.Update(r.Context(), event)
+	if err == nil && event.CalendarID != existing.CalendarID {
+		err = moveOverrides(r.Context(), event)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeEvent(w, http.StatusOK, event)
+}
+
+// deleteEventV2 удаляет событие (серию целиком)
+func deleteEventV2(w http.ResponseWriter, r *http.Request, userID, eventID string) {
+	unlock := userLocks.lock(userID)
+	defer unlock()
+
+	existing, err := userEvent(r, userID, eventID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !ifMatch(r, existing) {
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("event has been modified"))
+		return
+	}
+
+	if err := deleteSeries(r.Context(), eventID); err != nil && !errors.Is(err, ErrEventNotFound) {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Роли пользователей в событии. Владелец — пользователь UserID события,
+// приглашенным участникам назначается роль editor или viewer.
+const (
+	roleOwner  = "owner"
+	roleEditor = "editor"
+	roleViewer = "viewer"
+)
+
+// Ответы участника на приглашение
+const (
+	rsvpNeedsAction = "needs_action"
+	rsvpAccepted    = "accepted"
+	rsvpDeclined    = "declined"
+	rsvpTentative   = "tentative"
+)
+
+// Ошибки управления участниками
+var (
+	ErrAttendeeNotFound = errors.New("attendee not found")
+	ErrInvalidAttendee  = errors.New("owner cannot be invited as attendee")
+)
+
+// Attendee приглашенный участник события
+type Attendee struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+	RSVP   string `json:"rsvp"`
+}
+
+// participants возвращает владельца и всех участников события
+func (e Event) participants() []string {
+	users := make([]string, 0, len(e.Attendees)+1)
+	users = append(users, e.UserID)
+	for _, attendee := range e.Attendees {
+		users = append(users, attendee.UserID)
+	}
+	return users
+}
+
+// attendeeIndex возвращает позицию участника в списке или -1
+func (e Event) attendeeIndex(userID string) int {
+	for i, attendee := range e.Attendees {
+		if attendee.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// roleOf возвращает роль пользователя в событии или пустую строку
+func roleOf(event Event, userID string) string {
+	if event.UserID == userID {
+		return roleOwner
+	}
+	if i := event.attendeeIndex(userID); i >= 0 {
+		return event.Attendees[i].Role
+	}
+	return ""
+}
+
+// busyFor проверяет, занимает ли событие время пользователя: владельца
+// всегда, участника — если он не отклонил приглашение
+func busyFor(event Event, userID string) bool {
+	if i := event.attendeeIndex(userID); i >= 0 && event.UserID != userID {
+		return event.Attendees[i].RSVP != rsvpDeclined
+	}
+	return true
+}
+
+// canRead проверяет право пользователя на просмотр события: участникам
+// события и всем пользователям, если событие в открытом календаре
+func canRead(ctx context.Context, event Event) bool {
+	userID, ok := userFromContext(ctx)
+	return !ok || roleOf(event, userID) != "" || calendars.isPublic(event.CalendarID)
+}
+
+// canModify проверяет право пользователя на изменение события
+func canModify(ctx context.Context, event Event) bool {
+	userID, ok := userFromContext(ctx)
+	if !ok {
+		return true
+	}
+	role := roleOf(event, userID)
+	return role == roleOwner || role == roleEditor
+}
+
+// canDelete проверяет право пользователя на удаление события: удалять
+// событие может только владелец
+func canDelete(ctx context.Context, event Event) bool {
+	userID, ok := userFromContext(ctx)
+	return !ok || event.UserID == userID
+}
+
+// requireOwner проверяет, что запрос выполняет владелец события. Без
+// аутентификации владелец передается в параметре user_id.
+func requireOwner(r *http.Request, event Event) error {
+	userID, err := actingUser(r, r.FormValue("user_id"))
+	if err != nil {
+		return err
+	}
+	if userID != event.UserID {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// changeAttendees применяет изменение списка участников к событию и, если
+// это серия, к ее отдельно измененным повторениям. Для повторения изменение
+// применяется ко всей серии. check проверяет права до изменения.
+func changeAttendees(r *http.Request, id string, check func(Event) error, change func(*Event) error) error {
+	ctx := r.Context()
+	event, err := store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if event.SeriesID != "" {
+		id = event.SeriesID
+	}
+
+	unlock := userLocks.lock(event.UserID)
+	defer unlock()
+
+	if event, err = store.Get(ctx, id); err != nil {
+		return err
+	}
+	if err := check(event); err != nil {
+		return err
+	}
+	if err := applyAttendeeChange(ctx, event, change); err != nil {
+		return err
+	}
+	if event.RRule == "" {
+		return nil
+	}
+
+	userEvents, err := store.ListByUser(ctx, event.UserID)
+	if err != nil {
+		return err
+	}
+	for _, override := range userEvents {
+		if override.SeriesID != id {
+			continue
+		}
+		err := applyAttendeeChange(ctx, override, change)
+		if err != nil && !errors.Is(err, ErrAttendeeNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyAttendeeChange изменяет копию списка участников и сохраняет событие
+func applyAttendeeChange(ctx context.Context, event Event, change func(*Event) error) error {
+	event.Attendees = append([]Attendee(nil), event.Attendees...)
+	if err := change(&event); err != nil {
+		return err
+	}
+	if len(event.Attendees) == 0 {
+		event.Attendees = nil
+	}
+	return store.Update(ctx, event)
+}
+
+// parseAttendee парсит обязательный параметр attendee
+func parseAttendee(r *http.Request) (string, error) {
+	attendee := r.FormValue("attendee")
+	if attendee == "" {
+		return "", fmt.Errorf("missing attendee")
+	}
+	return attendee, nil
+}
+
+// writeAttendeeError отправляет ответ с ошибкой изменения участников
+func writeAttendeeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrAttendeeNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrInvalidAttendee):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeStoreError(w, err)
+	}
+}
+
+// inviteAttendeeHandler обработчик для приглашения участника (POST
+// /invite_attendee) с ролью editor или viewer (по умолчанию). Повторное
+// приглашение меняет роль, сохраняя ответ участника. Приглашать может только
+// владелец события.
+func inviteAttendeeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseAndValidateID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	attendee, err := parseAttendee(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	role := r.FormValue("role")
+	switch role {
+	case "":
+		role = roleViewer
+	case roleEditor, roleViewer:
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid role: must be editor or viewer"))
+		return
+	}
+
+	err = changeAttendees(r, id, func(event Event) error {
+		if err := requireOwner(r, event); err != nil {
+			return err
+		}
+		if attendee == event.UserID {
+			return ErrInvalidAttendee
+		}
+		return nil
+	}, func(event *Event) error {
+		if i := event.attendeeIndex(attendee); i >= 0 {
+			event.Attendees[i].Role = role
+			return nil
+		}
+		event.Attendees = append(event.Attendees, Attendee{UserID: attendee, Role: role, RSVP: rsvpNeedsAction})
+		return nil
+	})
+	if err != nil {
+		writeAttendeeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, JSONResponse{Result: "attendee invited"})
+}
+
+// respondInviteHandler обработчик для ответа участника на приглашение (POST
+// /respond_invite): rsvp принимает значения accepted, declined или tentative
+func respondInviteHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseAndValidateID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	attendee, err := actingUser(r, r.FormValue("attendee"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if attendee == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing attendee"))
+		return
+	}
+	rsvp := r.FormValue("rsvp")
+	switch rsvp {
+	case rsvpAccepted, rsvpDeclined, rsvpTentative:
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid rsvp: must be accepted, declined or tentative"))
+		return
+	}
+
+	err = changeAttendees(r, id, func(Event) error { return nil }, func(event *Event) error {
+		i := event.attendeeIndex(attendee)
+		if i < 0 {
+			return ErrAttendeeNotFound
+		}
+		event.Attendees[i].RSVP = rsvp
+		return nil
+	})
+	if err != nil {
+		writeAttendeeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, JSONResponse{Result: "response recorded"})
+}
+
+// removeAttendeeHandler обработчик для исключения участника (POST
+// /remove_attendee). Исключать может только владелец события.
+func removeAttendeeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseAndValidateID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	attendee, err := parseAttendee(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = changeAttendees(r, id, func(event Event) error {
+		return requireOwner(r, event)
+	}, func(event *Event) error {
+		i := event.attendeeIndex(attendee)
+		if i < 0 {
+			return ErrAttendeeNotFound
+		}
+		event.Attendees = append(event.Attendees[:i], event.Attendees[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		writeAttendeeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, JSONResponse{Result: "attendee removed"})
+}
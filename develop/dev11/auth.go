@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Ошибки аутентификации и авторизации
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+const (
+	defaultTokenTTL = 12 * time.Hour
+	minSecretLen    = 32
+)
+
+// auth включает аутентификацию, если задан реестр пользователей; nil —
+// аутентификация выключена и user_id берется из параметров запроса
+var auth *authenticator
+
+// registeredUser запись реестра пользователей
+type registeredUser struct {
+	UserID       string `json:"user_id"`
+	PasswordHash string `json:"password_hash"`
+}
+
+// authenticator проверяет пароли по реестру и выпускает подписанные токены
+type authenticator struct {
+	users  map[string]registeredUser
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// loadAuthenticator загружает реестр пользователей из JSON-файла
+func loadAuthenticator(path string, secret []byte, ttl time.Duration) (*authenticator, error) {
+	if len(secret) < minSecretLen {
+		return nil, fmt.Errorf("auth secret must be at least %d bytes", minSecretLen)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read user registry: %w", err)
+	}
+	var list []registeredUser
+	if err := fromJSON(data, &list); err != nil {
+		return nil, fmt.Errorf("decode user registry: %w", err)
+	}
+
+	a := &authenticator{users: make(map[string]registeredUser), secret: secret, ttl: ttl, now: time.Now}
+	for _, user := range list {
+		if user.UserID == "" || user.PasswordHash == "" {
+			return nil, fmt.Errorf("user registry: empty user_id or password_hash")
+		}
+		a.users[user.UserID] = user
+	}
+	dummyPasswordHash()
+	return a, nil
+}
+
+// hashPassword вычисляет bcrypt-хэш пароля с солью
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword проверяет пароль по bcrypt-хэшу
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// passwordCost стоимость bcrypt для новых хэшей паролей
+var passwordCost = bcrypt.DefaultCost
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash возвращает хэш, с которым сравнивается пароль
+// неизвестного пользователя, чтобы по времени ответа нельзя было узнать,
+// какие user_id зарегистрированы
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("dummy password")
+	})
+	return dummyHash
+}
+
+// login проверяет пароль и выпускает токен
+func (a *authenticator) login(userID, password string) (string, time.Time, error) {
+	user, ok := a.users[userID]
+	if !ok {
+		checkPassword(dummyPasswordHash(), password)
+		return "", time.Time{}, ErrUnauthorized
+	}
+	if !checkPassword(user.PasswordHash, password) {
+		return "", time.Time{}, ErrUnauthorized
+	}
+	expires := a.now().Add(a.ttl)
+	return a.issue(userID, expires), expires, nil
+}
+
+// issue выпускает токен вида base64(user_id|exp).base64(HMAC-SHA256)
+func (a *authenticator) issue(userID string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%d", userID, expires.Unix())))
+	return payload + "." + a.sign(payload)
+}
+
+// sign подписывает полезную нагрузку токена
+func (a *authenticator) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify проверяет подпись и срок действия токена и возвращает пользователя
+func (a *authenticator) verify(token string) (string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(a.sign(payload))) {
+		return "", ErrUnauthorized
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrUnauthorized
+	}
+	sep := strings.LastIndexByte(string(raw), '|')
+	if sep <= 0 {
+		return "", ErrUnauthorized
+	}
+	var expires int64
+	if _, err := fmt.Sscanf(string(raw[sep+1:]), "%d", &expires); err != nil {
+		return "", ErrUnauthorized
+	}
+	if a.now().Unix() >= expires {
+		return "", ErrUnauthorized
+	}
+
+	userID := string(raw[:sep])
+	if _, ok := a.users[userID]; !ok {
+		return "", ErrUnauthorized
+	}
+	return userID, nil
+}
+
+type userContextKey struct{}
+
+// withUser сохраняет аутентифицированного пользователя в контексте
+func withUser(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userContextKey{}, userID)
+}
+
+// userFromContext возвращает аутентифицированного пользователя, если он есть
+func userFromContext(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(userContextKey{}).(string)
+	return userID, ok
+}
+
+// publicPaths доступны без токена
+var publicPaths = map[string]bool{
+	"/login":   true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// authMiddleware middleware для проверки bearer-токена
+func authMiddleware(a *authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calendar"`)
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing bearer token"))
+			return
+		}
+		userID, err := a.verify(strings.TrimSpace(token))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calendar", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid or expired token"))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withUser(r.Context(), userID)))
+	})
+}
+
+// LoginResponse ответ на успешный вход
+type LoginResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// loginHandler обработчик для получения токена по user_id и паролю
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if auth == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("authentication is disabled"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	token, expires, err := auth.login(r.FormValue("user_id"), r.FormValue("password"))
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid user_id or password"))
+		return
+	}
+	writeJSON(w, http.StatusOK, LoginResponse{Token: token, ExpiresAt: expires.UTC()})
+}
+
+// actingUser определяет пользователя, от имени которого выполняется запрос.
+// При включенной аутентификации это владелец токена, и переданный claimed
+// user_id обязан с ним совпадать. Без аутентификации используется claimed.
+func actingUser(r *http.Request, claimed string) (string, error) {
+	userID, ok := userFromContext(r.Context())
+	if !ok {
+		return claimed, nil
+	}
+	if claimed != "" && claimed != userID {
+		return "", ErrForbidden
+	}
+	return userID, nil
+}
+
+// authorizeUser разрешает запрос к данным пользователя userID только ему самому
+func authorizeUser(r *http.Request, userID string) error {
+	_, err := actingUser(r, userID)
+	return err
+}
+
+// readableEvents оставляет только события, доступные пользователю запроса
+func readableEvents(ctx context.Context, events []Event) []Event {
+	if _, ok := userFromContext(ctx); !ok {
+		return events
+	}
+	var results []Event
+	for _, event := range events {
+		if canRead(ctx, event) {
+			results = append(results, event)
+		}
+	}
+	return results
+}
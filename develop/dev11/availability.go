@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSuggestionStep  = 15 * time.Minute
+	defaultSuggestionLimit = 10
+	maxSuggestionLimit     = 100
+	maxMeetingDuration     = 24 * time.Hour
+	suggestionBuffer       = 30 * time.Minute // запас до соседних встреч, при котором слот считается удобным
+	maxHolidays            = 1000
+	holidayLayout          = "2006-01-02"
+)
+
+// weekdayNames сокращенные названия дней недели в порядке time.Weekday
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// WorkingHours рабочие часы в часовом поясе пользователя по указанным дням
+// недели. Время задается как "15:04", конец должен быть позже начала.
+type WorkingHours struct {
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// defaultWorkingHours рабочие часы пользователей, которые их не задали
+var defaultWorkingHours = []WorkingHours{
+	{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "17:00"},
+}
+
+// parseWorkingHours разбирает рабочие часы вида "mon-fri 09:00-17:00" или
+// "mon,wed,sat 10:00-14:00"
+func parseWorkingHours(spec string) (WorkingHours, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return WorkingHours{}, fmt.Errorf("invalid working_hours %q: want days and hours, e.g. mon-fri 09:00-17:00", spec)
+	}
+
+	var wh WorkingHours
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, to := weekdayIndex(first), weekdayIndex(last)
+		if !isRange {
+			to = from
+		}
+		if from < 0 || to < 0 {
+			return WorkingHours{}, fmt.Errorf("invalid working_hours %q: unknown day %q", spec, part)
+		}
+		// Диапазон может переходить через воскресенье: fri-mon
+		for day := from; ; day = (day + 1) % 7 {
+			if !seen[weekdayNames[day]] {
+				seen[weekdayNames[day]] = true
+				wh.Days = append(wh.Days, weekdayNames[day])
+			}
+			if day == to {
+				break
+			}
+		}
+	}
+
+	var ok bool
+	wh.Start, wh.End, ok = strings.Cut(fields[1], "-")
+	if !ok {
+		return WorkingHours{}, fmt.Errorf("invalid working_hours %q: want hours as 09:00-17:00", spec)
+	}
+	if err := wh.validate(); err != nil {
+		return WorkingHours{}, fmt.Errorf("invalid working_hours %q: %v", spec, err)
+	}
+	return wh, nil
+}
+
+// weekdayIndex возвращает номер дня недели по сокращению или -1
+func weekdayIndex(name string) int {
+	for i, weekday := range weekdayNames {
+		if weekday == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// validate проверяет время начала и конца рабочего дня
+func (wh WorkingHours) validate() error {
+	start, err := time.Parse("15:04", wh.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start %q", wh.Start)
+	}
+	end, err := time.Parse("15:04", wh.End)
+	if err != nil {
+		return fmt.Errorf("invalid end %q", wh.End)
+	}
+	if !end.After(start) {
+		return fmt.Errorf("end must be after start")
+	}
+	return nil
+}
+
+// worksOn проверяет, рабочий ли день недели
+func (wh WorkingHours) worksOn(day time.Weekday) bool {
+	for _, name := range wh.Days {
+		if name == weekdayNames[day] {
+			return true
+		}
+	}
+	return false
+}
+
+// at возвращает время clock ("15:04") в день date часового пояса date
+func at(date time.Time, clock string) time.Time {
+	t, _ := time.Parse("15:04", clock)
+	return time.Date(date.Year(), date.Month(), date.Day(), t.Hour(), t.Minute(), 0, 0, date.Location())
+}
+
+// parseHolidays разбирает даты выходных вида 2024-12-25 из повторяющегося
+// или перечисленного через запятую параметра
+func parseHolidays(values []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var holidays []string
+	for _, value := range values {
+		for _, date := range strings.Split(value, ",") {
+			date = strings.TrimSpace(date)
+			if date == "" || seen[date] {
+				continue
+			}
+			if _, err := time.Parse(holidayLayout, date); err != nil {
+				return nil, fmt.Errorf("invalid holiday %q: want YYYY-MM-DD", date)
+			}
+			seen[date] = true
+			holidays = append(holidays, date)
+		}
+	}
+	if len(holidays) > maxHolidays {
+		return nil, fmt.Errorf("too many holidays: at most %d", maxHolidays)
+	}
+	sort.Strings(holidays)
+	return holidays, nil
+}
+
+// workingIntervals возвращает рабочее время пользователя внутри [from, to):
+// рабочие часы в его часовом поясе loc без выходных дней
+func workingIntervals(us UserSettings, loc *time.Location, from, to time.Time) []Interval {
+	hours := us.WorkingHours
+	if len(hours) == 0 {
+		hours = defaultWorkingHours
+	}
+	holidays := make(map[string]bool, len(us.Holidays))
+	for _, date := range us.Holidays {
+		holidays[date] = true
+	}
+
+	window := Interval{Start: from, End: to}
+	local := from.In(loc)
+	var intervals []Interval
+	for day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if holidays[day.Format(holidayLayout)] {
+			continue
+		}
+		for _, wh := range hours {
+			if !wh.worksOn(day.Weekday()) {
+				continue
+			}
+			interval := Interval{Start: at(day, wh.Start), End: at(day, wh.End)}
+			if !interval.overlaps(window) {
+				continue
+			}
+			if interval.Start.Before(from) {
+				interval.Start = from
+			}
+			if interval.End.After(to) {
+				interval.End = to
+			}
+			intervals = append(intervals, interval)
+		}
+	}
+	return mergeIntervals(intervals)
+}
+
+// intersectIntervals возвращает пересечение двух упорядоченных списков
+// непересекающихся интервалов
+func intersectIntervals(a, b []Interval) []Interval {
+	var result []Interval
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		start, end := a[i].Start, a[i].End
+		if b[j].Start.After(start) {
+			start = b[j].Start
+		}
+		if b[j].End.Before(end) {
+			end = b[j].End
+		}
+		if start.Before(end) {
+			result = append(result, Interval{Start: start, End: end})
+		}
+		if a[i].End.Before(b[j].End) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return result
+}
+
+// containing возвращает интервал из упорядоченного списка, содержащий slot
+func containing(intervals []Interval, slot Interval) (Interval, bool) {
+	i := sort.Search(len(intervals), func(i int) bool { return intervals[i].End.After(slot.Start) })
+	if i < len(intervals) && !intervals[i].Start.After(slot.Start) && !intervals[i].End.Before(slot.End) {
+		return intervals[i], true
+	}
+	return Interval{}, false
+}
+
+// MeetingSlot предлагаемое время встречи. Score от 0 до 1: выше у слотов с
+// запасом до соседних встреч и ближе к середине рабочего дня каждого
+// участника.
+type MeetingSlot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Score float64   `json:"score"`
+}
+
+// MeetingSuggestions ответ на запрос подбора времени встречи
+type MeetingSuggestions struct {
+	Slots []MeetingSlot `json:"slots"`
+}
+
+// scoreSlot оценивает слот внутри свободного промежутка free. Половина
+// оценки — запас до границ промежутка (не больше suggestionBuffer), половина
+// — удаленность от краев рабочего дня участника, которому слот наименее
+// удобен.
+func scoreSlot(slot, free Interval, working [][]Interval) float64 {
+	margin := slot.Start.Sub(free.Start)
+	if after := free.End.Sub(slot.End); after < margin {
+		margin = after
+	}
+	if margin > suggestionBuffer {
+		margin = suggestionBuffer
+	}
+
+	centrality := 1.0
+	mid := slot.Start.Add(slot.End.Sub(slot.Start) / 2)
+	for _, intervals := range working {
+		day, ok := containing(intervals, slot)
+		if !ok {
+			return 0
+		}
+		half := day.End.Sub(day.Start) / 2
+		offset := mid.Sub(day.Start.Add(half))
+		if offset < 0 {
+			offset = -offset
+		}
+		centrality = math.Min(centrality, 1-float64(offset)/float64(half))
+	}
+
+	score := 0.5*float64(margin)/float64(suggestionBuffer) + 0.5*centrality
+	return math.Round(score*1000) / 1000
+}
+
+// suggestMeetingHandler обработчик для подбора времени встречи (GET
+// /suggest_meeting). Параметры: user_ids — участники, duration —
+// длительность встречи, from и to — окно поиска, step — шаг начала слотов,
+// limit — число слотов. Слоты попадают в рабочие часы всех участников в их
+// часовых поясах, минуют их выходные и занятое время и не пересекаются между
+// собой; лучшие идут первыми.
+func suggestMeetingHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userIDs := parseUserIDs(r)
+	if len(userIDs) == 0 || query.Get("duration") == "" || query.Get("from") == "" || query.Get("to") == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing user_ids, duration, from or to"))
+		return
+	}
+
+	duration, err := time.ParseDuration(query.Get("duration"))
+	if err != nil || duration <= 0 || duration > maxMeetingDuration {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration: must be positive and at most %s", maxMeetingDuration))
+		return
+	}
+	from, ferr := time.Parse(time.RFC3339, query.Get("from"))
+	to, terr := time.Parse(time.RFC3339, query.Get("to"))
+	if ferr != nil || terr != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("from and to must be RFC 3339 timestamps"))
+		return
+	}
+	if !to.After(from) || to.Sub(from) > maxFreeBusyRange {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid time range"))
+		return
+	}
+
+	step := defaultSuggestionStep
+	if value := query.Get("step"); value != "" {
+		if step, err = time.ParseDuration(value); err != nil || step < time.Minute {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid step: must be at least 1m"))
+			return
+		}
+	}
+	limit := defaultSuggestionLimit
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxSuggestionLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: must be between 1 and %d", maxSuggestionLimit))
+			return
+		}
+	}
+
+	available := []Interval{{Start: from, End: to}}
+	working := make([][]Interval, len(userIDs))
+	for i, userID := range userIDs {
+		working[i] = workingIntervals(settings.Get(userID), settings.location(userID), from, to)
+		available = intersectIntervals(available, working[i])
+	}
+
+	busy, err := busyIntervals(r.Context(), userIDs, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var candidates []MeetingSlot
+	for _, window := range available {
+		for _, free := range freeSlots(busy, window.Start, window.End, duration) {
+			start := free.Start.Truncate(step)
+			if start.Before(free.Start) {
+				start = start.Add(step)
+			}
+			for ; !start.Add(duration).After(free.End); start = start.Add(step) {
+				slot := Interval{Start: start, End: start.Add(duration)}
+				candidates = append(candidates, MeetingSlot{Start: slot.Start, End: slot.End, Score: scoreSlot(slot, free, working)})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+
+	// Лучшие слоты, не пересекающиеся с уже выбранными
+	result := MeetingSuggestions{Slots: []MeetingSlot{}}
+	for _, candidate := range candidates {
+		if len(result.Slots) == limit {
+			break
+		}
+		overlaps := false
+		for _, chosen := range result.Slots {
+			if candidate.Start.Before(chosen.End) && chosen.Start.Before(candidate.End) {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			result.Slots = append(result.Slots, candidate)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
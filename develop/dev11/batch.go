@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	maxBatchOps = 5000    // операций в одном пакете
+	maxBatchLen = 8 << 20 // размер тела запроса /batch
+)
+
+// storeOp операция пакетной записи в хранилище: changeCreate и changeUpdate
+// записывают Event, changeDelete удаляет событие ID
+type storeOp struct {
+	Op    string
+	ID    string
+	Event Event
+}
+
+// id возвращает ID события, которого касается операция
+func (op storeOp) id() string {
+	if op.Op == changeDelete {
+		return op.ID
+	}
+	return op.Event.ID
+}
+
+// batchError ошибка операции Index пакета; пакет при этом не применяется
+type batchError struct {
+	Index int
+	Err   error
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+func (e *batchError) Unwrap() error {
+	return e.Err
+}
+
+// checkOps проверяет, что операции пакета применимы по порядку: создаваемые
+// события еще не существуют, изменяемые и удаляемые — существуют с учетом
+// предыдущих операций. exists сообщает о наличии события в хранилище.
+func checkOps(ops []storeOp, exists func(id string) bool) error {
+	state := make(map[string]bool)
+	for i, op := range ops {
+		id := op.id()
+		present, seen := state[id]
+		if !seen {
+			present = exists(id)
+		}
+		switch op.Op {
+		case changeCreate:
+			if present {
+				return &batchError{Index: i, Err: ErrEventExists}
+			}
+		case changeUpdate, changeDelete:
+			if !present {
+				return &batchError{Index: i, Err: ErrEventNotFound}
+			}
+		default:
+			return &batchError{Index: i, Err: fmt.Errorf("unknown operation %q", op.Op)}
+		}
+		state[id] = op.Op != changeDelete
+	}
+	return nil
+}
+
+// batchView хранилище с наложенными, но еще не примененными изменениями
+// пакета. Через него операции пакета видят результаты предыдущих.
+type batchView struct {
+	EventStore
+	changed map[string]*Event // nil — событие удалено пакетом
+}
+
+// newBatchView создает представление поверх хранилища s
+func newBatchView(s EventStore) *batchView {
+	return &batchView{EventStore: s, changed: make(map[string]*Event)}
+}
+
+// set запоминает новое состояние события; nil означает удаление
+func (v *batchView) set(id string, event *Event) {
+	v.changed[id] = event
+}
+
+// Get возвращает событие с учетом изменений пакета
+func (v *batchView) Get(ctx context.Context, id string) (Event, error) {
+	if event, ok := v.changed[id]; ok {
+		if event == nil {
+			return Event{}, ErrEventNotFound
+		}
+		return *event, nil
+	}
+	return v.EventStore.Get(ctx, id)
+}
+
+// ListByUser возвращает события пользователя с учетом изменений пакета
+func (v *batchView) ListByUser(ctx context.Context, userID string) ([]Event, error) {
+	events, err := v.EventStore.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return v.merge(events, func(event Event) bool { return roleOf(event, userID) != "" }), nil
+}
+
+// Overlapping возвращает пересекающиеся события с учетом изменений пакета
+func (v *batchView) Overlapping(ctx context.Context, userID string, from, to time.Time) ([]Event, error) {
+	events, err := v.EventStore.Overlapping(ctx, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	window := Interval{Start: from, End: to}
+	return v.merge(events, func(event Event) bool {
+		return roleOf(event, userID) != "" && eventSpan(event).overlaps(window)
+	}), nil
+}
+
+// merge заменяет в events измененные пакетом события их новым состоянием,
+// если оно подходит под match
+func (v *batchView) merge(events []Event, match func(Event) bool) []Event {
+	results := make([]Event, 0, len(events))
+	for _, event := range events {
+		if _, ok := v.changed[event.ID]; !ok {
+			results = append(results, event)
+		}
+	}
+	for _, event := range v.changed {
+		if event != nil && match(*event) {
+			results = append(results, *event)
+		}
+	}
+	return results
+}
+
+// BatchOperation операция запроса /batch. Для create задаются user_id и
+// event, для update — id и изменяемые поля event, для delete — id.
+type BatchOperation struct {
+	Op     string     `json:"op"`
+	ID     string     `json:"id,omitempty"`
+	UserID string     `json:"user_id,omitempty"`
+	Event  eventInput `json:"event"`
+}
+
+// BatchResult результат отдельной операции пакета. Если пакет отменен,
+// операции без собственной ошибки получают статус 424.
+type BatchResult struct {
+	Index     int      `json:"index"`
+	Op        string   `json:"op"`
+	ID        string   `json:"id,omitempty"`
+	Status    int      `json:"status"`
+	Event     *Event   `json:"event,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// BatchResponse ответ на запрос /batch
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// decodeBatch читает JSON-массив операций, отвергая неизвестные поля
+func decodeBatch(r *http.Request) ([]BatchOperation, error) {
+	var ops []BatchOperation
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&ops); err != nil {
+		return nil, fmt.Errorf("invalid request body: %v", err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("invalid request body: unexpected data after JSON array")
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+	if len(ops) > maxBatchOps {
+		return nil, fmt.Errorf("too many operations: at most %d per batch", maxBatchOps)
+	}
+	return ops, nil
+}
+
+// batchOwners возвращает владельцев событий, которых касается пакет, чтобы
+// захватить их блокировки. Владелец события не меняется при изменении,
+// поэтому набор остается верным и после захвата.
+func batchOwners(r *http.Request, ops []BatchOperation) []string {
+	var owners []string
+	for _, op := range ops {
+		if op.Op == changeCreate {
+			if userID, err := actingUser(r, op.UserID); err == nil && userID != "" {
+				owners = append(owners, userID)
+			}
+			continue
+		}
+		if event, err := store.Get(r.Context(), op.ID); err == nil {
+			owners = append(owners, event.UserID)
+		}
+	}
+	return owners
+}
+
+// batchHandler обработчик для пакетного изменения событий (POST /batch).
+// Тело — JSON-массив операций create, update (частичное изменение, как
+// PATCH в API v2) и delete (удаляет серию целиком). Операции выполняются по
+// порядку и видят результаты предыдущих; пакет применяется атомарно: при
+// ошибке любой операции не применяется ни одна. Параметр reject_overlap
+// проверяет пересечения с учетом всего пакета.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	ops, err := decodeBatch(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rejectOverlap, err := parseRejectOverlap(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	unlock := userLocks.lockAll(batchOwners(r, ops))
+	defer unlock()
+
+	ctx := r.Context()
+	view := newBatchView(store)
+	results := make([]BatchResult, len(ops))
+	var storeOps []storeOp
+	var opIndex []int // номер операции запроса для каждой операции хранилища
+	fail := func(i, status int, err error) {
+		results[i].Status, results[i].Error = status, err.Error()
+	}
+
+	for i, op := range ops {
+		results[i] = BatchResult{Index: i, Op: op.Op, ID: op.ID}
+		switch op.Op {
+		case changeCreate:
+			userID, err := actingUser(r, op.UserID)
+			if err != nil {
+				fail(i, storeErrorStatus(err), err)
+				continue
+			}
+			if userID == "" {
+				fail(i, http.StatusBadRequest, fmt.Errorf("missing user_id"))
+				continue
+			}
+			if op.ID != "" {
+				fail(i, http.StatusBadRequest, fmt.Errorf("id is assigned by the server"))
+				continue
+			}
+			event := Event{ID: newEventID(), UserID: userID}
+			op.Event.applyTo(&event)
+			if err := validateEvent(event); err != nil {
+				fail(i, http.StatusUnprocessableEntity, err)
+				continue
+			}
+			if err := validateCalendar(event); err != nil {
+				fail(i, storeErrorStatus(err), err)
+				continue
+			}
+			view.set(event.ID, &event)
+			storeOps, opIndex = append(storeOps, storeOp{Op: changeCreate, Event: event}), append(opIndex, i)
+			results[i].ID, results[i].Status, results[i].Event = event.ID, http.StatusCreated, &event
+
+		case changeUpdate:
+			if op.ID == "" {
+				fail(i, http.StatusBadRequest, fmt.Errorf("missing id"))
+				continue
+			}
+			existing, err := batchTarget(ctx, view, op.ID)
+			if err == nil && !canModify(ctx, existing) {
+				err = ErrForbidden
+			}
+			if err != nil {
+				fail(i, storeErrorStatus(err), err)
+				continue
+			}
+			event := existing
+			op.Event.applyTo(&event)
+			keepServerFields(&event, existing)
+			if err := validateEvent(event); err != nil {
+				fail(i, http.StatusUnprocessableEntity, err)
+				continue
+			}
+			if err := validateCalendar(event); err != nil {
+				fail(i, storeErrorStatus(err), err)
+				continue
+			}
+			view.set(event.ID, &event)
+			storeOps, opIndex = append(storeOps, storeOp{Op: changeUpdate, Event: event}), append(opIndex, i)
+
+			// Повторения серии переходят в ее новый календарь
+			if event.RRule != "" && event.CalendarID != existing.CalendarID {
+				userEvents, err := view.ListByUser(ctx, existing.UserID)
+				if err != nil {
+					fail(i, http.StatusInternalServerError, err)
+					continue
+				}
+				for _, override := range userEvents {
+					if override.SeriesID == event.ID && override.CalendarID != event.CalendarID {
+						moved := override
+						moved.CalendarID = event.CalendarID
+						view.set(moved.ID, &moved)
+						storeOps, opIndex = append(storeOps, storeOp{Op: changeUpdate, Event: moved}), append(opIndex, i)
+					}
+				}
+			}
+			results[i].Status, results[i].Event = http.StatusOK, &event
+
+		case changeDelete:
+			if op.ID == "" {
+				fail(i, http.StatusBadRequest, fmt.Errorf("missing id"))
+				continue
+			}
+			existing, err := batchTarget(ctx, view, op.ID)
+			if err == nil && !canDelete(ctx, existing) {
+				err = ErrForbidden
+			}
+			if err != nil {
+				fail(i, storeErrorStatus(err), err)
+				continue
+			}
+			ids := []string{op.ID}
+			if existing.RRule != "" {
+				userEvents, err := view.ListByUser(ctx, existing.UserID)
+				if err != nil {
+					fail(i, http.StatusInternalServerError, err)
+					continue
+				}
+				for _, override := range userEvents {
+					if override.SeriesID == op.ID {
+						ids = append(ids, override.ID)
+					}
+				}
+			}
+			for _, id := range ids {
+				view.set(id, nil)
+				storeOps, opIndex = append(storeOps, storeOp{Op: changeDelete, ID: id}), append(opIndex, i)
+			}
+			results[i].Status = http.StatusNoContent
+
+		default:
+			fail(i, http.StatusBadRequest, fmt.Errorf("unknown op %q: must be create, update or delete", op.Op))
+		}
+	}
+
+	// Пересечения проверяются по итоговому состоянию пакета
+	if rejectOverlap {
+		for i := range results {
+			if results[i].Event == nil || results[i].Error != "" {
+				continue
+			}
+			final, err := view.Get(ctx, results[i].ID)
+			if err != nil {
+				continue
+			}
+			conflicts, err := findConflictsIn(ctx, view, final)
+			if err != nil {
+				fail(i, http.StatusInternalServerError, err)
+				continue
+			}
+			if len(conflicts) > 0 {
+				fail(i, http.StatusConflict, fmt.Errorf("event overlaps existing events"))
+				results[i].Conflicts = conflicts
+			}
+		}
+	}
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Error != "" {
+			status = result.Status
+			break
+		}
+	}
+	if status == http.StatusOK {
+		if err := store.Apply(ctx, storeOps); err != nil {
+			status = storeErrorStatus(err)
+			var opErr *batchError
+			if errors.As(err, &opErr) {
+				fail(opIndex[opErr.Index], status, opErr.Err)
+			} else {
+				for i := range results {
+					fail(i, status, err)
+				}
+			}
+		}
+	}
+
+	if status != http.StatusOK {
+		for i := range results {
+			if results[i].Error == "" {
+				fail(i, http.StatusFailedDependency, fmt.Errorf("batch aborted"))
+			}
+			if results[i].Op == changeCreate {
+				results[i].ID = ""
+			}
+			results[i].Event = nil
+		}
+	}
+	writeJSON(w, status, BatchResponse{Committed: status == http.StatusOK, Results: results})
+}
+
+// batchTarget возвращает событие, которое изменяет или удаляет операция;
+// недоступное пользователю запроса событие считается отсутствующим
+func batchTarget(ctx context.Context, view *batchView, id string) (Event, error) {
+	existing, err := view.Get(ctx, id)
+	if err == nil && !canRead(ctx, existing) {
+		err = ErrEventNotFound
+	}
+	return existing, err
+}
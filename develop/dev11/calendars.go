@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrCalendarNotFound календарь не найден
+var ErrCalendarNotFound = errors.New("calendar not found")
+
+// Видимость календаря: события закрытого календаря видят владелец и
+// участники событий, открытого — все пользователи
+const (
+	visibilityPrivate = "private"
+	visibilityPublic  = "public"
+)
+
+// Что делать с событиями удаляемого календаря
+const (
+	cascadeDelete = "delete" // удалить вместе с календарем
+	cascadeKeep   = "keep"   // перенести в календарь по умолчанию
+)
+
+// defaultCalendarFilter значение calendar_id в фильтре, выбирающее события
+// календаря по умолчанию. Оно не может совпасть с ID календаря.
+const defaultCalendarFilter = "default"
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Calendar именованный календарь пользователя. События без календаря
+// относятся к календарю по умолчанию, который отдельно не хранится.
+type Calendar struct {
+	ID         string `json:"id"`
+	UserID     string `json:"user_id"`
+	Name       string `json:"name"`
+	Color      string `json:"color,omitempty"`
+	Visibility string `json:"visibility"`
+}
+
+// calendarStore хранит календари в памяти и, если задан путь, сохраняет их
+// в JSON-файл при каждом изменении
+type calendarStore struct {
+	mu        sync.RWMutex
+	path      string
+	calendars map[string]Calendar
+}
+
+var calendars = newCalendarStore() // Календари пользователей
+
+// newCalendarStore создает хранилище календарей в памяти
+func newCalendarStore() *calendarStore {
+	return &calendarStore{calendars: make(map[string]Calendar)}
+}
+
+// openCalendarStore загружает календари из файла path
+func openCalendarStore(path string) (*calendarStore, error) {
+	s := newCalendarStore()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read calendars: %w", err)
+	}
+	if err := fromJSON(data, &s.calendars); err != nil {
+		return nil, fmt.Errorf("decode calendars: %w", err)
+	}
+	return s, nil
+}
+
+// Get возвращает календарь по ID
+func (s *calendarStore) Get(id string) (Calendar, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.calendars[id]
+	if !ok {
+		return Calendar{}, ErrCalendarNotFound
+	}
+	return c, nil
+}
+
+// ListByUser возвращает календари пользователя, упорядоченные по имени
+func (s *calendarStore) ListByUser(userID string) []Calendar {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	results := []Calendar{}
+	for _, c := range s.calendars {
+		if c.UserID == userID {
+			results = append(results, c)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Name != results[j].Name {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+// Put сохраняет новый или измененный календарь
+func (s *calendarStore) Put(c Calendar) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updated := s.copyLocked()
+	updated[c.ID] = c
+	return s.replaceLocked(updated)
+}
+
+// Delete удаляет календарь
+func (s *calendarStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.calendars[id]; !ok {
+		return ErrCalendarNotFound
+	}
+	updated := s.copyLocked()
+	delete(updated, id)
+	return s.replaceLocked(updated)
+}
+
+// copyLocked возвращает копию календарей; вызывающий должен держать s.mu
+func (s *calendarStore) copyLocked() map[string]Calendar {
+	copied := make(map[string]Calendar, len(s.calendars)+1)
+	for id, c := range s.calendars {
+		copied[id] = c
+	}
+	return copied
+}
+
+// replaceLocked записывает календари в файл и только затем подменяет ими
+// календари в памяти, чтобы при ошибке записи они не расходились
+func (s *calendarStore) replaceLocked(updated map[string]Calendar) error {
+	if err := s.save(updated); err != nil {
+		return err
+	}
+	s.calendars = updated
+	return nil
+}
+
+// save записывает календари в файл, если он задан
+func (s *calendarStore) save(byID map[string]Calendar) error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := toJSON(byID)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return fmt.Errorf("write calendars: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("rename calendars: %w", err)
+	}
+	return nil
+}
+
+// isPublic проверяет, что календарь открыт для всех пользователей
+func (s *calendarStore) isPublic(id string) bool {
+	if id == "" {
+		return false
+	}
+	c, err := s.Get(id)
+	return err == nil && c.Visibility == visibilityPublic
+}
+
+// validateCalendar проверяет, что календарь события существует и
+// принадлежит владельцу события
+func validateCalendar(event Event) error {
+	if event.CalendarID == "" {
+		return nil
+	}
+	c, err := calendars.Get(event.CalendarID)
+	if err != nil {
+		return err
+	}
+	if c.UserID != event.UserID {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// moveOverrides переносит отдельно измененные повторения серии в ее
+// календарь: повторение всегда находится в календаре серии
+func moveOverrides(ctx context.Context, series Event) error {
+	if series.RRule == "" {
+		return nil
+	}
+	userEvents, err := store.ListByUser(ctx, series.UserID)
+	if err != nil {
+		return err
+	}
+	for _, override := range userEvents {
+		if override.SeriesID != series.ID || override.CalendarID == series.CalendarID {
+			continue
+		}
+		override.CalendarID = series.CalendarID
+		if err := store.Update(ctx, override); err != nil && !errors.Is(err, ErrEventNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseCalendarFilter парсит необязательный список calendar_id (через
+// запятую или повторением параметра); "default" выбирает календарь по
+// умолчанию. nil означает события всех календарей.
+func parseCalendarFilter(r *http.Request) (map[string]bool, error) {
+	var filter map[string]bool
+	for _, value := range r.URL.Query()["calendar_id"] {
+		for _, id := range strings.Split(value, ",") {
+			id = strings.TrimSpace(id)
+			switch {
+			case id == defaultCalendarFilter:
+				id = ""
+			case !validID(id):
+				return nil, fmt.Errorf("invalid calendar_id")
+			}
+			if filter == nil {
+				filter = make(map[string]bool)
+			}
+			filter[id] = true
+		}
+	}
+	return filter, nil
+}
+
+// inCalendars оставляет события из календарей filter
+func inCalendars(events []Event, filter map[string]bool) []Event {
+	if filter == nil {
+		return events
+	}
+	var results []Event
+	for _, event := range events {
+		if filter[event.CalendarID] {
+			results = append(results, event)
+		}
+	}
+	return results
+}
+
+// canManageCalendar проверяет право пользователя запроса изменять и удалять
+// календарь: это может только владелец
+func canManageCalendar(ctx context.Context, c Calendar) bool {
+	userID, ok := userFromContext(ctx)
+	return !ok || c.UserID == userID
+}
+
+// parseCalendarFields проверяет и переносит в календарь переданные поля
+// name, color и visibility. Отсутствующие поля не меняются.
+func parseCalendarFields(r *http.Request, c *Calendar) error {
+	if _, ok := r.Form["name"]; ok {
+		c.Name = strings.TrimSpace(r.FormValue("name"))
+	}
+	if _, ok := r.Form["color"]; ok {
+		c.Color = r.FormValue("color")
+	}
+	if _, ok := r.Form["visibility"]; ok {
+		c.Visibility = r.FormValue("visibility")
+	}
+
+	if c.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if c.Color != "" && !colorPattern.MatchString(c.Color) {
+		return fmt.Errorf("invalid color: must be #RRGGBB")
+	}
+	if c.Visibility != visibilityPrivate && c.Visibility != visibilityPublic {
+		return fmt.Errorf("invalid visibility: must be private or public")
+	}
+	return nil
+}
+
+// calendarsHandler обработчик для списка календарей пользователя (GET
+// /calendars). Чужие календари видны, только если они открытые.
+func calendarsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	if actor, ok := userFromContext(r.Context()); ok && userID == "" {
+		userID = actor
+	}
+	if userID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing user_id"))
+		return
+	}
+
+	results := calendars.ListByUser(userID)
+	if authorizeUser(r, userID) != nil {
+		visible := []Calendar{}
+		for _, c := range results {
+			if c.Visibility == visibilityPublic {
+				visible = append(visible, c)
+			}
+		}
+		results = visible
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// createCalendarHandler обработчик для создания календаря (POST
+// /create_calendar). По умолчанию календарь закрытый.
+func createCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+	userID, err := actingUser(r, r.FormValue("user_id"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if userID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing user_id"))
+		return
+	}
+
+	c := Calendar{ID: ids.next(), UserID: userID, Visibility: visibilityPrivate}
+	if err := parseCalendarFields(r, &c); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := calendars.Put(c); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
+
+// updateCalendarHandler обработчик для изменения календаря (POST
+// /update_calendar): меняются только переданные поля
+func updateCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseAndValidateID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	c, err := calendars.Get(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !canManageCalendar(r.Context(), c) {
+		writeStoreError(w, ErrForbidden)
+		return
+	}
+
+	if err := parseCalendarFields(r, &c); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := calendars.Put(c); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// deleteCalendarHandler обработчик для удаления календаря (POST
+// /delete_calendar). Параметр events задает судьбу событий календаря:
+// delete (по умолчанию) удаляет их, keep переносит в календарь по
+// умолчанию. События изменяются одним пакетом до удаления календаря, так
+// что при ошибке календарь и его события остаются прежними.
+func deleteCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseAndValidateID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	cascade := r.FormValue("events")
+	if cascade == "" {
+		cascade = cascadeDelete
+	}
+	if cascade != cascadeDelete && cascade != cascadeKeep {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid events: must be delete or keep"))
+		return
+	}
+
+	c, err := calendars.Get(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !canManageCalendar(r.Context(), c) {
+		writeStoreError(w, ErrForbidden)
+		return
+	}
+
+	// Календарь удаляется первым, поэтому новое событие в него уже не
+	// попадет, а блокировка владельца не дает изменить его события, пока
+	// они удаляются или переносятся. Если это не удалось, календарь
+	// восстанавливается.
+	unlock := userLocks.lock(c.UserID)
+	defer unlock()
+
+	if err := calendars.Delete(id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	restore := func() {
+		if err := calendars.Put(c); err != nil {
+			log.Printf("Could not restore calendar %s: %s\n", id, err)
+		}
+	}
+
+	userEvents, err := store.ListByUser(r.Context(), c.UserID)
+	if err != nil {
+		restore()
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var ops []storeOp
+	for _, event := range userEvents {
+		if event.CalendarID != id || event.UserID != c.UserID {
+			continue
+		}
+		if cascade == cascadeDelete {
+			ops = append(ops, storeOp{Op: changeDelete, ID: event.ID})
+		} else {
+			event.CalendarID = ""
+			ops = append(ops, storeOp{Op: changeUpdate, Event: event})
+		}
+	}
+	if len(ops) > 0 {
+		if err := store.Apply(r.Context(), ops); err != nil {
+			restore()
+			writeStoreError(w, err)
+			return
+		}
+	}
+
+	result := fmt.Sprintf("calendar deleted, %d events deleted", len(ops))
+	if cascade == cascadeKeep {
+		result = fmt.Sprintf("calendar deleted, %d events moved to the default calendar", len(ops))
+	}
+	writeJSON(w, http.StatusOK, JSONResponse{Result: result})
+}
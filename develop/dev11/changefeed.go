@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFeedCapacity = 1000             // изменений в журнале для возобновления
+	feedSubscriberQueue = 64               // изменений в очереди одного подписчика
+	feedHeartbeat       = 15 * time.Second // комментарий для поддержания соединения
+)
+
+// FeedEntry изменение события в ленте. Event отсутствует при удалении.
+type FeedEntry struct {
+	Seq     uint64 `json:"seq"`
+	Op      string `json:"op"`
+	EventID string `json:"event_id"`
+	Event   *Event `json:"event,omitempty"`
+
+	old *Event // прежнее состояние для фильтрации по участникам
+}
+
+// visibleTo проверяет, касается ли изменение пользователя: он участвовал в
+// событии до изменения или участвует после
+func (e FeedEntry) visibleTo(userID string) bool {
+	return (e.Event != nil && roleOf(*e.Event, userID) != "") || (e.old != nil && roleOf(*e.old, userID) != "")
+}
+
+// readableBy проверяет право пользователя запроса видеть изменение
+func (e FeedEntry) readableBy(ctx context.Context) bool {
+	return (e.Event != nil && canRead(ctx, *e.Event)) || (e.old != nil && canRead(ctx, *e.old))
+}
+
+// feedSubscriber подписчик ленты. Если подписчик не успевает читать и его
+// очередь переполнена, он отключается и возобновляет чтение по Last-Event-ID.
+type feedSubscriber struct {
+	entries chan FeedEntry
+	dropped chan struct{}
+}
+
+// changeFeed лента изменений событий с ограниченным журналом в памяти.
+// Номера изменений монотонно растут и между запусками: отсчет начинается с
+// текущего времени в микросекундах, поэтому номер из прошлого запуска всегда
+// меньше номеров нового и распознается как устаревший.
+type changeFeed struct {
+	mu          sync.Mutex
+	seq         uint64
+	log         []FeedEntry // кольцевой буфер
+	start       int
+	capacity    int
+	subscribers map[*feedSubscriber]struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+var feed = newChangeFeed(defaultFeedCapacity) // Лента изменений для /changes
+
+// newChangeFeed создает ленту, хранящую последние capacity изменений
+func newChangeFeed(capacity int) *changeFeed {
+	return &changeFeed{
+		seq:         uint64(time.Now().UnixMicro()),
+		capacity:    capacity,
+		subscribers: make(map[*feedSubscriber]struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// onChange добавляет изменение в журнал и рассылает подписчикам;
+// подписывается на observedStore
+func (f *changeFeed) onChange(change storeChange) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq++
+	entry := FeedEntry{Seq: f.seq, Op: change.Op, EventID: change.ID, Event: change.Event, old: change.Old}
+	if len(f.log) < f.capacity {
+		f.log = append(f.log, entry)
+	} else {
+		f.log[f.start] = entry
+		f.start = (f.start + 1) % f.capacity
+	}
+
+	for sub := range f.subscribers {
+		select {
+		case sub.entries <- entry:
+		default:
+			delete(f.subscribers, sub)
+			close(sub.dropped)
+		}
+	}
+}
+
+// subscribe регистрирует подписчика и возвращает изменения после lastSeq из
+// журнала. complete равен false, если часть изменений уже вытеснена из
+// журнала и клиенту нужно перечитать состояние целиком.
+func (f *changeFeed) subscribe(lastSeq uint64, resume bool) (sub *feedSubscriber, backlog []FeedEntry, complete bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub = &feedSubscriber{entries: make(chan FeedEntry, feedSubscriberQueue), dropped: make(chan struct{})}
+	f.subscribers[sub] = struct{}{}
+	if !resume {
+		return sub, nil, true
+	}
+
+	oldest := f.seq + 1
+	if len(f.log) > 0 {
+		oldest = f.log[f.start].Seq
+	}
+	complete = lastSeq+1 >= oldest && lastSeq <= f.seq
+	for i := 0; i < len(f.log); i++ {
+		entry := f.log[(f.start+i)%len(f.log)]
+		if entry.Seq > lastSeq {
+			backlog = append(backlog, entry)
+		}
+	}
+	return sub, backlog, complete
+}
+
+// unsubscribe отключает подписчика
+func (f *changeFeed) unsubscribe(sub *feedSubscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribers, sub)
+}
+
+// Close завершает все потоки ленты; вызывается при остановке сервера
+func (f *changeFeed) Close() {
+	f.closeOnce.Do(func() { close(f.closed) })
+}
+
+// writeFeedEntry отправляет изменение в формате Server-Sent Events
+func writeFeedEntry(w http.ResponseWriter, entry FeedEntry) error {
+	data, err := toJSON(entry)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", entry.Seq, entry.Op, data)
+	return err
+}
+
+// changesHandler обработчик потока изменений событий (GET /changes) в
+// формате Server-Sent Events. Параметр user_id оставляет только изменения
+// событий, в которых пользователь участвовал до или после изменения.
+// Заголовок Last-Event-ID (или параметр last_event_id) возобновляет поток с
+// изменения, следующего за указанным; если оно уже вытеснено из журнала,
+// первым приходит событие reset.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastSeq uint64
+	if lastEventID != "" {
+		var err error
+		if lastSeq, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid Last-Event-ID"))
+			return
+		}
+	}
+
+	// Поток живет дольше WriteTimeout сервера
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	f := feed
+	sub, backlog, complete := f.subscribe(lastSeq, lastEventID != "")
+	defer f.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(entry FeedEntry) error {
+		if (userID != "" && !entry.visibleTo(userID)) || !entry.readableBy(r.Context()) {
+			return nil
+		}
+		return writeFeedEntry(w, entry)
+	}
+
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, entry := range backlog {
+		if err := send(entry); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case entry := <-sub.entries:
+			if err := send(entry); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-sub.dropped:
+			return
+		case <-f.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Config настройки сервера. Значения берутся по возрастанию приоритета:
+// значения по умолчанию, JSON-файл (флаг -config или CONFIG_FILE),
+// переменные окружения, флаги командной строки.
+type Config struct {
+	Listen           string   `json:"listen"`
+	MetricsListen    string   `json:"metrics_listen"`
+	TLSCert          string   `json:"tls_cert"`
+	TLSKey           string   `json:"tls_key"`
+	Storage          string   `json:"storage"`
+	StorageDir       string   `json:"storage_dir"`
+	LogLevel         string   `json:"log_level"`
+	RejectOverlap    bool     `json:"reject_overlap"`
+	RateLimits       string   `json:"rate_limits"`
+	MaxBodyBytes     int64    `json:"max_body_bytes"`
+	MaxEventsPerUser int      `json:"max_events_per_user"`
+	AuthUsersFile    string   `json:"auth_users_file"`
+	Timeouts         Timeouts `json:"timeouts"`
+}
+
+// Timeouts таймауты HTTP-сервера
+type Timeouts struct {
+	ReadHeader Duration `json:"read_header"`
+	Read       Duration `json:"read"`
+	Write      Duration `json:"write"`
+	Idle       Duration `json:"idle"`
+	Shutdown   Duration `json:"shutdown"`
+}
+
+// defaultConfig возвращает настройки по умолчанию
+func defaultConfig() Config {
+	return Config{
+		Listen:           ":8080",
+		Storage:          storageMemory,
+		StorageDir:       "data",
+		LogLevel:         "info",
+		RateLimits:       defaultRateLimits,
+		MaxBodyBytes:     defaultMaxBodyBytes,
+		MaxEventsPerUser: defaultMaxEventsPerUser,
+		Timeouts: Timeouts{
+			ReadHeader: Duration(readHeaderTimeout),
+			Read:       Duration(readTimeout),
+			Write:      Duration(writeTimeout),
+			Idle:       Duration(idleTimeout),
+			Shutdown:   Duration(shutdownTimeout),
+		},
+	}
+}
+
+// configOption настройка, задаваемая переменной окружения и флагом
+type configOption struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+// configOptions настройки, доступные через окружение и флаги
+var configOptions = []configOption{
+	{"port", "PORT", "port to listen on all interfaces; shorthand for -listen", func(c *Config, v string) error {
+		c.Listen = ":" + v
+		return nil
+	}},
+	{"listen", "LISTEN_ADDR", "listen address, host:port", setString(func(c *Config) *string { return &c.Listen })},
+	{"metrics-listen", "METRICS_LISTEN", "separate listen address of /metrics; metrics are disabled if empty", setString(func(c *Config) *string { return &c.MetricsListen })},
+	{"tls-cert", "TLS_CERT", "TLS certificate file; enables HTTPS together with -tls-key", setString(func(c *Config) *string { return &c.TLSCert })},
+	{"tls-key", "TLS_KEY", "TLS private key file", setString(func(c *Config) *string { return &c.TLSKey })},
+	{"storage", "STORAGE", "storage backend: memory or file", setString(func(c *Config) *string { return &c.Storage })},
+	{"storage-dir", "STORAGE_DIR", "directory of the file storage backend", setString(func(c *Config) *string { return &c.StorageDir })},
+	{"log-level", "LOG_LEVEL", "log level: debug, info, warn or error", setString(func(c *Config) *string { return &c.LogLevel })},
+	{"reject-overlap", "REJECT_OVERLAP", "reject overlapping events by default", func(c *Config, v string) error {
+		value, err := strconv.ParseBool(v)
+		c.RejectOverlap = value
+		return err
+	}},
+	{"rate-limits", "RATE_LIMITS", "rate limits, route=rate:burst separated by commas", setString(func(c *Config) *string { return &c.RateLimits })},
+	{"max-body-bytes", "MAX_BODY_BYTES", "maximum request body size", func(c *Config, v string) error {
+		value, err := strconv.ParseInt(v, 10, 64)
+		c.MaxBodyBytes = value
+		return err
+	}},
+	{"max-events-per-user", "MAX_EVENTS_PER_USER", "maximum events owned by one user, 0 for no limit", func(c *Config, v string) error {
+		value, err := strconv.Atoi(v)
+		c.MaxEventsPerUser = value
+		return err
+	}},
+	{"auth-users-file", "AUTH_USERS_FILE", "user registry file; enables authentication", setString(func(c *Config) *string { return &c.AuthUsersFile })},
+	{"read-header-timeout", "READ_HEADER_TIMEOUT", "timeout for reading request headers", setDuration(func(c *Config) *Duration { return &c.Timeouts.ReadHeader })},
+	{"read-timeout", "READ_TIMEOUT", "timeout for reading the whole request", setDuration(func(c *Config) *Duration { return &c.Timeouts.Read })},
+	{"write-timeout", "WRITE_TIMEOUT", "timeout for writing the response", setDuration(func(c *Config) *Duration { return &c.Timeouts.Write })},
+	{"idle-timeout", "IDLE_TIMEOUT", "timeout for idle keep-alive connections", setDuration(func(c *Config) *Duration { return &c.Timeouts.Idle })},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "time to drain requests on shutdown", setDuration(func(c *Config) *Duration { return &c.Timeouts.Shutdown })},
+}
+
+// boolOptions флаги, которые можно указать без значения
+var boolOptions = map[string]bool{"reject-overlap": true}
+
+// setString возвращает установщик строковой настройки
+func setString(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+// setDuration возвращает установщик интервала вида "30s"
+func setDuration(field func(c *Config) *Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		return field(c).UnmarshalText([]byte(value))
+	}
+}
+
+// loadConfig собирает настройки из файла, окружения getenv и аргументов
+// командной строки args и проверяет их. Все найденные ошибки возвращаются
+// вместе.
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	fs := flag.NewFlagSet("dev11", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("CONFIG_FILE"), "JSON configuration file")
+	flags := make(map[string]string)
+	for _, option := range configOptions {
+		name := option.flag
+		save := func(value string) error {
+			flags[name] = value
+			return nil
+		}
+		if boolOptions[name] {
+			fs.BoolFunc(name, option.usage+" (env "+option.env+")", save)
+		} else {
+			fs.Func(name, option.usage+" (env "+option.env+")", save)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	config := defaultConfig()
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return Config{}, fmt.Errorf("read config: %w", err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return Config{}, fmt.Errorf("parse config %s: %w", *configPath, err)
+		}
+	}
+
+	var errs []error
+	for _, option := range configOptions {
+		if value := getenv(option.env); value != "" {
+			if err := option.set(&config, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %q", option.env, value))
+			}
+		}
+	}
+	for _, option := range configOptions {
+		if value, ok := flags[option.flag]; ok {
+			if err := option.set(&config, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid -%s: %q", option.flag, value))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return Config{}, errors.Join(errs...)
+	}
+
+	if err := config.validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// validateListen проверяет адрес вида host:port настройки name
+func validateListen(name, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid %s address %q: %w", name, addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid %s port %q", name, port)
+	}
+	return nil
+}
+
+// validate проверяет настройки и возвращает все найденные ошибки
+func (c Config) validate() error {
+	var errs []error
+
+	if err := validateListen("listen", c.Listen); err != nil {
+		errs = append(errs, err)
+	}
+	if c.MetricsListen != "" {
+		if err := validateListen("metrics_listen", c.MetricsListen); err != nil {
+			errs = append(errs, err)
+		} else if c.MetricsListen == c.Listen {
+			errs = append(errs, fmt.Errorf("metrics_listen must differ from listen"))
+		}
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, fmt.Errorf("tls_cert and tls_key must be set together"))
+	}
+	for _, path := range []string{c.TLSCert, c.TLSKey, c.AuthUsersFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("cannot access %s: %w", path, err))
+		}
+	}
+
+	switch c.Storage {
+	case storageMemory:
+	case storageFile:
+		if c.StorageDir == "" {
+			errs = append(errs, fmt.Errorf("storage_dir is required for the file backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown storage backend %q: must be memory or file", c.Storage))
+	}
+
+	if _, err := c.logLevel(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log_level %q: must be debug, info, warn or error", c.LogLevel))
+	}
+	if _, err := parseRateLimits(c.RateLimits); err != nil {
+		errs = append(errs, err)
+	}
+	if c.MaxBodyBytes <= 0 {
+		errs = append(errs, fmt.Errorf("max_body_bytes must be positive"))
+	}
+	if c.MaxEventsPerUser < 0 {
+		errs = append(errs, fmt.Errorf("max_events_per_user must not be negative"))
+	}
+
+	timeouts := []struct {
+		name  string
+		value Duration
+	}{
+		{"read_header", c.Timeouts.ReadHeader},
+		{"read", c.Timeouts.Read},
+		{"write", c.Timeouts.Write},
+		{"idle", c.Timeouts.Idle},
+		{"shutdown", c.Timeouts.Shutdown},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value <= 0 {
+			errs = append(errs, fmt.Errorf("timeout %s must be positive", timeout.name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// logLevel возвращает уровень журналирования
+func (c Config) logLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	return level, err
+}
+
+// tls проверяет, нужно ли обслуживать HTTPS
+func (c Config) tls() bool {
+	return c.TLSCert != ""
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conflictHorizon ограничивает проверку пересечений бесконечных серий
+const conflictHorizon = 366 * 24 * time.Hour
+
+// maxFreeBusyRange ограничивает интервал запроса занятости
+const maxFreeBusyRange = 92 * 24 * time.Hour
+
+// rejectOverlapDefault включает отказ в создании пересекающихся событий для
+// запросов без параметра reject_overlap
+var rejectOverlapDefault bool
+
+// userLocks сериализует проверку пересечений и запись событий одного
+// пользователя, чтобы два параллельных запроса не заняли одно время
+var userLocks keyedMutex
+
+// keyedMutex набор мьютексов по ключу
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockAll захватывает мьютексы нескольких ключей в порядке сортировки, чтобы
+// параллельные вызовы не взаимоблокировались
+func (k *keyedMutex) lockAll(keys []string) func() {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	var unlocks []func()
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		unlocks = append(unlocks, k.lock(key))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// lock захватывает мьютекс ключа и возвращает функцию освобождения
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// parseRejectOverlap определяет, включен ли режим отказа при пересечении
+func parseRejectOverlap(r *http.Request) (bool, error) {
+	value := r.FormValue("reject_overlap")
+	if value == "" {
+		return rejectOverlapDefault, nil
+	}
+	reject, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid reject_overlap: %v", err)
+	}
+	return reject, nil
+}
+
+// occurrenceIntervals возвращает интервалы повторений события, пересекающиеся
+// с [from, to)
+func occurrenceIntervals(event Event, from, to time.Time) []Interval {
+	duration := event.EndTime.Sub(event.StartTime)
+	window := Interval{Start: from, End: to}
+
+	var results []Interval
+	for _, occurrence := range occurrencesBetween(event, from.Add(-duration), to) {
+		interval := Interval{Start: occurrence.StartTime, End: occurrence.EndTime}
+		if interval.overlaps(window) {
+			results = append(results, interval)
+		}
+	}
+	return results
+}
+
+// findConflicts возвращает ID событий владельца, пересекающихся с event, в
+// том числе событий, приглашение на которые он не отклонил.
+// Само событие, его серия в исключаемом повторении и измененные повторения
+// самой серии не считаются конфликтами.
+func findConflicts(ctx context.Context, event Event) ([]string, error) {
+	return findConflictsIn(ctx, store, event)
+}
+
+// findConflictsIn ищет конфликты события среди событий хранилища s
+func findConflictsIn(ctx context.Context, s EventStore, event Event) ([]string, error) {
+	span := eventSpan(event)
+	if limit := event.StartTime.Add(conflictHorizon); span.End.After(limit) {
+		span.End = limit
+	}
+
+	own := occurrenceIntervals(event, span.Start, span.End)
+	if len(own) == 0 {
+		return nil, nil
+	}
+
+	candidates, err := s.Overlapping(ctx, event.UserID, span.Start, span.End)
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []string
+	for _, candidate := range candidates {
+		if candidate.ID == event.ID || (event.ID != "" && candidate.SeriesID == event.ID) {
+			continue
+		}
+		if !busyFor(candidate, event.UserID) {
+			continue
+		}
+		if candidate.ID == event.SeriesID && event.RecurrenceID != nil {
+			candidate.ExDates = append(append([]time.Time(nil), candidate.ExDates...), *event.RecurrenceID)
+		}
+		if intervalsOverlap(own, occurrenceIntervals(candidate, span.Start, span.End)) {
+			conflicts = append(conflicts, candidate.ID)
+		}
+	}
+	return conflicts, nil
+}
+
+// intervalsOverlap проверяет, пересекается ли хотя бы один интервал a с
+// каким-либо интервалом b. Оба списка упорядочены по началу.
+func intervalsOverlap(a, b []Interval) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].overlaps(b[j]) {
+			return true
+		}
+		if a[i].End.Before(b[j].End) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return false
+}
+
+// writeConflict отправляет ответ 409 со списком пересекающихся событий
+func writeConflict(w http.ResponseWriter, conflicts []string) {
+	writeJSON(w, http.StatusConflict, JSONResponse{Error: "event overlaps existing events", Conflicts: conflicts})
+}
+
+// checkConflicts в режиме reject отправляет 409, если событие пересекается
+// с другими, и возвращает false, если обработку нужно прекратить
+func checkConflicts(w http.ResponseWriter, r *http.Request, event Event, reject bool) bool {
+	if !reject {
+		return true
+	}
+	conflicts, err := findConflicts(r.Context(), event)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	if len(conflicts) > 0 {
+		writeConflict(w, conflicts)
+		return false
+	}
+	return true
+}
+
+// FreeBusy ответ на запрос занятости: объединенные занятые интервалы всех
+// пользователей и общие свободные окна
+type FreeBusy struct {
+	Busy []Interval `json:"busy"`
+	Free []Interval `json:"free"`
+}
+
+// busyIntervals возвращает объединенные занятые интервалы пользователей в [from, to)
+func busyIntervals(ctx context.Context, userIDs []string, from, to time.Time) ([]Interval, error) {
+	window := Interval{Start: from, End: to}
+
+	var busy []Interval
+	for _, userID := range userIDs {
+		candidates, err := store.Overlapping(ctx, userID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range candidates {
+			if !busyFor(event, userID) {
+				continue
+			}
+			for _, interval := range occurrenceIntervals(event, from, to) {
+				if interval.Start.Before(window.Start) {
+					interval.Start = window.Start
+				}
+				if interval.End.After(window.End) {
+					interval.End = window.End
+				}
+				busy = append(busy, interval)
+			}
+		}
+	}
+	return mergeIntervals(busy), nil
+}
+
+// parseUserIDs разбирает список пользователей из повторяющегося или
+// перечисленного через запятую параметра user_ids
+func parseUserIDs(r *http.Request) []string {
+	var userIDs []string
+	seen := make(map[string]struct{})
+	for _, value := range r.URL.Query()["user_ids"] {
+		for _, userID := range strings.Split(value, ",") {
+			userID = strings.TrimSpace(userID)
+			if _, dup := seen[userID]; userID == "" || dup {
+				continue
+			}
+			seen[userID] = struct{}{}
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
+// freeBusyHandler обработчик для получения занятости нескольких пользователей
+// и общих свободных окон не короче min_duration
+func freeBusyHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userIDs := parseUserIDs(r)
+	if len(userIDs) == 0 || query.Get("from") == "" || query.Get("to") == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing user_ids, from or to"))
+		return
+	}
+
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %v", err))
+		return
+	}
+	to, err := time.Parse(time.RFC3339, query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %v", err))
+		return
+	}
+	if !to.After(from) || to.Sub(from) > maxFreeBusyRange {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid time range"))
+		return
+	}
+
+	var minDuration time.Duration
+	if value := query.Get("min_duration"); value != "" {
+		if minDuration, err = time.ParseDuration(value); err != nil || minDuration < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid min_duration"))
+			return
+		}
+	}
+
+	busy, err := busyIntervals(r.Context(), userIDs, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result := FreeBusy{Busy: busy, Free: freeSlots(busy, from, to, minDuration)}
+	if result.Busy == nil {
+		result.Busy = []Interval{}
+	}
+	if result.Free == nil {
+		result.Free = []Interval{}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Таймауты HTTP-сервера
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 15 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
+	shutdownTimeout   = 30 * time.Second // срок на завершение текущих запросов
+)
+
+// ready становится true, когда хранилище загружено, и снова false, когда
+// сервер начинает остановку
+var ready atomic.Bool
+
+// healthPaths отвечают до готовности хранилища и не требуют токена
+var healthPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// HealthResponse ответ проверок живости и готовности
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// healthzHandler проверка живости: процесс запущен и обслуживает запросы
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// readyzHandler проверка готовности: хранилище загружено и сервер не
+// останавливается
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: "unavailable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// readinessMiddleware отвечает 503 на запросы к API, пока хранилище не загружено
+func readinessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() && !healthPaths[r.URL.Path] {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("service is not ready"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
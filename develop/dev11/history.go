@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHistoryRetention = 30 * 24 * time.Hour // сколько хранится история удаленного события
+	maxEventVersions        = 100                 // версий на событие, старые вытесняются
+	historyCompactMin       = 1000                // записей в журнале, после которых он может сжиматься
+)
+
+// ErrVersionNotFound версия события не найдена в истории
+var ErrVersionNotFound = errors.New("version not found")
+
+// EventVersion версия события: кто и когда изменил событие, состояние до
+// изменения (Old) и после (New)
+type EventVersion struct {
+	EventID string    `json:"event_id"`
+	Version int       `json:"version"`
+	Op      string    `json:"op"`
+	Actor   string    `json:"actor,omitempty"`
+	At      time.Time `json:"at"`
+	Old     *Event    `json:"old,omitempty"`
+	New     *Event    `json:"new,omitempty"`
+}
+
+// historyStore хранит историю изменений событий. Если задан путь, версии
+// дописываются в JSON-журнал и загружаются из него при запуске. История
+// удаленного события хранится retention, после чего восстановить его нельзя.
+// Когда вытесненных и истекших записей в журнале становится больше, чем
+// живых версий, журнал переписывается только с живыми версиями.
+type historyStore struct {
+	mu        sync.Mutex
+	versions  map[string][]EventVersion
+	deletedAt map[string]time.Time
+	retention time.Duration
+	live      int // версий в памяти
+	path      string
+	file      *os.File
+	records   int // записей в журнале
+	now       func() time.Time
+}
+
+var history = newHistoryStore(defaultHistoryRetention) // История изменений событий
+
+// newHistoryStore создает историю в памяти
+func newHistoryStore(retention time.Duration) *historyStore {
+	return &historyStore{
+		versions:  make(map[string][]EventVersion),
+		deletedAt: make(map[string]time.Time),
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+// openHistoryStore загружает историю из журнала path. Истекшие записи при
+// загрузке отбрасываются и журнал перезаписывается без них.
+func openHistoryStore(path string, retention time.Duration) (*historyStore, error) {
+	h := newHistoryStore(retention)
+
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("open history: %w", err)
+	default:
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+		for scanner.Scan() {
+			var version EventVersion
+			if err := fromJSON(scanner.Bytes(), &version); err != nil {
+				// Неполная последняя строка после сбоя
+				log.Printf("Skipping corrupt history record: %s\n", err)
+				continue
+			}
+			h.add(version)
+		}
+		err := scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read history: %w", err)
+		}
+	}
+
+	h.prune()
+	h.path = path
+	if err := h.compact(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// compact переписывает журнал только с живыми версиями и открывает его для
+// дописывания; вызывающий должен держать h.mu, если история уже используется
+func (h *historyStore) compact() error {
+	if err := h.rewrite(h.path); err != nil {
+		return err
+	}
+	if h.file != nil {
+		h.file.Close()
+	}
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		h.file = nil
+		return fmt.Errorf("open history: %w", err)
+	}
+	h.file = f
+	h.records = h.live
+	return nil
+}
+
+// rewrite атомарно записывает текущую историю в файл path
+func (h *historyStore) rewrite(path string) error {
+	var data []byte
+	for _, versions := range h.versions {
+		for _, version := range versions {
+			line, err := toJSON(version)
+			if err != nil {
+				return err
+			}
+			data = append(append(data, line...), '\n')
+		}
+	}
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return fmt.Errorf("write history: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename history: %w", err)
+	}
+	return nil
+}
+
+// add добавляет версию; вызывающий должен держать h.mu, если история уже используется
+func (h *historyStore) add(version EventVersion) {
+	versions := append(h.versions[version.EventID], version)
+	h.live++
+	if len(versions) > maxEventVersions {
+		h.live -= len(versions) - maxEventVersions
+		versions = append([]EventVersion(nil), versions[len(versions)-maxEventVersions:]...)
+	}
+	h.versions[version.EventID] = versions
+
+	if version.Op == changeDelete {
+		h.deletedAt[version.EventID] = version.At
+	} else {
+		delete(h.deletedAt, version.EventID)
+	}
+}
+
+// prune удаляет историю событий, удаленных раньше срока хранения
+func (h *historyStore) prune() {
+	limit := h.now().Add(-h.retention)
+	for id, at := range h.deletedAt {
+		if at.Before(limit) {
+			h.live -= len(h.versions[id])
+			delete(h.deletedAt, id)
+			delete(h.versions, id)
+		}
+	}
+}
+
+// onChange записывает изменение события как новую версию; подписывается на
+// observedStore
+func (h *historyStore) onChange(change storeChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	next := 1
+	if versions := h.versions[change.ID]; len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+	}
+	version := EventVersion{
+		EventID: change.ID,
+		Version: next,
+		Op:      change.Op,
+		Actor:   change.Actor,
+		At:      change.At,
+		Old:     change.Old,
+		New:     change.Event,
+	}
+	h.add(version)
+	h.prune()
+
+	if h.file != nil {
+		if err := h.writeVersion(version); err != nil {
+			log.Printf("Could not write history: %s\n", err)
+		}
+	}
+}
+
+// writeVersion дописывает версию в журнал и сбрасывает ее на диск, как и WAL
+// хранилища. Разросшийся журнал сжимается.
+func (h *historyStore) writeVersion(version EventVersion) error {
+	line, err := toJSON(version)
+	if err != nil {
+		return err
+	}
+	if _, err := h.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write history: %w", err)
+	}
+	if err := h.file.Sync(); err != nil {
+		return fmt.Errorf("sync history: %w", err)
+	}
+	h.records++
+
+	if h.records > historyCompactMin && h.records > 2*h.live {
+		return h.compact()
+	}
+	return nil
+}
+
+// list возвращает версии события от старых к новым
+func (h *historyStore) list(id string) ([]EventVersion, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.prune()
+	versions, ok := h.versions[id]
+	return append([]EventVersion(nil), versions...), ok
+}
+
+// Close закрывает журнал истории
+func (h *historyStore) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
+
+// latestState возвращает последнее известное состояние события
+func latestState(versions []EventVersion) Event {
+	last := versions[len(versions)-1]
+	if last.New != nil {
+		return *last.New
+	}
+	return *last.Old
+}
+
+// HistoryResponse история изменений события
+type HistoryResponse struct {
+	EventID  string         `json:"event_id"`
+	Versions []EventVersion `json:"versions"`
+}
+
+// eventHistoryHandler обработчик для получения истории изменений события
+// (GET /event_history), в том числе удаленного в пределах срока хранения
+func eventHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseAndValidateID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	versions, ok := history.list(id)
+	if !ok {
+		writeStoreError(w, ErrEventNotFound)
+		return
+	}
+	if !canRead(r.Context(), latestState(versions)) {
+		writeStoreError(w, ErrForbidden)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, HistoryResponse{EventID: id, Versions: versions})
+}
+
+// revertEventHandler обработчик для возврата события к состоянию после
+// версии version (POST /revert_event). Удаленное событие восстанавливается,
+// если срок хранения его истории не истек; восстанавливать может только
+// владелец. Измененные повторения серии восстанавливаются отдельно.
+func revertEventHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseAndValidateID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	number, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil || number < 1 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid version"))
+		return
+	}
+	rejectOverlap, err := parseRejectOverlap(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	versions, ok := history.list(id)
+	if !ok {
+		writeStoreError(w, ErrEventNotFound)
+		return
+	}
+	var target *EventVersion
+	for i := range versions {
+		if versions[i].Version == number {
+			target = &versions[i]
+		}
+	}
+	if target == nil {
+		writeError(w, http.StatusNotFound, ErrVersionNotFound)
+		return
+	}
+	if target.New == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("version %d is a deletion; revert to an earlier version", number))
+		return
+	}
+	event := *target.New
+
+	unlock := userLocks.lock(event.UserID)
+	defer unlock()
+
+	// Календарь мог быть удален после этой версии: событие
+	// восстанавливается в календаре по умолчанию
+	if _, err := calendars.Get(event.CalendarID); event.CalendarID != "" && err != nil {
+		event.CalendarID = ""
+	}
+
+	current, err := store.Get(r.Context(), id)
+	switch {
+	case err == nil:
+		if !canModify(r.Context(), current) || !canModify(r.Context(), event) {
+			writeStoreError(w, ErrForbidden)
+			return
+		}
+		if !checkConflicts(w, r, event, rejectOverlap) {
+			return
+		}
+		err = store.Update(r.Context(), event)
+		if err == nil && event.CalendarID != current.CalendarID {
+			err = moveOverrides(r.Context(), event)
+		}
+	case errors.Is(err, ErrEventNotFound):
+		if !canDelete(r.Context(), latestState(versions)) || !canDelete(r.Context(), event) {
+			writeStoreError(w, ErrForbidden)
+			return
+		}
+		if !checkConflicts(w, r, event, rejectOverlap) {
+			return
+		}
+		err = store.Create(r.Context(), event)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, JSONResponse{Result: fmt.Sprintf("event reverted to version %d", number)})
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	icalTimeLayout  = "20060102T150405Z"
+	icalLineLimit   = 75
+	icalProductID   = "-//L2//dev11 calendar//RU"
+	maxICSImportLen = 10 << 20
+)
+
+// icalEscaper экранирует текстовые значения iCalendar (RFC 5545, 3.3.11)
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// icalUnescaper снимает экранирование текстовых значений iCalendar
+var icalUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// encodeICS сериализует события в документ VCALENDAR
+func encodeICS(w io.Writer, events []Event, now time.Time) error {
+	bw := bufio.NewWriter(w)
+	writeLine := func(line string) {
+		bw.WriteString(foldICalLine(line))
+		bw.WriteString("\r\n")
+	}
+
+	writeLine("BEGIN:VCALENDAR")
+	writeLine("VERSION:2.0")
+	writeLine("PRODID:" + icalProductID)
+	for _, event := range events {
+		// Измененное повторение разделяет UID со своей серией
+		uid := event.ID
+		if event.SeriesID != "" {
+			uid = event.SeriesID
+		}
+		writeLine("BEGIN:VEVENT")
+		writeLine("UID:" + uid)
+		writeLine("DTSTAMP:" + now.UTC().Format(icalTimeLayout))
+		writeLine("DTSTART" + icalDateTime(event.StartTime, event.TimeZone))
+		writeLine("DTEND" + icalDateTime(event.EndTime, event.TimeZone))
+		writeLine("SUMMARY:" + icalEscaper.Replace(event.Title))
+		if event.RRule != "" {
+			writeLine("RRULE:" + event.RRule)
+		}
+		for _, exdate := range event.ExDates {
+			writeLine("EXDATE:" + exdate.UTC().Format(icalTimeLayout))
+		}
+		if event.SeriesID != "" && event.RecurrenceID != nil {
+			writeLine("RECURRENCE-ID:" + event.RecurrenceID.UTC().Format(icalTimeLayout))
+		}
+		writeLine("END:VEVENT")
+	}
+	writeLine("END:VCALENDAR")
+
+	return bw.Flush()
+}
+
+// icalDateTime форматирует параметры и значение DTSTART/DTEND: в часовом
+// поясе серии с TZID, чтобы повторения не сдвигались при переходе на летнее
+// время, иначе в UTC
+func icalDateTime(t time.Time, timeZone string) string {
+	if loc, err := time.LoadLocation(timeZone); err == nil && timeZone != "" && loc != time.UTC {
+		return ";TZID=" + timeZone + ":" + t.In(loc).Format("20060102T150405")
+	}
+	return ":" + t.UTC().Format(icalTimeLayout)
+}
+
+// foldICalLine разбивает строку длиннее 75 октетов на строки продолжения,
+// не разрывая многобайтовые символы UTF-8
+func foldICalLine(line string) string {
+	if len(line) <= icalLineLimit {
+		return line
+	}
+
+	var b strings.Builder
+	limit := icalLineLimit
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// Строка продолжения начинается с пробела, он входит в лимит
+		limit = icalLineLimit - 1
+	}
+	b.WriteString(line)
+	return b.String()
+}
+
+// icalProperty свойство компонента iCalendar
+type icalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icalEvent компонент VEVENT в виде набора свойств
+type icalEvent struct {
+	Properties []icalProperty
+}
+
+// get возвращает первое свойство с именем name
+func (e icalEvent) get(name string) (icalProperty, bool) {
+	for _, prop := range e.Properties {
+		if prop.Name == name {
+			return prop, true
+		}
+	}
+	return icalProperty{}, false
+}
+
+// unfoldICalLines читает строки документа, склеивая строки продолжения
+func unfoldICalLines(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxICSImportLen)
+
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseICalProperty разбирает строку вида NAME;PARAM=VALUE:value
+func parseICalProperty(line string) (icalProperty, error) {
+	// Двоеточие внутри параметров может стоять только в кавычках
+	inQuotes := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			inQuotes = !inQuotes
+		}
+		if c == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return icalProperty{}, fmt.Errorf("malformed line %q", line)
+	}
+
+	// Точка с запятой разделяет параметры, только если стоит вне кавычек
+	var parts []string
+	inQuotes = false
+	begin := 0
+	for i := 0; i < colon; i++ {
+		switch line[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ';':
+			if !inQuotes {
+				parts = append(parts, line[begin:i])
+				begin = i + 1
+			}
+		}
+	}
+	parts = append(parts, line[begin:colon])
+
+	prop := icalProperty{
+		Name:   strings.ToUpper(parts[0]),
+		Params: make(map[string]string),
+		Value:  line[colon+1:],
+	}
+	for _, param := range parts[1:] {
+		key, value, _ := strings.Cut(param, "=")
+		prop.Params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+	return prop, nil
+}
+
+// decodeICS разбирает документ VCALENDAR на компоненты VEVENT
+func decodeICS(r io.Reader) ([]icalEvent, error) {
+	lines, err := unfoldICalLines(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, fmt.Errorf("not an iCalendar document")
+	}
+
+	var events []icalEvent
+	var current *icalEvent
+	depth := 0 // вложенные компоненты (VALARM) внутри VEVENT пропускаются
+
+	for _, line := range lines {
+		prop, err := parseICalProperty(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VEVENT") && current == nil:
+			current = &icalEvent{}
+		case prop.Name == "END" && strings.EqualFold(prop.Value, "VEVENT") && current != nil && depth == 0:
+			events = append(events, *current)
+			current = nil
+		case prop.Name == "BEGIN" && current != nil:
+			depth++
+		case prop.Name == "END" && current != nil:
+			depth--
+		case current != nil && depth == 0:
+			current.Properties = append(current.Properties, prop)
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("unterminated VEVENT")
+	}
+	return events, nil
+}
+
+// parseICalDateTime переводит значение DTSTART/DTEND/EXDATE во время с учетом
+// TZID и VALUE=DATE. Время без зоны считается UTC.
+func parseICalDateTime(prop icalProperty) (time.Time, bool, error) {
+	loc := time.UTC
+	if tzid := prop.Params["TZID"]; tzid != "" {
+		var err error
+		if loc, err = time.LoadLocation(tzid); err != nil {
+			return time.Time{}, false, fmt.Errorf("unknown TZID %q", tzid)
+		}
+	}
+
+	value := strings.TrimSpace(prop.Value)
+	if strings.EqualFold(prop.Params["VALUE"], "DATE") || len(value) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icalTimeLayout, value)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+// eventFromICal строит событие пользователя userID из компонента VEVENT
+func eventFromICal(component icalEvent, userID string) (Event, string, error) {
+	event := Event{UserID: userID}
+
+	uidProp, _ := component.get("UID")
+	uid := uidProp.Value
+
+	summary, ok := component.get("SUMMARY")
+	if !ok || summary.Value == "" {
+		return event, uid, fmt.Errorf("missing SUMMARY")
+	}
+	event.Title = icalUnescaper.Replace(summary.Value)
+
+	dtstart, ok := component.get("DTSTART")
+	if !ok {
+		return event, uid, fmt.Errorf("missing DTSTART")
+	}
+	start, allDay, err := parseICalDateTime(dtstart)
+	if err != nil {
+		return event, uid, fmt.Errorf("invalid DTSTART: %v", err)
+	}
+	event.StartTime = start.UTC()
+
+	if dtend, ok := component.get("DTEND"); ok {
+		end, _, err := parseICalDateTime(dtend)
+		if err != nil {
+			return event, uid, fmt.Errorf("invalid DTEND: %v", err)
+		}
+		event.EndTime = end.UTC()
+	} else if duration, ok := component.get("DURATION"); ok {
+		d, err := parseICalDuration(duration.Value)
+		if err != nil {
+			return event, uid, fmt.Errorf("invalid DURATION: %v", err)
+		}
+		event.EndTime = event.StartTime.Add(d)
+	} else if allDay {
+		event.EndTime = start.AddDate(0, 0, 1).UTC()
+	} else {
+		event.EndTime = event.StartTime
+	}
+
+	if rrule, ok := component.get("RRULE"); ok {
+		event.RRule = rrule.Value
+		// Серия повторяется по местному времени TZID
+		if !allDay {
+			event.TimeZone = dtstart.Params["TZID"]
+		}
+	}
+	for _, prop := range component.Properties {
+		if prop.Name != "EXDATE" {
+			continue
+		}
+		for _, value := range strings.Split(prop.Value, ",") {
+			exdate, _, err := parseICalDateTime(icalProperty{Params: prop.Params, Value: value})
+			if err != nil {
+				return event, uid, fmt.Errorf("invalid EXDATE: %v", err)
+			}
+			event.ExDates = append(event.ExDates, exdate.UTC())
+		}
+	}
+	if recurrenceID, ok := component.get("RECURRENCE-ID"); ok {
+		at, _, err := parseICalDateTime(recurrenceID)
+		if err != nil {
+			return event, uid, fmt.Errorf("invalid RECURRENCE-ID: %v", err)
+		}
+		at = at.UTC()
+		event.RecurrenceID = &at
+	}
+
+	return event, uid, validateEvent(event)
+}
+
+// parseICalDuration разбирает длительность iCalendar вида P1DT2H30M или PT15M
+func parseICalDuration(value string) (time.Duration, error) {
+	value = strings.TrimPrefix(value, "+")
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	var total time.Duration
+	var number int
+	inTime := false
+	for _, c := range value[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			number = number*10 + int(c-'0')
+		case c == 'T':
+			inTime = true
+		case c == 'W' && !inTime:
+			total += time.Duration(number) * 7 * 24 * time.Hour
+			number = 0
+		case c == 'D' && !inTime:
+			total += time.Duration(number) * 24 * time.Hour
+			number = 0
+		case c == 'H' && inTime:
+			total += time.Duration(number) * time.Hour
+			number = 0
+		case c == 'M' && inTime:
+			total += time.Duration(number) * time.Minute
+			number = 0
+		case c == 'S' && inTime:
+			total += time.Duration(number) * time.Second
+			number = 0
+		default:
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+	}
+	return total, nil
+}
+
+// exportICSHandler обработчик для выгрузки событий пользователя в формате iCalendar
+func exportICSHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing user_id"))
+		return
+	}
+
+	events, err := store.ListByUser(r.Context(), userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	events = readableEvents(r.Context(), events)
+	sortEvents(events)
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.ics"`, userID))
+	w.WriteHeader(http.StatusOK)
+	encodeICS(w, events, time.Now())
+}
+
+// importICSHandler обработчик для массового создания событий из файла
+// iCalendar. Файл передается телом запроса или полем file формы
+// multipart/form-data. Ошибки отдельных событий не мешают импорту остальных и
+// возвращаются в поле errors.
+func importICSHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		userID = r.FormValue("user_id")
+	}
+	userID, err := actingUser(r, userID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if userID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing user_id"))
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxICSImportLen)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid upload: %v", err))
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	components, err := decodeICS(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ics: %v", err))
+		return
+	}
+
+	created, errs := importICalEvents(r, userID, components)
+
+	writeJSON(w, http.StatusOK, JSONResponse{
+		Result: fmt.Sprintf("%d events imported", created),
+		Errors: errs,
+	})
+}
+
+// importICalEvents создает события из компонентов VEVENT. Сначала создаются
+// серии, затем отдельно измененные повторения, которые привязываются к сериям
+// по UID.
+func importICalEvents(r *http.Request, userID string, components []icalEvent) (int, []string) {
+	type parsed struct {
+		index int
+		uid   string
+		event Event
+	}
+
+	var errs []string
+	var masters, overrides []parsed
+	for i, component := range components {
+		event, uid, err := eventFromICal(component, userID)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("event %d (UID %q): %v", i+1, uid, err))
+			continue
+		}
+		if event.RecurrenceID != nil {
+			if event.RRule != "" {
+				errs = append(errs, fmt.Sprintf("event %d (UID %q): RRULE is not allowed with RECURRENCE-ID", i+1, uid))
+				continue
+			}
+			overrides = append(overrides, parsed{i, uid, event})
+		} else {
+			masters = append(masters, parsed{i, uid, event})
+		}
+	}
+
+	created := 0
+	seriesByUID := make(map[string]string)
+	for _, p := range masters {
+		p.event.ID = newEventID()
+		if err := store.Create(r.Context(), p.event); err != nil {
+			errs = append(errs, fmt.Sprintf("event %d (UID %q): %v", p.index+1, p.uid, err))
+			continue
+		}
+		seriesByUID[p.uid] = p.event.ID
+		created++
+	}
+
+	for _, p := range overrides {
+		seriesID, ok := seriesByUID[p.uid]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("event %d (UID %q): RECURRENCE-ID without series", p.index+1, p.uid))
+			continue
+		}
+		override := p.event
+		override.ID = newEventID()
+		override.RecurrenceID = nil
+		if err := updateOccurrence(r.Context(), seriesID, *p.event.RecurrenceID, override); err != nil {
+			errs = append(errs, fmt.Sprintf("event %d (UID %q): %v", p.index+1, p.uid, err))
+			continue
+		}
+		created++
+	}
+
+	return created, errs
+}
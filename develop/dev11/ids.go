@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	idLen       = 26 // 48 бит времени и 80 бит случайности в base32
+	idAlphabet  = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	maxLegacyID = 19 // цифр в старом ID из time.Now().UnixNano()
+)
+
+// idGenerator генерирует ID событий в формате ULID: миллисекунды времени и
+// случайный суффикс в base32 Крокфорда. ID сортируются по времени создания;
+// внутри одной миллисекунды суффикс увеличивается на единицу, поэтому
+// порядок сохраняется и ID не повторяются даже при грубых часах или
+// переводе часов назад.
+type idGenerator struct {
+	mu      sync.Mutex
+	lastMs  int64
+	suffix  [10]byte
+	now     func() time.Time
+	entropy io.Reader
+}
+
+var ids = newIDGenerator() // Генератор ID событий
+
+// newIDGenerator создает генератор на системных часах и crypto/rand
+func newIDGenerator() *idGenerator {
+	return &idGenerator{now: time.Now, entropy: rand.Reader}
+}
+
+// next возвращает следующий ID
+func (g *idGenerator) next() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.now().UnixMilli()
+	if ms > g.lastMs {
+		g.lastMs = ms
+		if _, err := io.ReadFull(g.entropy, g.suffix[:]); err != nil {
+			panic("ids: read entropy: " + err.Error())
+		}
+	} else if !increment(g.suffix[:]) {
+		// Суффикс исчерпан: занимаем следующую миллисекунду
+		g.lastMs++
+	}
+	return encodeID(g.lastMs, g.suffix)
+}
+
+// increment увеличивает число big-endian на единицу; false при переполнении
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeID кодирует 48 бит времени и 80 бит суффикса в 26 символов
+func encodeID(ms int64, suffix [10]byte) string {
+	var raw [16]byte
+	for i := 0; i < 6; i++ {
+		raw[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(raw[6:], suffix[:])
+
+	// 128 бит дополняются слева двумя нулевыми битами до 130 = 26 * 5
+	out := make([]byte, idLen)
+	var acc uint32
+	bits := 2
+	pos := 0
+	for _, b := range raw {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[pos] = idAlphabet[(acc>>bits)&31]
+			pos++
+		}
+	}
+	return string(out)
+}
+
+// newEventID возвращает ID для нового события
+func newEventID() string {
+	return ids.next()
+}
+
+// validID проверяет формат ID события: ULID или десятичный ID, которые
+// выдавались до перехода на ULID
+func validID(id string) bool {
+	if len(id) == idLen && id[0] <= '7' {
+		for i := 0; i < len(id); i++ {
+			if strings.IndexByte(idAlphabet, id[i]) < 0 {
+				return false
+			}
+		}
+		return true
+	}
+	if len(id) == 0 || len(id) > maxLegacyID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '0' || id[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
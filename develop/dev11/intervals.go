@@ -0,0 +1,198 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Interval полуоткрытый интервал времени [Start, End)
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// overlaps проверяет пересечение двух полуоткрытых интервалов
+func (i Interval) overlaps(other Interval) bool {
+	return i.Start.Before(other.End) && other.Start.Before(i.End)
+}
+
+// farFuture используется как конец бесконечной серии повторений
+var farFuture = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// eventSpan возвращает интервал, покрывающий все повторения события. Для
+// бесконечной серии конец интервала — farFuture.
+func eventSpan(event Event) Interval {
+	span := Interval{Start: event.StartTime, End: event.EndTime}
+	if event.RRule == "" {
+		return span
+	}
+
+	rule, err := parseRRule(event.RRule)
+	if err != nil {
+		return span
+	}
+
+	duration := event.EndTime.Sub(event.StartTime)
+	switch {
+	case !rule.Until.IsZero():
+		span.End = rule.Until.Add(duration)
+	case rule.Count > 0:
+		starts := expandRecurrence(seriesStart(event), rule, nil, event.StartTime, farFuture)
+		if len(starts) > 0 {
+			span.End = starts[len(starts)-1].Add(duration)
+		}
+	default:
+		span.End = farFuture
+	}
+	return span
+}
+
+// intervalEntry элемент индекса: интервал события и его ID
+type intervalEntry struct {
+	Interval
+	id string
+}
+
+// intervalIndex индекс интервалов событий одного пользователя. Элементы
+// упорядочены по началу, а maxEnd[i] хранит максимальный конец среди первых
+// i+1 элементов. Так как maxEnd не убывает, первый элемент, способный
+// пересечься с запросом, находится бинарным поиском, а просмотр
+// останавливается на первом элементе, начинающемся после конца запроса.
+// Бесконечные серии хранятся отдельно в open: иначе одна такая серия
+// подняла бы maxEnd всех следующих элементов до farFuture и запрос
+// превратился бы в перебор.
+type intervalIndex struct {
+	entries []intervalEntry
+	maxEnd  []time.Time
+	open    []intervalEntry
+}
+
+// insert добавляет интервал события в индекс
+func (ix *intervalIndex) insert(id string, span Interval) {
+	if span.End.Equal(farFuture) {
+		ix.open = append(ix.open, intervalEntry{Interval: span, id: id})
+		return
+	}
+
+	pos := sort.Search(len(ix.entries), func(i int) bool {
+		return ix.entries[i].Start.After(span.Start)
+	})
+	ix.entries = append(ix.entries, intervalEntry{})
+	copy(ix.entries[pos+1:], ix.entries[pos:])
+	ix.entries[pos] = intervalEntry{Interval: span, id: id}
+	ix.rebuildFrom(pos)
+}
+
+// remove удаляет интервал события из индекса
+func (ix *intervalIndex) remove(id string, span Interval) {
+	if span.End.Equal(farFuture) {
+		for i, entry := range ix.open {
+			if entry.id == id {
+				ix.open = append(ix.open[:i], ix.open[i+1:]...)
+				return
+			}
+		}
+		return
+	}
+
+	pos := sort.Search(len(ix.entries), func(i int) bool {
+		return !ix.entries[i].Start.Before(span.Start)
+	})
+	for ; pos < len(ix.entries) && ix.entries[pos].Start.Equal(span.Start); pos++ {
+		if ix.entries[pos].id == id {
+			ix.entries = append(ix.entries[:pos], ix.entries[pos+1:]...)
+			ix.rebuildFrom(pos)
+			return
+		}
+	}
+}
+
+// rebuildFrom пересчитывает maxEnd начиная с позиции pos
+func (ix *intervalIndex) rebuildFrom(pos int) {
+	ix.maxEnd = ix.maxEnd[:min(pos, len(ix.maxEnd))]
+	for i := pos; i < len(ix.entries); i++ {
+		end := ix.entries[i].End
+		if i > 0 && ix.maxEnd[i-1].After(end) {
+			end = ix.maxEnd[i-1]
+		}
+		ix.maxEnd = append(ix.maxEnd, end)
+	}
+}
+
+// query возвращает ID событий, интервалы которых пересекаются с [from, to)
+func (ix *intervalIndex) query(from, to time.Time) []string {
+	lo := sort.Search(len(ix.maxEnd), func(i int) bool {
+		return ix.maxEnd[i].After(from)
+	})
+
+	var ids []string
+	for i := lo; i < len(ix.entries) && ix.entries[i].Start.Before(to); i++ {
+		if ix.entries[i].End.After(from) {
+			ids = append(ids, ix.entries[i].id)
+		}
+	}
+	for _, entry := range ix.open {
+		if entry.Start.Before(to) {
+			ids = append(ids, entry.id)
+		}
+	}
+	return ids
+}
+
+// len возвращает количество интервалов в индексе
+func (ix *intervalIndex) len() int {
+	return len(ix.entries) + len(ix.open)
+}
+
+// mergeIntervals объединяет пересекающиеся и смежные интервалы
+func mergeIntervals(intervals []Interval) []Interval {
+	if len(intervals) == 0 {
+		return nil
+	}
+
+	sorted := append([]Interval(nil), intervals...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+
+	merged := []Interval{sorted[0]}
+	for _, interval := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if !interval.Start.After(last.End) {
+			if interval.End.After(last.End) {
+				last.End = interval.End
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
+
+// freeSlots возвращает промежутки внутри [from, to), не занятые busy, длиной
+// не меньше minDuration. busy должен быть результатом mergeIntervals.
+func freeSlots(busy []Interval, from, to time.Time, minDuration time.Duration) []Interval {
+	var free []Interval
+	cursor := from
+	for _, interval := range busy {
+		if interval.Start.After(cursor) {
+			end := interval.Start
+			if end.After(to) {
+				end = to
+			}
+			if end.Sub(cursor) >= minDuration && end.After(cursor) {
+				free = append(free, Interval{Start: cursor, End: end})
+			}
+		}
+		if interval.End.After(cursor) {
+			cursor = interval.End
+		}
+		if !cursor.Before(to) {
+			return free
+		}
+	}
+	if to.Sub(cursor) >= minDuration && to.After(cursor) {
+		free = append(free, Interval{Start: cursor, End: to})
+	}
+	return free
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrEventLimit превышено число событий пользователя
+var ErrEventLimit = errors.New("event limit reached")
+
+const (
+	defaultMaxBodyBytes     = 1 << 20
+	defaultMaxEventsPerUser = 10000
+	defaultRateLimits       = "default=20:40,/create_event=5:10,/import_ics=0.2:2"
+	bucketSweepInterval     = time.Minute
+)
+
+// bodyLimits максимальный размер тела для маршрутов, которым нужно больше
+// общего ограничения
+var bodyLimits = map[string]int64{
+	"/import_ics": maxICSImportLen,
+	"/batch":      maxBatchLen,
+}
+
+// rateQuota квота маршрута: пополнение корзины в секунду и ее емкость
+type rateQuota struct {
+	Rate  float64
+	Burst float64
+}
+
+// parseRateLimits разбирает квоты вида "default=20:40,/create_event=5:10",
+// где для каждого маршрута задано число запросов в секунду и емкость
+// корзины. Квота default применяется к маршрутам без собственной.
+func parseRateLimits(spec string) (map[string]rateQuota, error) {
+	quotas := make(map[string]rateQuota)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, value, ok := strings.Cut(entry, "=")
+		rateStr, burstStr, ok2 := strings.Cut(value, ":")
+		if !ok || !ok2 || route == "" {
+			return nil, fmt.Errorf("invalid rate limit %q: want route=rate:burst", entry)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("invalid rate limit %q: rate must be a positive number", entry)
+		}
+		burst, err := strconv.ParseFloat(burstStr, 64)
+		if err != nil || burst < 1 || math.IsInf(burst, 0) {
+			return nil, fmt.Errorf("invalid rate limit %q: burst must be at least 1", entry)
+		}
+		quotas[route] = rateQuota{Rate: rate, Burst: burst}
+	}
+	return quotas, nil
+}
+
+// tokenBucket корзина маркеров одного клиента на одном маршруте
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter ограничивает частоту запросов по алгоритму корзины маркеров.
+// Корзины создаются по паре (маршрут, клиент); заполненные до краев корзины
+// периодически удаляются, так как не отличаются от новых.
+type rateLimiter struct {
+	mu        sync.Mutex
+	quotas    map[string]rateQuota
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// newRateLimiter создает ограничитель с квотами по маршрутам
+func newRateLimiter(quotas map[string]rateQuota) *rateLimiter {
+	return &rateLimiter{quotas: quotas, buckets: make(map[string]*tokenBucket), now: time.Now}
+}
+
+// quota возвращает квоту маршрута или квоту по умолчанию
+func (l *rateLimiter) quota(route string) (rateQuota, bool) {
+	if q, ok := l.quotas[route]; ok {
+		return q, true
+	}
+	q, ok := l.quotas["default"]
+	return q, ok
+}
+
+// allow расходует маркер клиента на маршруте. Если маркеров нет, возвращает
+// время до появления следующего.
+func (l *rateLimiter) allow(route, client string) (bool, time.Duration) {
+	q, ok := l.quota(route)
+	if !ok {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > bucketSweepInterval {
+		l.sweep(now)
+	}
+
+	key := route + " " + client
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: q.Burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(q.Burst, b.tokens+now.Sub(b.last).Seconds()*q.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / q.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep удаляет корзины, которые успели заполниться; вызывающий должен держать l.mu
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		route, _, _ := strings.Cut(key, " ")
+		q, _ := l.quota(route)
+		if b.tokens+now.Sub(b.last).Seconds()*q.Rate >= q.Burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// clientKey определяет клиента: аутентифицированного пользователя или IP-адрес
+func clientKey(r *http.Request) string {
+	if userID, ok := userFromContext(r.Context()); ok {
+		return "user:" + userID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimitMiddleware middleware для ограничения частоты запросов. Должен
+// стоять после authMiddleware, чтобы квота считалась по пользователю.
+func rateLimitMiddleware(l *rateLimiter, mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if allowed, retryAfter := l.allow(route, clientKey(r)); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyLimitMiddleware middleware для ограничения размера тела запроса.
+// Запросы с заведомо большим Content-Length отвергаются сразу с 413.
+func bodyLimitMiddleware(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max := limit
+		if routeLimit, ok := bodyLimits[r.URL.Path]; ok {
+			max = routeLimit
+		}
+		if r.ContentLength > max {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body too large: limit is %d bytes", max))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedStore оборачивает хранилище и ограничивает число событий, которыми
+// владеет один пользователь. Проверка и создание выполняются под мьютексом,
+// поэтому параллельные запросы не превысят лимит.
+type limitedStore struct {
+	EventStore
+	mu         sync.Mutex
+	maxPerUser int
+}
+
+// limitStore оборачивает хранилище лимитом событий на пользователя; 0 — без лимита
+func limitStore(s EventStore, maxPerUser int) EventStore {
+	if maxPerUser <= 0 {
+		return s
+	}
+	return &limitedStore{EventStore: s, maxPerUser: maxPerUser}
+}
+
+// Create добавляет событие, если лимит владельца не исчерпан
+func (s *limitedStore) Create(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkLocked(ctx, event.UserID, 1); err != nil {
+		return err
+	}
+	return s.EventStore.Create(ctx, event)
+}
+
+// Update изменяет событие; при смене владельца проверяется лимит нового
+func (s *limitedStore) Update(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.EventStore.Get(ctx, event.ID)
+	if err != nil {
+		return err
+	}
+	if current.UserID != event.UserID {
+		if err := s.checkLocked(ctx, event.UserID, 1); err != nil {
+			return err
+		}
+	}
+	return s.EventStore.Update(ctx, event)
+}
+
+// checkLocked проверяет, что пользователь может получить еще delta событий;
+// вызывающий должен держать s.mu
+func (s *limitedStore) checkLocked(ctx context.Context, userID string, delta int) error {
+	events, err := s.EventStore.ListByUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	owned := 0
+	for _, e := range events {
+		if e.UserID == userID {
+			owned++
+		}
+	}
+	if owned+delta > s.maxPerUser {
+		return fmt.Errorf("%w: at most %d events per user", ErrEventLimit, s.maxPerUser)
+	}
+	return nil
+}
+
+// Apply выполняет пакет операций, если после него ни один владелец не
+// превысит лимит событий. Владелец события отслеживается по ходу пакета,
+// так что смена UserID учитывается у нового владельца.
+func (s *limitedStore) Apply(ctx context.Context, ops []storeOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owners := make(map[string]string) // владелец после уже просмотренных операций; "" — удалено
+	owner := func(id string) (string, bool) {
+		if userID, ok := owners[id]; ok {
+			return userID, userID != ""
+		}
+		event, err := s.EventStore.Get(ctx, id)
+		return event.UserID, err == nil
+	}
+
+	added := make(map[string]int)
+	for _, op := range ops {
+		switch op.Op {
+		case changeCreate:
+			added[op.Event.UserID]++
+			owners[op.Event.ID] = op.Event.UserID
+		case changeUpdate:
+			if userID, ok := owner(op.Event.ID); ok && userID != op.Event.UserID {
+				added[userID]--
+				added[op.Event.UserID]++
+			}
+			owners[op.Event.ID] = op.Event.UserID
+		case changeDelete:
+			if userID, ok := owner(op.ID); ok {
+				added[userID]--
+			}
+			owners[op.ID] = ""
+		}
+	}
+	for userID, delta := range added {
+		if delta <= 0 {
+			continue
+		}
+		if err := s.checkLocked(ctx, userID, delta); err != nil {
+			return err
+		}
+	}
+	return s.EventStore.Apply(ctx, ops)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	maxRequestIDLen = 128
+)
+
+type requestIDContextKey struct{}
+
+// withRequestID сохраняет ID запроса в контексте
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// requestIDFromContext возвращает ID запроса или пустую строку
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// requestLogger возвращает журнал, дополняющий записи ID запроса
+func requestLogger(ctx context.Context) *slog.Logger {
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		return slog.Default().With("request_id", requestID)
+	}
+	return slog.Default()
+}
+
+// newRequestID генерирует случайный ID запроса
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID проверяет ID запроса, пришедший от клиента: допускаются
+// только печатные ASCII-символы, чтобы ID нельзя было использовать для
+// подделки записей журнала
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < 0x21 || requestID[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// loggingMiddleware middleware для журналирования запросов в формате JSON.
+// ID запроса берется из заголовка X-Request-ID или генерируется, передается
+// обработчикам через контекст и возвращается клиенту в том же заголовке.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		r = r.WithContext(withRequestID(r.Context(), requestID))
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		// Строка запроса не пишется: в ней бывают пароли, токены и данные
+		// событий пользователей
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("request_id", requestID),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Int("bytes", recorder.size),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets границы гистограммы длительности запросов в секундах
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// userEventBuckets границы гистограммы числа событий у владельца
+var userEventBuckets = []float64{1, 10, 100, 1000, 10000}
+
+// requestKey метки счетчика запросов
+type requestKey struct {
+	route, method string
+	code          int
+}
+
+// histogram гистограмма с накопительными корзинами в формате Prometheus
+type histogram struct {
+	counts []uint64 // по корзинам latencyBuckets, без +Inf
+	count  uint64
+	sum    float64
+}
+
+// observe добавляет наблюдение
+func (h *histogram) observe(v float64) {
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// httpMetrics метрики HTTP-сервера
+type httpMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[string]*histogram
+	inFlight  atomic.Int64
+}
+
+var metrics = newHTTPMetrics() // Метрики, отдаваемые /metrics
+
+// newHTTPMetrics создает пустой набор метрик
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests:  make(map[requestKey]uint64),
+		latencies: make(map[string]*histogram),
+	}
+}
+
+// record учитывает завершенный запрос
+func (m *httpMetrics) record(route, method string, code int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{route: route, method: method, code: code}]++
+	h, ok := m.latencies[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[route] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+// statusRecorder запоминает код ответа обработчика и размер тела ответа
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+// WriteHeader реализует http.ResponseWriter
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write реализует http.ResponseWriter
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// Unwrap открывает исходный ResponseWriter для http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// metricsMiddleware middleware для учета запросов. Маршрут определяется по
+// шаблону mux, чтобы число меток не зависело от параметров запроса.
+func metricsMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "other"
+		if _, pattern := mux.Handler(r); pattern != "" {
+			route = pattern
+		}
+
+		metrics.inFlight.Add(1)
+		defer metrics.inFlight.Add(-1)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		metrics.record(route, r.Method, recorder.status, time.Since(start))
+	})
+}
+
+// escapeLabel экранирует значение метки по правилам формата Prometheus
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatFloat форматирует число для формата Prometheus
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// newMetricsMux создает маршрутизатор отдельного адреса метрик: /metrics
+// не публикуется вместе с API, так как раскрывает нагрузку и объем данных
+func newMetricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	return mux
+}
+
+// metricsHandler обработчик для выдачи метрик в текстовом формате
+// Prometheus. Доменные метрики вычисляются по хранилищу при каждом запросе;
+// события по владельцам отдаются гистограммой, а не меткой user_id, чтобы
+// число рядов не росло с числом пользователей.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	events, err := store.All(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	perUser := make(map[string]int)
+	for _, event := range events {
+		perUser[event.UserID]++
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	metrics.mu.Lock()
+	keys := make([]requestKey, 0, len(metrics.requests))
+	for key := range metrics.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	fmt.Fprintln(out, "# HELP calendar_http_requests_total Total HTTP requests by route, method and status code.")
+	fmt.Fprintln(out, "# TYPE calendar_http_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(out, "calendar_http_requests_total{route=\"%s\",method=\"%s\",code=\"%d\"} %d\n",
+			escapeLabel(key.route), escapeLabel(key.method), key.code, metrics.requests[key])
+	}
+
+	routes := make([]string, 0, len(metrics.latencies))
+	for route := range metrics.latencies {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	fmt.Fprintln(out, "# HELP calendar_http_request_duration_seconds HTTP request latency by route.")
+	fmt.Fprintln(out, "# TYPE calendar_http_request_duration_seconds histogram")
+	for _, route := range routes {
+		h := metrics.latencies[route]
+		label := escapeLabel(route)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(out, "calendar_http_request_duration_seconds_bucket{route=\"%s\",le=\"%s\"} %d\n", label, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(out, "calendar_http_request_duration_seconds_bucket{route=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(out, "calendar_http_request_duration_seconds_sum{route=\"%s\"} %s\n", label, formatFloat(h.sum))
+		fmt.Fprintf(out, "calendar_http_request_duration_seconds_count{route=\"%s\"} %d\n", label, h.count)
+	}
+	metrics.mu.Unlock()
+
+	fmt.Fprintln(out, "# HELP calendar_http_requests_in_flight HTTP requests currently being served.")
+	fmt.Fprintln(out, "# TYPE calendar_http_requests_in_flight gauge")
+	fmt.Fprintf(out, "calendar_http_requests_in_flight %d\n", metrics.inFlight.Load())
+
+	fmt.Fprintln(out, "# HELP calendar_events_total Stored events, counting each recurring series and override once.")
+	fmt.Fprintln(out, "# TYPE calendar_events_total gauge")
+	fmt.Fprintf(out, "calendar_events_total %d\n", len(events))
+
+	owners := make([]int, len(userEventBuckets))
+	for _, count := range perUser {
+		for i, bound := range userEventBuckets {
+			if float64(count) <= bound {
+				owners[i]++
+			}
+		}
+	}
+	fmt.Fprintln(out, "# HELP calendar_user_events Owners by number of stored events.")
+	fmt.Fprintln(out, "# TYPE calendar_user_events histogram")
+	for i, bound := range userEventBuckets {
+		fmt.Fprintf(out, "calendar_user_events_bucket{le=\"%s\"} %d\n", formatFloat(bound), owners[i])
+	}
+	fmt.Fprintf(out, "calendar_user_events_bucket{le=\"+Inf\"} %d\n", len(perUser))
+	fmt.Fprintf(out, "calendar_user_events_sum %d\n", len(events))
+	fmt.Fprintf(out, "calendar_user_events_count %d\n", len(perUser))
+}
@@ -0,0 +1,889 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Типы параметров запроса
+const (
+	typeString   = "string"
+	typeInteger  = "integer"
+	typeBoolean  = "boolean"
+	typeDateTime = "date-time" // RFC 3339
+	typeDate     = "date"      // 2006-01-02
+	typeDuration = "duration"  // строка time.ParseDuration, например 30m
+	typeID       = "id"        // ID события
+	typeTimeZone = "tz"        // имя часового пояса IANA
+)
+
+// Размещение параметров
+const (
+	inQuery  = "query" // строка запроса или поле формы
+	inPath   = "path"
+	inHeader = "header"
+)
+
+// Типы содержимого
+const (
+	contentJSON      = "application/json"
+	contentForm      = "application/x-www-form-urlencoded"
+	contentMultipart = "multipart/form-data"
+	contentCalendar  = "text/calendar"
+	contentStream    = "text/event-stream"
+)
+
+const maxFormMemory = 32 << 20
+
+// apiParam параметр операции
+type apiParam struct {
+	Name        string
+	In          string
+	Type        string
+	Description string
+	Required    bool
+	List        bool // можно повторять или перечислять через запятую
+	Enum        []string
+}
+
+// param создает необязательный параметр строки запроса или формы
+func param(name, typ, description string) apiParam {
+	return apiParam{Name: name, In: inQuery, Type: typ, Description: description}
+}
+
+// required помечает параметр обязательным
+func (p apiParam) required() apiParam {
+	p.Required = true
+	return p
+}
+
+// list разрешает несколько значений параметра
+func (p apiParam) list() apiParam {
+	p.List = true
+	return p
+}
+
+// oneOf ограничивает значения параметра перечнем
+func (p apiParam) oneOf(values ...string) apiParam {
+	p.Enum = values
+	return p
+}
+
+// inPath переносит параметр в путь
+func (p apiParam) inPath() apiParam {
+	p.In, p.Required = inPath, true
+	return p
+}
+
+// inHeader переносит параметр в заголовок
+func (p apiParam) inHeader() apiParam {
+	p.In = inHeader
+	return p
+}
+
+// apiResponse ответ операции: статус, тип содержимого и Go-тип тела, по
+// которому строится схема
+type apiResponse struct {
+	Status      int
+	Description string
+	Content     string
+	Body        reflect.Type
+}
+
+// apiOperation операция маршрута. Consumes — допустимые типы тела; для
+// форм параметры inQuery можно передать и в строке запроса, и в теле.
+type apiOperation struct {
+	Method    string
+	ID        string
+	Summary   string
+	Params    []apiParam
+	Consumes  []string
+	Body      reflect.Type // схема JSON-тела
+	Responses []apiResponse
+	Errors    []int
+}
+
+// apiRoute маршрут в шаблонном виде OpenAPI
+type apiRoute struct {
+	Path       string
+	Operations []apiOperation
+}
+
+var (
+	formBody     = []string{contentForm, contentMultipart}
+	jsonBody     = []string{contentJSON}
+	userIDParam  = param("user_id", typeString, "user acting on the calendar; taken from the token when authentication is enabled")
+	idParam      = param("id", typeID, "event ID").required()
+	rejectParam  = param("reject_overlap", typeBoolean, "reject the change with 409 if it overlaps the owner's events")
+	recurrenceID = param("recurrence_id", typeDateTime, "start of a single occurrence of a series")
+)
+
+// eventFormParams поля события в форме create_event и update_event
+var eventFormParams = []apiParam{
+	param("title", typeString, "event title").required(),
+	userIDParam,
+	param("start_time", typeDateTime, "event start").required(),
+	param("end_time", typeDateTime, "event end").required(),
+	param("calendar_id", typeString, "owner's calendar; the default calendar when empty, the series' calendar for an occurrence"),
+	param("rrule", typeString, "RFC 5545 recurrence rule, e.g. FREQ=WEEKLY;BYDAY=MO"),
+	param("exdate", typeDateTime, "excluded occurrence starts of a series").list(),
+	param("time_zone", typeTimeZone, "time zone in which a series repeats; occurrences keep their local time across DST changes"),
+	param("reminders", typeDuration, "reminder offsets before start, e.g. 15m").list(),
+	rejectParam,
+}
+
+// eventListParams параметры events_for_day, events_for_week и events_for_month
+var eventListParams = []apiParam{
+	userIDParam,
+	param("date", typeDate, "any day of the period").required(),
+	param("tz", typeTimeZone, "time zone of the period; defaults to the user's setting"),
+	param("calendar_id", typeString, "only events of these calendars; default selects the default calendar").list(),
+}
+
+// calendarParams изменяемые поля календаря
+var calendarParams = []apiParam{
+	param("name", typeString, "calendar name; required on creation"),
+	param("color", typeString, "color as #RRGGBB"),
+	param("visibility", typeString, "public calendars are readable by every user; private by default").oneOf(visibilityPrivate, visibilityPublic),
+}
+
+// ok описывает успешный JSON-ответ
+func ok(status int, description string, body interface{}) apiResponse {
+	return apiResponse{Status: status, Description: description, Content: contentJSON, Body: reflect.TypeOf(body)}
+}
+
+// withParams объединяет списки параметров
+func withParams(lists ...[]apiParam) []apiParam {
+	var params []apiParam
+	for _, list := range lists {
+		params = append(params, list...)
+	}
+	return params
+}
+
+// apiRoutes описание всех маршрутов newMux. Документ /openapi.json и
+// проверка запросов строятся по нему, поэтому новый маршрут нужно добавить и
+// сюда.
+var apiRoutes = []apiRoute{
+	{"/create_event", []apiOperation{{
+		Method: http.MethodPost, ID: "createEvent", Summary: "Create an event",
+		Params: eventFormParams, Consumes: formBody,
+		Responses: []apiResponse{ok(http.StatusCreated, "event created", JSONResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusConflict},
+	}}},
+	{"/update_event", []apiOperation{{
+		Method: http.MethodPost, ID: "updateEvent", Summary: "Replace an event or a single occurrence of a series",
+		Params: withParams([]apiParam{idParam, recurrenceID}, eventFormParams), Consumes: formBody,
+		Responses: []apiResponse{ok(http.StatusOK, "event updated", JSONResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+	}}},
+	{"/delete_event", []apiOperation{{
+		Method: http.MethodPost, ID: "deleteEvent", Summary: "Delete an event with its overrides or a single occurrence",
+		Params: []apiParam{idParam, recurrenceID}, Consumes: formBody,
+		Responses: []apiResponse{ok(http.StatusOK, "event deleted", JSONResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound},
+	}}},
+	{"/events_for_day", []apiOperation{{
+		Method: http.MethodGet, ID: "eventsForDay", Summary: "List occurrences of a calendar day",
+		Params:    eventListParams,
+		Responses: []apiResponse{ok(http.StatusOK, "occurrences; null when there are none", []Event{})},
+	}}},
+	{"/events_for_week", []apiOperation{{
+		Method: http.MethodGet, ID: "eventsForWeek", Summary: "List occurrences of an ISO week",
+		Params:    eventListParams,
+		Responses: []apiResponse{ok(http.StatusOK, "occurrences; null when there are none", []Event{})},
+	}}},
+	{"/events_for_month", []apiOperation{{
+		Method: http.MethodGet, ID: "eventsForMonth", Summary: "List occurrences of a calendar month",
+		Params:    eventListParams,
+		Responses: []apiResponse{ok(http.StatusOK, "occurrences; null when there are none", []Event{})},
+	}}},
+	{"/free_busy", []apiOperation{{
+		Method: http.MethodGet, ID: "freeBusy", Summary: "Merged busy intervals and common free slots of several users",
+		Params: []apiParam{
+			param("user_ids", typeString, "users to check").required().list(),
+			param("from", typeDateTime, "window start").required(),
+			param("to", typeDateTime, "window end").required(),
+			param("min_duration", typeDuration, "shortest free slot to return"),
+		},
+		Responses: []apiResponse{ok(http.StatusOK, "busy and free intervals", FreeBusy{})},
+	}}},
+	{"/suggest_meeting", []apiOperation{{
+		Method: http.MethodGet, ID: "suggestMeeting", Summary: "Ranked meeting slots within everyone's working hours",
+		Params: []apiParam{
+			param("user_ids", typeString, "participants").required().list(),
+			param("duration", typeDuration, "meeting length").required(),
+			param("from", typeDateTime, "search window start").required(),
+			param("to", typeDateTime, "search window end").required(),
+			param("step", typeDuration, "granularity of slot starts; 15m by default"),
+			param("limit", typeInteger, "number of slots, 1 to 100; 10 by default"),
+		},
+		Responses: []apiResponse{ok(http.StatusOK, "non-overlapping slots, best first", MeetingSuggestions{})},
+	}}},
+	{"/user_settings", []apiOperation{{
+		Method: http.MethodGet, ID: "getUserSettings", Summary: "Read user settings",
+		Params:    []apiParam{userIDParam},
+		Responses: []apiResponse{ok(http.StatusOK, "settings", UserSettings{})},
+		Errors:    []int{http.StatusForbidden},
+	}, {
+		Method: http.MethodPost, ID: "updateUserSettings", Summary: "Change user settings; absent fields are kept, empty ones reset",
+		Params: []apiParam{
+			userIDParam,
+			param("tz", typeTimeZone, "default time zone"),
+			param("working_hours", typeString, "working hours such as mon-fri 09:00-17:00; repeat for several ranges").list(),
+			param("holidays", typeDate, "days off").list(),
+		},
+		Consumes:  formBody,
+		Responses: []apiResponse{ok(http.StatusOK, "updated settings", UserSettings{})},
+		Errors:    []int{http.StatusForbidden},
+	}}},
+	{"/v2/users/{user_id}/events", []apiOperation{{
+		Method: http.MethodGet, ID: "listEventsV2", Summary: "List a user's events, expanded into occurrences with from and to",
+		Params: []apiParam{
+			param("user_id", typeString, "calendar owner").inPath(),
+			param("from", typeDateTime, "window start; requires to"),
+			param("to", typeDateTime, "window end; requires from"),
+		},
+		Responses: []apiResponse{ok(http.StatusOK, "events", []Event{})},
+	}, {
+		Method: http.MethodPost, ID: "createEventV2", Summary: "Create an event from JSON",
+		Params:   []apiParam{param("user_id", typeString, "calendar owner").inPath(), rejectParam},
+		Consumes: jsonBody, Body: reflect.TypeOf(eventInput{}),
+		Responses: []apiResponse{ok(http.StatusCreated, "created event with ETag and Location headers", Event{})},
+		Errors:    []int{http.StatusForbidden, http.StatusConflict, http.StatusUnprocessableEntity},
+	}}},
+	{"/v2/users/{user_id}/events/{id}", []apiOperation{{
+		Method: http.MethodGet, ID: "getEventV2", Summary: "Get an event",
+		Params: []apiParam{
+			param("user_id", typeString, "calendar owner").inPath(),
+			param("id", typeID, "event ID").inPath(),
+			param("If-None-Match", typeString, "ETag of a cached copy").inHeader(),
+		},
+		Responses: []apiResponse{ok(http.StatusOK, "event with ETag header", Event{}), {Status: http.StatusNotModified, Description: "cached copy is current"}},
+		Errors:    []int{http.StatusNotFound},
+	}, {
+		Method: http.MethodPut, ID: "replaceEventV2", Summary: "Replace an event",
+		Params: []apiParam{
+			param("user_id", typeString, "calendar owner").inPath(),
+			param("id", typeID, "event ID").inPath(),
+			param("If-Match", typeString, "ETag the change is based on").inHeader(),
+			rejectParam,
+		},
+		Consumes: jsonBody, Body: reflect.TypeOf(eventInput{}),
+		Responses: []apiResponse{ok(http.StatusOK, "updated event", Event{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusUnprocessableEntity},
+	}, {
+		Method: http.MethodPatch, ID: "patchEventV2", Summary: "Change the given fields of an event",
+		Params: []apiParam{
+			param("user_id", typeString, "calendar owner").inPath(),
+			param("id", typeID, "event ID").inPath(),
+			param("If-Match", typeString, "ETag the change is based on").inHeader(),
+			rejectParam,
+		},
+		Consumes: jsonBody, Body: reflect.TypeOf(eventInput{}),
+		Responses: []apiResponse{ok(http.StatusOK, "updated event", Event{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusUnprocessableEntity},
+	}, {
+		Method: http.MethodDelete, ID: "deleteEventV2", Summary: "Delete an event with its overrides",
+		Params: []apiParam{
+			param("user_id", typeString, "calendar owner").inPath(),
+			param("id", typeID, "event ID").inPath(),
+			param("If-Match", typeString, "ETag the deletion is based on").inHeader(),
+		},
+		Responses: []apiResponse{{Status: http.StatusNoContent, Description: "event deleted"}},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound, http.StatusPreconditionFailed},
+	}}},
+	{"/invite_attendee", []apiOperation{{
+		Method: http.MethodPost, ID: "inviteAttendee", Summary: "Invite a user to an event or change their role",
+		Params: []apiParam{
+			idParam,
+			param("attendee", typeString, "invited user").required(),
+			param("role", typeString, "attendee role; viewer by default").oneOf(roleEditor, roleViewer),
+			userIDParam,
+		},
+		Consumes:  formBody,
+		Responses: []apiResponse{ok(http.StatusOK, "attendee invited", JSONResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound},
+	}}},
+	{"/respond_invite", []apiOperation{{
+		Method: http.MethodPost, ID: "respondInvite", Summary: "Accept, decline or tentatively accept an invitation",
+		Params: []apiParam{
+			idParam,
+			param("attendee", typeString, "responding user").required(),
+			param("rsvp", typeString, "response").required().oneOf(rsvpAccepted, rsvpDeclined, rsvpTentative),
+		},
+		Consumes:  formBody,
+		Responses: []apiResponse{ok(http.StatusOK, "response recorded", JSONResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound},
+	}}},
+	{"/remove_attendee", []apiOperation{{
+		Method: http.MethodPost, ID: "removeAttendee", Summary: "Remove an attendee from an event",
+		Params: []apiParam{
+			idParam,
+			param("attendee", typeString, "user to remove").required(),
+			userIDParam,
+		},
+		Consumes:  formBody,
+		Responses: []apiResponse{ok(http.StatusOK, "attendee removed", JSONResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound},
+	}}},
+	{"/login", []apiOperation{{
+		Method: http.MethodPost, ID: "login", Summary: "Exchange a password for a bearer token",
+		Params: []apiParam{
+			param("user_id", typeString, "user").required(),
+			param("password", typeString, "password").required(),
+		},
+		Consumes:  formBody,
+		Responses: []apiResponse{ok(http.StatusOK, "token", LoginResponse{})},
+		Errors:    []int{http.StatusUnauthorized, http.StatusNotFound},
+	}}},
+	{"/export_ics", []apiOperation{{
+		Method: http.MethodGet, ID: "exportICS", Summary: "Export a user's events as iCalendar",
+		Params:    []apiParam{param("user_id", typeString, "calendar owner").required()},
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "iCalendar file", Content: contentCalendar}},
+	}}},
+	{"/import_ics", []apiOperation{{
+		Method: http.MethodPost, ID: "importICS", Summary: "Import events from an iCalendar file in the body or the file form field",
+		Params:    []apiParam{userIDParam},
+		Consumes:  []string{contentCalendar, contentMultipart},
+		Responses: []apiResponse{ok(http.StatusOK, "number of imported events and per-event errors", JSONResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusRequestEntityTooLarge},
+	}}},
+	{"/healthz", []apiOperation{{
+		Method: http.MethodGet, ID: "healthz", Summary: "Liveness probe",
+		Responses: []apiResponse{ok(http.StatusOK, "process is alive", HealthResponse{})},
+	}}},
+	{"/readyz", []apiOperation{{
+		Method: http.MethodGet, ID: "readyz", Summary: "Readiness probe",
+		Responses: []apiResponse{ok(http.StatusOK, "ready to serve", HealthResponse{}), ok(http.StatusServiceUnavailable, "starting or shutting down", HealthResponse{})},
+	}}},
+	{"/search", []apiOperation{{
+		Method: http.MethodGet, ID: "searchEvents", Summary: "Search events by title, participant, time and duration",
+		Params: []apiParam{
+			param("q", typeString, "words that must all occur in the title"),
+			param("contains", typeString, "title substring"),
+			param("user_id", typeString, "owner or attendee"),
+			param("from", typeDateTime, "at least one occurrence after; requires to"),
+			param("to", typeDateTime, "at least one occurrence before; requires from"),
+			param("min_duration", typeDuration, "shortest event"),
+			param("max_duration", typeDuration, "longest event"),
+			param("sort", typeString, "order by start").oneOf("start", "-start"),
+			param("limit", typeInteger, "page size, 1 to 500; 50 by default"),
+			param("cursor", typeString, "next_cursor of the previous page"),
+		},
+		Responses: []apiResponse{ok(http.StatusOK, "page of events", SearchResponse{})},
+	}}},
+	{"/changes", []apiOperation{{
+		Method: http.MethodGet, ID: "changes", Summary: "Stream of event changes as Server-Sent Events",
+		Params: []apiParam{
+			param("user_id", typeString, "only changes of events the user takes part in"),
+			param("last_event_id", typeInteger, "resume after this sequence number"),
+			param("Last-Event-ID", typeInteger, "resume after this sequence number").inHeader(),
+		},
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "create, update, delete and reset events carrying FeedEntry data", Content: contentStream}},
+	}}},
+	{"/event_history", []apiOperation{{
+		Method: http.MethodGet, ID: "eventHistory", Summary: "Versions of an event, including a deleted one within the retention window",
+		Params:    []apiParam{idParam},
+		Responses: []apiResponse{ok(http.StatusOK, "versions, oldest first", HistoryResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound},
+	}}},
+	{"/revert_event", []apiOperation{{
+		Method: http.MethodPost, ID: "revertEvent", Summary: "Revert an event to a version or restore a deleted event",
+		Params: []apiParam{
+			idParam,
+			param("version", typeInteger, "version to revert to").required(),
+			rejectParam,
+		},
+		Consumes:  formBody,
+		Responses: []apiResponse{ok(http.StatusOK, "event reverted", JSONResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+	}}},
+	{"/batch", []apiOperation{{
+		Method: http.MethodPost, ID: "batch", Summary: "Apply create, update and delete operations atomically",
+		Params:   []apiParam{rejectParam},
+		Consumes: jsonBody, Body: reflect.TypeOf([]BatchOperation{}),
+		Responses: []apiResponse{ok(http.StatusOK, "all operations applied", BatchResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity},
+	}}},
+	{"/calendars", []apiOperation{{
+		Method: http.MethodGet, ID: "listCalendars", Summary: "List a user's calendars; other users see only public ones",
+		Params:    []apiParam{userIDParam},
+		Responses: []apiResponse{ok(http.StatusOK, "calendars ordered by name", []Calendar{})},
+	}}},
+	{"/create_calendar", []apiOperation{{
+		Method: http.MethodPost, ID: "createCalendar", Summary: "Create a calendar",
+		Params:    withParams([]apiParam{userIDParam}, calendarParams),
+		Consumes:  formBody,
+		Responses: []apiResponse{ok(http.StatusCreated, "created calendar", Calendar{})},
+		Errors:    []int{http.StatusForbidden},
+	}}},
+	{"/update_calendar", []apiOperation{{
+		Method: http.MethodPost, ID: "updateCalendar", Summary: "Change the given fields of a calendar",
+		Params:    withParams([]apiParam{param("id", typeString, "calendar ID").required()}, calendarParams),
+		Consumes:  formBody,
+		Responses: []apiResponse{ok(http.StatusOK, "updated calendar", Calendar{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound},
+	}}},
+	{"/delete_calendar", []apiOperation{{
+		Method: http.MethodPost, ID: "deleteCalendar", Summary: "Delete a calendar and delete or keep its events",
+		Params: []apiParam{
+			param("id", typeString, "calendar ID").required(),
+			param("events", typeString, "delete the calendar's events or move them to the default calendar; delete by default").oneOf(cascadeDelete, cascadeKeep),
+		},
+		Consumes:  formBody,
+		Responses: []apiResponse{ok(http.StatusOK, "calendar deleted", JSONResponse{})},
+		Errors:    []int{http.StatusForbidden, http.StatusNotFound},
+	}}},
+	{"/rpc", []apiOperation{{
+		Method: http.MethodPost, ID: "rpc", Summary: "JSON-RPC 2.0 calls of createEvent, updateEvent, deleteEvent and eventsFor{Day,Week,Month}; params are named like the parameters of those operations",
+		Consumes: jsonBody, Body: reflect.TypeOf(rpcRequest{}),
+		Responses: []apiResponse{ok(http.StatusOK, "response or array of responses to a batch", rpcResponse{}), {Status: http.StatusNoContent, Description: "only notifications were sent"}},
+	}}},
+	{"/openapi.json", []apiOperation{{
+		Method: http.MethodGet, ID: "openapi", Summary: "This document",
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "OpenAPI 3 document", Content: contentJSON}},
+	}}},
+}
+
+// findRoute возвращает описание маршрута по пути запроса и значения
+// параметров пути
+func findRoute(path string) (apiRoute, map[string]string, bool) {
+	if strings.HasPrefix(path, v2UsersPrefix) {
+		userID, eventID, ok := parseV2Path(path)
+		if !ok {
+			return apiRoute{}, nil, false
+		}
+		template := "/v2/users/{user_id}/events"
+		values := map[string]string{"user_id": userID}
+		if eventID != "" {
+			template += "/{id}"
+			values["id"] = eventID
+		}
+		path = template
+		for _, route := range apiRoutes {
+			if route.Path == path {
+				return route, values, true
+			}
+		}
+		return apiRoute{}, nil, false
+	}
+	for _, route := range apiRoutes {
+		if route.Path == path {
+			return route, nil, true
+		}
+	}
+	return apiRoute{}, nil, false
+}
+
+// operation возвращает операцию маршрута для метода; HEAD обслуживается как GET
+func (route apiRoute) operation(method string) (apiOperation, bool) {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	for _, op := range route.Operations {
+		if op.Method == method {
+			return op, true
+		}
+	}
+	return apiOperation{}, false
+}
+
+// validateValue проверяет значение параметра по его типу
+func validateValue(p apiParam, value string) error {
+	var err error
+	switch p.Type {
+	case typeInteger:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case typeBoolean:
+		_, err = strconv.ParseBool(value)
+	case typeDateTime:
+		_, err = time.Parse(time.RFC3339, value)
+	case typeDate:
+		_, err = time.Parse("2006-01-02", value)
+	case typeDuration:
+		_, err = time.ParseDuration(value)
+	case typeTimeZone:
+		_, err = time.LoadLocation(value)
+	case typeID:
+		if !validID(value) {
+			err = errors.New("malformed")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid parameter %s: must be %s", p.Name, typeDescriptions[p.Type])
+	}
+	if len(p.Enum) > 0 {
+		for _, allowed := range p.Enum {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid parameter %s: must be one of %s", p.Name, strings.Join(p.Enum, ", "))
+	}
+	return nil
+}
+
+// typeDescriptions описания типов для сообщений об ошибках
+var typeDescriptions = map[string]string{
+	typeInteger:  "an integer",
+	typeBoolean:  "true or false",
+	typeDateTime: "an RFC 3339 timestamp",
+	typeDate:     "a date as YYYY-MM-DD",
+	typeDuration: "a duration such as 30m",
+	typeTimeZone: "an IANA time zone such as Europe/Moscow",
+	typeID:       "an event ID",
+}
+
+// validateRequest проверяет запрос по операции: тип тела, наличие
+// обязательных параметров и формат значений. Возвращает HTTP-статус ошибки.
+func validateRequest(r *http.Request, op apiOperation, pathValues map[string]string) (int, error) {
+	mediaType := ""
+	if header := r.Header.Get("Content-Type"); header != "" && r.ContentLength != 0 {
+		mediaType, _, _ = mime.ParseMediaType(header)
+		accepted := false
+		for _, content := range op.Consumes {
+			accepted = accepted || mediaType == content
+		}
+		if !accepted {
+			return http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", mediaType)
+		}
+	}
+
+	// Параметры формы читаются так же, как их прочитает обработчик
+	values := r.URL.Query()
+	var err error
+	switch mediaType {
+	case contentForm:
+		err = r.ParseForm()
+		values = r.Form
+	case contentMultipart:
+		err = r.ParseMultipartForm(maxFormMemory)
+		values = r.Form
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return http.StatusRequestEntityTooLarge, fmt.Errorf("request body too large: limit is %d bytes", tooLarge.Limit)
+		}
+		return http.StatusBadRequest, fmt.Errorf("invalid form: %v", err)
+	}
+
+	for _, p := range op.Params {
+		var raw []string
+		switch p.In {
+		case inPath:
+			raw = []string{pathValues[p.Name]}
+		case inHeader:
+			if value := r.Header.Get(p.Name); value != "" {
+				raw = []string{value}
+			}
+		default:
+			for _, value := range values[p.Name] {
+				if value != "" {
+					raw = append(raw, value)
+				}
+			}
+		}
+		if len(raw) == 0 {
+			if p.Required {
+				return http.StatusBadRequest, fmt.Errorf("missing parameter %s", p.Name)
+			}
+			continue
+		}
+		if p.In == inHeader && strings.HasPrefix(p.Name, "If-") {
+			continue
+		}
+		for _, value := range raw {
+			items := []string{value}
+			if p.List && p.Type != typeString {
+				items = strings.Split(value, ",")
+			}
+			for _, item := range items {
+				if err := validateValue(p, strings.TrimSpace(item)); err != nil {
+					return http.StatusBadRequest, err
+				}
+			}
+		}
+	}
+	return 0, nil
+}
+
+// validationMiddleware middleware для проверки запросов по apiRoutes.
+// Запросы к неизвестным путям передаются дальше, где mux ответит 404.
+func validationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathValues, found := findRoute(r.URL.Path)
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+		op, found := route.operation(r.Method)
+		if !found {
+			var allowed []string
+			for _, op := range route.Operations {
+				allowed = append(allowed, op.Method)
+			}
+			methodNotAllowed(w, allowed...)
+			return
+		}
+		if status, err := validateRequest(r, op, pathValues); err != nil {
+			writeError(w, status, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// schemaBuilder строит JSON-схемы OpenAPI по Go-типам ответов и запросов.
+// Именованные структуры попадают в components/schemas и подключаются по $ref.
+type schemaBuilder struct {
+	schemas map[string]interface{}
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(Duration(0))
+	rawJSONType  = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// schemaName возвращает имя схемы для типа: eventInput — EventInput
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+// schema возвращает схему типа t
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return map[string]interface{}{"type": "string", "format": "duration", "example": "15m0s"}
+	case t == rawJSONType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Struct:
+		name := schemaName(t)
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		if _, done := b.schemas[name]; done {
+			return ref
+		}
+		// Заглушка до построения полей защищает от рекурсии
+		b.schemas[name] = nil
+		b.schemas[name] = b.object(t)
+		return ref
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// object строит схему структуры по полям с тегами json. Поля без omitempty
+// и не указатели считаются обязательными.
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schema(field.Type)
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	object := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		object["required"] = required
+	}
+	return object
+}
+
+// paramSchema возвращает схему значения параметра
+func paramSchema(p apiParam) map[string]interface{} {
+	var schema map[string]interface{}
+	switch p.Type {
+	case typeInteger, typeBoolean:
+		schema = map[string]interface{}{"type": p.Type}
+	case typeDateTime, typeDate, typeDuration:
+		schema = map[string]interface{}{"type": "string", "format": p.Type}
+	case typeID:
+		schema = map[string]interface{}{"type": "string", "pattern": "^([0-7][0-9A-HJKMNP-TV-Z]{25}|[0-9]{1,19})$"}
+	case typeTimeZone:
+		schema = map[string]interface{}{"type": "string", "example": "Europe/Moscow"}
+	default:
+		schema = map[string]interface{}{"type": "string"}
+	}
+	if len(p.Enum) > 0 {
+		schema["enum"] = p.Enum
+	}
+	if p.List {
+		schema = map[string]interface{}{"type": "array", "items": schema}
+	}
+	return schema
+}
+
+// paramDescription дополняет описание параметра-списка
+func paramDescription(p apiParam) string {
+	if p.List && p.Type != typeString {
+		return p.Description + "; repeat the parameter or separate values with commas"
+	}
+	return p.Description
+}
+
+// operationDocument строит описание операции
+func (b *schemaBuilder) operationDocument(op apiOperation) map[string]interface{} {
+	doc := map[string]interface{}{"operationId": op.ID, "summary": op.Summary}
+
+	// Параметры форм описываются телом запроса, остальные — параметрами
+	isForm := false
+	for _, content := range op.Consumes {
+		isForm = isForm || content == contentForm
+	}
+	parameters := []interface{}{}
+	formProperties := make(map[string]interface{})
+	var formRequired []string
+	for _, p := range op.Params {
+		if isForm && p.In == inQuery {
+			formProperties[p.Name] = map[string]interface{}{"description": paramDescription(p), "allOf": []interface{}{paramSchema(p)}}
+			if p.Required {
+				formRequired = append(formRequired, p.Name)
+			}
+			continue
+		}
+		parameter := map[string]interface{}{
+			"name":        p.Name,
+			"in":          p.In,
+			"description": paramDescription(p),
+			"required":    p.Required,
+			"schema":      paramSchema(p),
+		}
+		if p.List {
+			parameter["explode"] = true
+		}
+		parameters = append(parameters, parameter)
+	}
+	if len(parameters) > 0 {
+		doc["parameters"] = parameters
+	}
+
+	content := make(map[string]interface{})
+	for _, mediaType := range op.Consumes {
+		switch mediaType {
+		case contentForm:
+			form := map[string]interface{}{"type": "object", "properties": formProperties}
+			if len(formRequired) > 0 {
+				form["required"] = formRequired
+			}
+			content[mediaType] = map[string]interface{}{"schema": form}
+		case contentMultipart:
+			properties := formProperties
+			if !isForm {
+				properties = map[string]interface{}{"file": map[string]interface{}{"type": "string", "format": "binary"}}
+			}
+			content[mediaType] = map[string]interface{}{"schema": map[string]interface{}{"type": "object", "properties": properties}}
+		case contentJSON:
+			content[mediaType] = map[string]interface{}{"schema": b.schema(op.Body)}
+		default:
+			content[mediaType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+		}
+	}
+	if len(content) > 0 {
+		doc["requestBody"] = map[string]interface{}{"required": !isForm, "content": content}
+	}
+
+	responses := make(map[string]interface{})
+	for _, response := range op.Responses {
+		entry := map[string]interface{}{"description": response.Description}
+		switch {
+		case response.Body != nil:
+			entry["content"] = map[string]interface{}{response.Content: map[string]interface{}{"schema": b.schema(response.Body)}}
+		case response.Content != "":
+			entry["content"] = map[string]interface{}{response.Content: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+		}
+		responses[strconv.Itoa(response.Status)] = entry
+	}
+	errorContent := map[string]interface{}{contentJSON: map[string]interface{}{"schema": b.schema(reflect.TypeOf(JSONResponse{}))}}
+	for _, status := range append([]int{http.StatusBadRequest}, op.Errors...) {
+		responses[strconv.Itoa(status)] = map[string]interface{}{"description": http.StatusText(status), "content": errorContent}
+	}
+	responses["default"] = map[string]interface{}{"description": "error", "content": errorContent}
+	doc["responses"] = responses
+	return doc
+}
+
+// openAPIDocument строит документ OpenAPI 3 по apiRoutes
+func openAPIDocument() map[string]interface{} {
+	b := &schemaBuilder{schemas: make(map[string]interface{})}
+	paths := make(map[string]interface{})
+	for _, route := range apiRoutes {
+		item := make(map[string]interface{})
+		for _, op := range route.Operations {
+			item[strings.ToLower(op.Method)] = b.operationDocument(op)
+		}
+		paths[route.Path] = item
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Calendar API",
+			"version":     "1.0.0",
+			"description": "Calendar HTTP server. Errors are returned as {\"error\": \"...\"}. With authentication enabled, requests carry Authorization: Bearer <token> obtained from /login.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// openAPIHandler обработчик документа OpenAPI (GET /openapi.json)
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = toJSON(openAPIDocument())
+	})
+	w.Header().Set("Content-Type", contentJSON)
+	w.Write(openAPIJSON)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Поддерживаемые частоты повторения (RFC 5545, FREQ)
+const (
+	freqDaily   = "DAILY"
+	freqWeekly  = "WEEKLY"
+	freqMonthly = "MONTHLY"
+)
+
+// maxOccurrenceSteps ограничивает перебор повторений одного события, чтобы
+// бесконечное правило не могло занять сервер
+const maxOccurrenceSteps = 100000
+
+var weekdayCodes = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// byDay элемент BYDAY: день недели и необязательный порядковый номер внутри
+// месяца (1MO — первый понедельник, -1FR — последняя пятница)
+type byDay struct {
+	Weekday time.Weekday
+	Ordinal int
+}
+
+// Recurrence правило повторения события в духе RRULE из RFC 5545
+type Recurrence struct {
+	Freq     string
+	Interval int
+	ByDay    []byDay
+	Count    int
+	Until    time.Time
+}
+
+// parseRRule разбирает строку вида FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=10
+func parseRRule(s string) (Recurrence, error) {
+	rule := Recurrence{Interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return rule, fmt.Errorf("invalid rrule part %q", part)
+		}
+
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(value)
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return rule, fmt.Errorf("invalid INTERVAL %q", value)
+			}
+			rule.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return rule, fmt.Errorf("invalid COUNT %q", value)
+			}
+			rule.Count = n
+		case "UNTIL":
+			until, err := parseICalTime(value)
+			if err != nil {
+				return rule, fmt.Errorf("invalid UNTIL %q", value)
+			}
+			rule.Until = until
+		case "BYDAY":
+			for _, code := range strings.Split(value, ",") {
+				day, err := parseByDay(code)
+				if err != nil {
+					return rule, err
+				}
+				rule.ByDay = append(rule.ByDay, day)
+			}
+		case "WKST":
+			if strings.ToUpper(value) != "MO" {
+				return rule, fmt.Errorf("unsupported WKST %q", value)
+			}
+		default:
+			return rule, fmt.Errorf("unsupported rrule part %q", key)
+		}
+	}
+
+	switch rule.Freq {
+	case freqDaily, freqMonthly:
+	case freqWeekly:
+		for _, day := range rule.ByDay {
+			if day.Ordinal != 0 {
+				return rule, fmt.Errorf("BYDAY ordinals are not allowed with FREQ=WEEKLY")
+			}
+		}
+	case "":
+		return rule, fmt.Errorf("missing FREQ")
+	default:
+		return rule, fmt.Errorf("unsupported FREQ %q", rule.Freq)
+	}
+
+	if rule.Freq == freqDaily && len(rule.ByDay) > 0 {
+		return rule, fmt.Errorf("BYDAY is not supported with FREQ=DAILY")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return rule, fmt.Errorf("COUNT and UNTIL are mutually exclusive")
+	}
+
+	return rule, nil
+}
+
+// parseByDay разбирает элемент BYDAY (MO, 2TU, -1FR)
+func parseByDay(code string) (byDay, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) < 2 {
+		return byDay{}, fmt.Errorf("invalid BYDAY %q", code)
+	}
+
+	weekday, ok := weekdayCodes[code[len(code)-2:]]
+	if !ok {
+		return byDay{}, fmt.Errorf("invalid BYDAY %q", code)
+	}
+
+	day := byDay{Weekday: weekday}
+	if prefix := code[:len(code)-2]; prefix != "" {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return byDay{}, fmt.Errorf("invalid BYDAY %q", code)
+		}
+		day.Ordinal = n
+	}
+	return day, nil
+}
+
+// parseICalTime разбирает дату или дату-время в формате iCalendar
+func parseICalTime(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date-time %q", value)
+}
+
+// expandRecurrence возвращает начала повторений события, попадающие в
+// интервал [from, to). Исключенные даты (EXDATE) пропускаются, но, как и в
+// RFC 5545, учитываются в COUNT.
+func expandRecurrence(start time.Time, rule Recurrence, exdates []time.Time, from, to time.Time) []time.Time {
+	excluded := make(map[int64]struct{}, len(exdates))
+	for _, exdate := range exdates {
+		excluded[exdate.UnixNano()] = struct{}{}
+	}
+
+	var results []time.Time
+	generated := 0
+	next := occurrenceGenerator(start, rule)
+
+	for step := 0; step < maxOccurrenceSteps; step++ {
+		candidates := next()
+		for _, occurrence := range candidates {
+			if occurrence.Before(start) {
+				continue
+			}
+			if !rule.Until.IsZero() && occurrence.After(rule.Until) {
+				return results
+			}
+			if rule.Count > 0 && generated >= rule.Count {
+				return results
+			}
+			if !occurrence.Before(to) {
+				return results
+			}
+			generated++
+
+			if _, skip := excluded[occurrence.UnixNano()]; skip {
+				continue
+			}
+			if !occurrence.Before(from) {
+				results = append(results, occurrence)
+			}
+		}
+	}
+	return results
+}
+
+// occurrenceGenerator возвращает функцию, которая при каждом вызове выдает
+// упорядоченные кандидаты очередного периода правила (дня, недели, месяца)
+func occurrenceGenerator(start time.Time, rule Recurrence) func() []time.Time {
+	period := 0
+	hour, min, sec := start.Clock()
+	loc := start.Location()
+
+	switch rule.Freq {
+	case freqWeekly:
+		days := rule.ByDay
+		if len(days) == 0 {
+			days = []byDay{{Weekday: start.Weekday()}}
+		}
+		offsets := make([]int, 0, len(days))
+		for _, day := range days {
+			offsets = append(offsets, (int(day.Weekday)+6)%7)
+		}
+		sort.Ints(offsets)
+
+		monday := start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		return func() []time.Time {
+			weekStart := monday.AddDate(0, 0, 7*rule.Interval*period)
+			period++
+			candidates := make([]time.Time, 0, len(offsets))
+			for _, offset := range offsets {
+				day := weekStart.AddDate(0, 0, offset)
+				candidates = append(candidates, time.Date(day.Year(), day.Month(), day.Day(), hour, min, sec, start.Nanosecond(), loc))
+			}
+			return candidates
+		}
+
+	case freqMonthly:
+		return func() []time.Time {
+			first := time.Date(start.Year(), start.Month()+time.Month(rule.Interval*period), 1, hour, min, sec, start.Nanosecond(), loc)
+			period++
+			if len(rule.ByDay) == 0 {
+				if start.Day() > daysIn(first) {
+					return nil
+				}
+				return []time.Time{first.AddDate(0, 0, start.Day()-1)}
+			}
+			return monthlyByDay(first, rule.ByDay)
+		}
+
+	default:
+		return func() []time.Time {
+			day := start.AddDate(0, 0, rule.Interval*period)
+			period++
+			return []time.Time{day}
+		}
+	}
+}
+
+// monthlyByDay возвращает дни месяца, соответствующие BYDAY, по возрастанию
+func monthlyByDay(first time.Time, days []byDay) []time.Time {
+	total := daysIn(first)
+	seen := make(map[int]struct{})
+	var dayNumbers []int
+
+	for _, day := range days {
+		firstMatch := 1 + (int(day.Weekday)-int(first.Weekday())+7)%7
+		var matches []int
+		for d := firstMatch; d <= total; d += 7 {
+			matches = append(matches, d)
+		}
+
+		switch {
+		case day.Ordinal > 0 && day.Ordinal <= len(matches):
+			matches = matches[day.Ordinal-1 : day.Ordinal]
+		case day.Ordinal < 0 && -day.Ordinal <= len(matches):
+			matches = matches[len(matches)+day.Ordinal : len(matches)+day.Ordinal+1]
+		case day.Ordinal != 0:
+			matches = nil
+		}
+
+		for _, d := range matches {
+			if _, dup := seen[d]; !dup {
+				seen[d] = struct{}{}
+				dayNumbers = append(dayNumbers, d)
+			}
+		}
+	}
+
+	sort.Ints(dayNumbers)
+	results := make([]time.Time, 0, len(dayNumbers))
+	for _, d := range dayNumbers {
+		results = append(results, first.AddDate(0, 0, d-1))
+	}
+	return results
+}
+
+// daysIn возвращает количество дней в месяце даты t
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// seriesLocations кэш часовых поясов серий по имени
+var seriesLocations sync.Map
+
+// seriesStart возвращает начало серии в ее часовом поясе: от него
+// отсчитываются повторения
+func seriesStart(event Event) time.Time {
+	if event.TimeZone == "" {
+		return event.StartTime
+	}
+	if loc, ok := seriesLocations.Load(event.TimeZone); ok {
+		return event.StartTime.In(loc.(*time.Location))
+	}
+	loc, err := time.LoadLocation(event.TimeZone)
+	if err != nil {
+		return event.StartTime
+	}
+	seriesLocations.Store(event.TimeZone, loc)
+	return event.StartTime.In(loc)
+}
+
+// isOccurrence проверяет, что серия действительно содержит повторение,
+// начинающееся в момент at
+func isOccurrence(event Event, at time.Time) bool {
+	if event.RRule == "" {
+		return false
+	}
+	rule, err := parseRRule(event.RRule)
+	if err != nil {
+		return false
+	}
+	window := expandRecurrence(seriesStart(event), rule, event.ExDates, at, at.Add(time.Nanosecond))
+	return len(window) == 1
+}
+
+// occurrencesBetween разворачивает событие в его экземпляры, начинающиеся в
+// интервале [from, to). Для неповторяющегося события возвращает его само,
+// если оно попадает в интервал.
+func occurrencesBetween(event Event, from, to time.Time) []Event {
+	if event.RRule == "" {
+		if !event.StartTime.Before(from) && event.StartTime.Before(to) {
+			return []Event{event}
+		}
+		return nil
+	}
+
+	rule, err := parseRRule(event.RRule)
+	if err != nil {
+		return nil
+	}
+
+	duration := event.EndTime.Sub(event.StartTime)
+	starts := expandRecurrence(seriesStart(event), rule, event.ExDates, from, to)
+	results := make([]Event, 0, len(starts))
+	for _, start := range starts {
+		start = start.In(event.StartTime.Location())
+		occurrence := event
+		occurrence.StartTime = start
+		occurrence.EndTime = start.Add(duration)
+		recurrenceID := start
+		occurrence.RecurrenceID = &recurrenceID
+		results = append(results, occurrence)
+	}
+	return results
+}
+
+// mergeExDates добавляет к исключениям dates исключения kept, которых в них
+// нет. Так изменение серии не возвращает перенесенные и удаленные повторения.
+func mergeExDates(dates, kept []time.Time) []time.Time {
+	merged := append([]time.Time(nil), dates...)
+	for _, exdate := range kept {
+		found := false
+		for _, d := range merged {
+			if d.Equal(exdate) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, exdate)
+		}
+	}
+	return merged
+}
+
+// ErrOccurrenceNotFound возвращается, если в серии нет указанного повторения
+var ErrOccurrenceNotFound = errors.New("occurrence not found")
+
+// updateOccurrence заменяет одно повторение серии seriesID отдельным событием
+// override: повторение исключается из серии, а override хранится как обычное
+// событие со ссылкой на серию
+func updateOccurrence(ctx context.Context, seriesID string, at time.Time, override Event) error {
+	series, err := store.Get(ctx, seriesID)
+	if err != nil {
+		return err
+	}
+	if !isOccurrence(series, at) {
+		return ErrOccurrenceNotFound
+	}
+
+	override.SeriesID = series.ID
+	override.RecurrenceID = &at
+	if err := store.Create(ctx, override); err != nil {
+		return err
+	}
+
+	series.ExDates = append(series.ExDates, at)
+	if err := store.Update(ctx, series); err != nil {
+		store.Delete(ctx, override.ID)
+		return err
+	}
+	return nil
+}
+
+// deleteOccurrence исключает одно повторение из серии
+func deleteOccurrence(ctx context.Context, seriesID string, at time.Time) error {
+	series, err := store.Get(ctx, seriesID)
+	if err != nil {
+		return err
+	}
+	if !isOccurrence(series, at) {
+		return ErrOccurrenceNotFound
+	}
+
+	series.ExDates = append(series.ExDates, at)
+	return store.Update(ctx, series)
+}
+
+// deleteSeries удаляет событие вместе с отдельно измененными повторениями,
+// если это серия
+func deleteSeries(ctx context.Context, id string) error {
+	event, err := store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := store.Delete(ctx, id); err != nil {
+		return err
+	}
+	if event.RRule == "" {
+		return nil
+	}
+
+	userEvents, err := store.ListByUser(ctx, event.UserID)
+	if err != nil {
+		return err
+	}
+	for _, override := range userEvents {
+		if override.SeriesID == id {
+			if err := store.Delete(ctx, override.ID); err != nil && !errors.Is(err, ErrEventNotFound) {
+				return err
+			}
+		}
+	}
+	return nil
+}
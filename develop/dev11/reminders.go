@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxReminders      = 10
+	maxReminderOffset = 31 * 24 * time.Hour
+	reminderHorizon   = 400 * 24 * time.Hour // дальше следующее напоминание не ищется
+	maxReminderWait   = time.Hour            // планировщик просыпается хотя бы так часто
+
+	reminderRescanInterval = 24 * time.Hour // как часто проверяются события за горизонтом
+
+	reminderShutdownTimeout = 10 * time.Second // ожидание доставки при остановке
+)
+
+// Duration интервал времени, который в JSON записывается строкой вида "15m0s"
+type Duration time.Duration
+
+// MarshalText реализует encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText реализует encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// parseReminders разбирает смещения напоминаний из повторяющегося или
+// перечисленного через запятую параметра reminders
+func parseReminders(values []string) ([]Duration, error) {
+	var reminders []Duration
+	for _, value := range values {
+		for _, offset := range strings.Split(value, ",") {
+			var d Duration
+			if err := d.UnmarshalText([]byte(strings.TrimSpace(offset))); err != nil {
+				return nil, fmt.Errorf("invalid reminders: %v", err)
+			}
+			reminders = append(reminders, d)
+		}
+	}
+	return reminders, nil
+}
+
+// validateReminders проверяет смещения напоминаний события
+func validateReminders(reminders []Duration) error {
+	if len(reminders) > maxReminders {
+		return fmt.Errorf("too many reminders: at most %d allowed", maxReminders)
+	}
+	for _, offset := range reminders {
+		if offset < 0 || time.Duration(offset) > maxReminderOffset {
+			return fmt.Errorf("reminder offset must be between 0 and %s", maxReminderOffset)
+		}
+	}
+	return nil
+}
+
+// Notification напоминание о начале повторения события
+type Notification struct {
+	EventID    string    `json:"event_id"`
+	Title      string    `json:"title"`
+	StartTime  time.Time `json:"start_time"`
+	EndTime    time.Time `json:"end_time"`
+	Offset     Duration  `json:"offset"`
+	FireAt     time.Time `json:"fire_at"`
+	Recipients []string  `json:"recipients"`
+}
+
+// Notifier доставляет напоминания
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// logNotifier записывает напоминания в журнал
+type logNotifier struct{}
+
+// Notify реализует Notifier
+func (logNotifier) Notify(_ context.Context, n Notification) error {
+	log.Printf("Reminder: event %s %q starts at %s (recipients: %s)",
+		n.EventID, n.Title, n.StartTime.Format(time.RFC3339), strings.Join(n.Recipients, ","))
+	return nil
+}
+
+// webhookNotifier отправляет напоминания POST-запросом с JSON-телом на URL.
+// Сетевые ошибки, ответы 429 и 5xx повторяются с экспоненциальной задержкой.
+type webhookNotifier struct {
+	url     string
+	client  *http.Client
+	retries int
+	backoff time.Duration
+}
+
+// newWebhookNotifier создает webhook-нотификатор с настройками по умолчанию
+func newWebhookNotifier(url string) *webhookNotifier {
+	return &webhookNotifier{
+		url:     url,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		retries: 5,
+		backoff: time.Second,
+	}
+}
+
+// Notify реализует Notifier
+func (n *webhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := toJSON(notification)
+	if err != nil {
+		return err
+	}
+
+	delay := n.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= n.retries {
+			return fmt.Errorf("webhook: %w", err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// post выполняет одну попытку доставки и сообщает, имеет ли смысл повтор
+func (n *webhookNotifier) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// reminderItem ближайшее напоминание события в очереди планировщика
+type reminderItem struct {
+	fireAt     time.Time
+	offset     Duration
+	occurrence Event
+	event      Event
+}
+
+// notification формирует напоминание для участников, не отклонивших приглашение
+func (item *reminderItem) notification() Notification {
+	var recipients []string
+	for _, userID := range item.event.participants() {
+		if busyFor(item.event, userID) {
+			recipients = append(recipients, userID)
+		}
+	}
+	return Notification{
+		EventID:    item.event.ID,
+		Title:      item.occurrence.Title,
+		StartTime:  item.occurrence.StartTime,
+		EndTime:    item.occurrence.EndTime,
+		Offset:     item.offset,
+		FireAt:     item.fireAt,
+		Recipients: recipients,
+	}
+}
+
+// reminderHeap min-куча напоминаний по времени срабатывания
+type reminderHeap []*reminderItem
+
+func (h reminderHeap) Len() int           { return len(h) }
+func (h reminderHeap) Less(i, j int) bool { return h[i].fireAt.Before(h[j].fireAt) }
+func (h reminderHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *reminderHeap) Push(x any)        { *h = append(*h, x.(*reminderItem)) }
+func (h *reminderHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// nextReminder возвращает первое напоминание события, срабатывающее позже
+// after. Повторения ищутся в расширяющемся окне: найденное напоминание
+// принимается, только если повторения за окном не могут сработать раньше.
+func nextReminder(event Event, after time.Time) (*reminderItem, bool) {
+	var maxOffset time.Duration
+	for _, offset := range event.Reminders {
+		if time.Duration(offset) > maxOffset {
+			maxOffset = time.Duration(offset)
+		}
+	}
+
+	for window := 24 * time.Hour; ; window *= 4 {
+		if window > reminderHorizon {
+			window = reminderHorizon
+		}
+		var best *reminderItem
+		for _, occurrence := range occurrencesBetween(event, after, after.Add(maxOffset+window)) {
+			for _, offset := range event.Reminders {
+				fireAt := occurrence.StartTime.Add(-time.Duration(offset))
+				if fireAt.After(after) && (best == nil || fireAt.Before(best.fireAt)) {
+					best = &reminderItem{fireAt: fireAt, offset: offset, occurrence: occurrence, event: event}
+				}
+			}
+		}
+		if best != nil && (best.fireAt.Before(after.Add(window)) || window == reminderHorizon) {
+			return best, true
+		}
+		if window == reminderHorizon {
+			return nil, false
+		}
+	}
+}
+
+// reminderState состояние планировщика, сохраняемое после срабатываний и при
+// остановке: все напоминания до Watermark обработаны, Pending еще не
+// доставлены
+type reminderState struct {
+	Watermark time.Time      `json:"watermark"`
+	Pending   []Notification `json:"pending,omitempty"`
+}
+
+// reminderScheduler фоновый планировщик напоминаний. Для каждого события с
+// напоминаниями в куче лежит только ближайшее; после срабатывания
+// планируется следующее. Изменения событий приходят через observedStore.
+// Сработавшие напоминания доставляются отдельной горутиной, поэтому
+// медленный нотификатор не задерживает планирование.
+type reminderScheduler struct {
+	store    EventStore
+	notifier Notifier
+	path     string // файл состояния; пустой — состояние не сохраняется
+	now      func() time.Time
+
+	mu        sync.Mutex
+	queue     reminderHeap
+	scheduled map[string]*reminderItem
+	distant   map[string]Event // события, чье следующее напоминание за горизонтом
+	pending   []Notification
+	watermark time.Time
+	rescanned time.Time // время последней проверки distant; меняет только run
+
+	wake      chan struct{}
+	queued    chan struct{}
+	stop      chan struct{}
+	draining  chan struct{}
+	done      chan struct{}
+	delivered chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// newReminderScheduler создает планировщик напоминаний для событий хранилища s
+func newReminderScheduler(s EventStore, notifier Notifier, path string) *reminderScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &reminderScheduler{
+		store:     s,
+		notifier:  notifier,
+		path:      path,
+		now:       time.Now,
+		scheduled: make(map[string]*reminderItem),
+		distant:   make(map[string]Event),
+		wake:      make(chan struct{}, 1),
+		queued:    make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		draining:  make(chan struct{}),
+		done:      make(chan struct{}),
+		delivered: make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Start загружает сохраненное состояние, планирует напоминания всех событий
+// и запускает фоновые горутины. Напоминания, пропущенные за время остановки,
+// срабатывают сразу, если повторение еще не закончилось.
+func (s *reminderScheduler) Start(ctx context.Context) error {
+	state, err := s.loadState()
+	if err != nil {
+		return err
+	}
+	events, err := s.store.All(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.watermark = state.Watermark
+	if s.watermark.IsZero() {
+		s.watermark = s.now()
+	}
+	s.pending = state.Pending
+	s.rescanned = s.now()
+	for _, event := range events {
+		s.scheduleLocked(event)
+	}
+	s.mu.Unlock()
+
+	go s.run()
+	go s.deliver()
+	wakeUp(s.queued)
+	return nil
+}
+
+// wakeUp будит горутину, не блокируясь, если она уже разбужена
+func wakeUp(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// onChange перепланирует напоминания измененного события; подписывается на
+// observedStore
+func (s *reminderScheduler) onChange(change storeChange) {
+	s.mu.Lock()
+	delete(s.scheduled, change.ID)
+	delete(s.distant, change.ID)
+	if change.Event != nil {
+		s.scheduleLocked(*change.Event)
+	}
+	s.mu.Unlock()
+	wakeUp(s.wake)
+}
+
+// scheduleLocked ставит в очередь ближайшее после watermark напоминание
+// события; вызывающий должен держать s.mu. Прежняя запись события в куче
+// становится устаревшей и пропускается при извлечении.
+func (s *reminderScheduler) scheduleLocked(event Event) {
+	s.scheduleAfterLocked(event, s.watermark)
+}
+
+// scheduleAfterLocked ставит в очередь первое после after напоминание
+// события. Событие, у которого его нет до горизонта, запоминается для
+// повторной проверки в rescan; одиночное событие, начинающееся до
+// горизонта, напоминаний больше не даст.
+func (s *reminderScheduler) scheduleAfterLocked(event Event, after time.Time) {
+	if len(event.Reminders) == 0 {
+		return
+	}
+	if item, ok := nextReminder(event, after); ok {
+		s.scheduled[event.ID] = item
+		heap.Push(&s.queue, item)
+		return
+	}
+	if event.RRule != "" || event.StartTime.After(after.Add(reminderHorizon)) {
+		s.distant[event.ID] = event
+	}
+}
+
+// rescan заново планирует события, чье следующее напоминание было за
+// горизонтом: с течением времени оно могло в него попасть
+func (s *reminderScheduler) rescan() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, event := range s.distant {
+		delete(s.distant, id)
+		s.scheduleAfterLocked(event, s.watermark)
+	}
+}
+
+// fireDue переносит наступившие напоминания в очередь доставки и
+// возвращает время ожидания до следующего и признак, что что-то сработало
+func (s *reminderScheduler) fireDue() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	fired := false
+	for len(s.queue) > 0 && !s.queue[0].fireAt.After(now) {
+		item := heap.Pop(&s.queue).(*reminderItem)
+		if s.scheduled[item.event.ID] != item {
+			continue
+		}
+		delete(s.scheduled, item.event.ID)
+
+		// Напоминание о закончившемся повторении бесполезно
+		if now.Before(item.occurrence.EndTime) {
+			s.pending = append(s.pending, item.notification())
+			fired = true
+		}
+		s.scheduleAfterLocked(item.event, item.fireAt)
+	}
+	if now.After(s.watermark) {
+		s.watermark = now
+	}
+	if fired {
+		wakeUp(s.queued)
+	}
+
+	if len(s.queue) == 0 {
+		return maxReminderWait, fired
+	}
+	if wait := s.queue[0].fireAt.Sub(now); wait < maxReminderWait {
+		return wait, fired
+	}
+	return maxReminderWait, fired
+}
+
+// run основной цикл планировщика. Раз в reminderRescanInterval проверяются
+// события за горизонтом; после каждого срабатывания состояние сохраняется,
+// чтобы после аварийной остановки напоминания не срабатывали повторно.
+func (s *reminderScheduler) run() {
+	defer close(s.done)
+	for {
+		wait, fired := s.fireDue()
+		if fired {
+			if err := s.saveState(); err != nil {
+				log.Printf("Could not save reminder state: %s\n", err)
+			}
+		}
+		// Перепроверка идет после fireDue, чтобы горизонт отсчитывался от
+		// нового watermark; найденные напоминания обработает следующий проход
+		if now := s.now(); now.Sub(s.rescanned) >= reminderRescanInterval {
+			s.rescan()
+			s.rescanned = now
+			wakeUp(s.wake)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// deliver доставляет сработавшие напоминания по очереди. При остановке
+// очередь дочищается; недоставленное из-за отмены возвращается в очередь.
+func (s *reminderScheduler) deliver() {
+	defer close(s.delivered)
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.queued:
+				continue
+			case <-s.draining:
+				return
+			}
+		}
+		n := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+
+		if err := s.notifier.Notify(s.ctx, n); err != nil {
+			if s.ctx.Err() != nil {
+				s.mu.Lock()
+				s.pending = append([]Notification{n}, s.pending...)
+				s.mu.Unlock()
+				return
+			}
+			log.Printf("Could not deliver reminder for event %s: %s\n", n.EventID, err)
+		}
+	}
+}
+
+// Shutdown останавливает планирование и ждет доставки сработавших
+// напоминаний до истечения ctx, после чего сохраняет недоставленные
+// напоминания и watermark, чтобы продолжить с них при следующем запуске
+func (s *reminderScheduler) Shutdown(ctx context.Context) error {
+	close(s.stop)
+	<-s.done
+
+	close(s.draining)
+	select {
+	case <-s.delivered:
+	case <-ctx.Done():
+		s.cancel()
+		<-s.delivered
+	}
+	s.cancel()
+
+	return s.saveState()
+}
+
+// loadState читает состояние планировщика из файла
+func (s *reminderScheduler) loadState() (reminderState, error) {
+	var state reminderState
+	if s.path == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("read reminder state: %w", err)
+	}
+	if err := fromJSON(data, &state); err != nil {
+		return state, fmt.Errorf("decode reminder state: %w", err)
+	}
+	return state, nil
+}
+
+// saveState атомарно записывает состояние планировщика в файл
+func (s *reminderScheduler) saveState() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	data, err := toJSON(reminderState{Watermark: s.watermark, Pending: s.pending})
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return fmt.Errorf("write reminder state: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("rename reminder state: %w", err)
+	}
+	return nil
+}
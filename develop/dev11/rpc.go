@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Коды ошибок JSON-RPC 2.0. Ошибки обработчиков с HTTP-статусом 4xx
+// получают коды rpcServerError-(status-400): 403 — -32003, 404 — -32004,
+// 409 — -32009; исходный статус передается в data.status.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcServerError    = -32000
+)
+
+const maxRPCBatch = 100 // вызовов в одном пакетном запросе
+
+// rpcMethods методы /rpc и маршруты, которые их обслуживают. Имена
+// совпадают с operationId в /openapi.json, параметры — с параметрами
+// маршрута.
+var rpcMethods = map[string]struct {
+	path    string
+	handler http.HandlerFunc
+}{
+	"createEvent":    {"/create_event", createEventHandler},
+	"updateEvent":    {"/update_event", updateEventHandler},
+	"deleteEvent":    {"/delete_event", deleteEventHandler},
+	"eventsForDay":   {"/events_for_day", eventsForDayHandler},
+	"eventsForWeek":  {"/events_for_week", eventsForWeekHandler},
+	"eventsForMonth": {"/events_for_month", eventsForMonthHandler},
+}
+
+// rpcRequest вызов JSON-RPC. Вызов без id — уведомление, ответ на него не
+// отправляется; id: null считается обычным вызовом.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// rpcError ошибка вызова JSON-RPC
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// rpcErrorData подробности ошибки обработчика
+type rpcErrorData struct {
+	Status    int      `json:"status"`
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// rpcResponse ответ на вызов JSON-RPC
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcRecorder собирает ответ обработчика, вызванного через /rpc
+type rpcRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *rpcRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *rpcRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *rpcRecorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(p)
+}
+
+// rpcParams переводит именованные параметры вызова в значения формы.
+// Числа и логические значения передаются как строки, массив — как
+// повторяющийся параметр.
+func rpcParams(raw json.RawMessage) (url.Values, error) {
+	values := make(url.Values)
+	if len(raw) == 0 || string(raw) == "null" {
+		return values, nil
+	}
+	var params map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("params must be an object")
+	}
+	for name, value := range params {
+		var list []json.RawMessage
+		if json.Unmarshal(value, &list) != nil {
+			list = []json.RawMessage{value}
+		}
+		for _, item := range list {
+			var scalar interface{}
+			decoder := json.NewDecoder(bytes.NewReader(item))
+			decoder.UseNumber()
+			if err := decoder.Decode(&scalar); err != nil {
+				return nil, fmt.Errorf("invalid parameter %s", name)
+			}
+			switch scalar := scalar.(type) {
+			case string:
+				values.Add(name, scalar)
+			case json.Number:
+				values.Add(name, scalar.String())
+			case bool:
+				values.Add(name, strconv.FormatBool(scalar))
+			default:
+				return nil, fmt.Errorf("invalid parameter %s: must be a string, number, boolean or array of them", name)
+			}
+		}
+	}
+	return values, nil
+}
+
+// callRPC выполняет вызов через обработчик метода. Параметры проходят ту же
+// проверку по описанию OpenAPI, что и HTTP-запросы, поэтому сообщения об
+// ошибках совпадают с ответами соответствующих маршрутов.
+func callRPC(r *http.Request, call rpcRequest) (json.RawMessage, *rpcError) {
+	method, ok := rpcMethods[call.Method]
+	if !ok {
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method not found: %s", call.Method)}
+	}
+	params, err := rpcParams(call.Params)
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+
+	route, _, _ := findRoute(method.path)
+	op := route.Operations[0]
+	var req *http.Request
+	if op.Method == http.MethodGet {
+		req, err = http.NewRequestWithContext(r.Context(), op.Method, method.path+"?"+params.Encode(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(r.Context(), op.Method, method.path, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", contentForm)
+		}
+	}
+	if err != nil {
+		return nil, &rpcError{Code: rpcInternalError, Message: err.Error()}
+	}
+	req.RemoteAddr = r.RemoteAddr
+
+	rec := &rpcRecorder{header: make(http.Header)}
+	if status, err := validateRequest(req, op, nil); err != nil {
+		writeError(rec, status, err)
+	} else {
+		method.handler(rec, req)
+	}
+
+	if rec.status < http.StatusBadRequest {
+		return json.RawMessage(bytes.TrimSpace(rec.body.Bytes())), nil
+	}
+	var response JSONResponse
+	fromJSON(rec.body.Bytes(), &response)
+	callErr := &rpcError{Message: response.Error, Data: rpcErrorData{Status: rec.status, Conflicts: response.Conflicts}}
+	switch {
+	case rec.status == http.StatusBadRequest, rec.status == http.StatusUnprocessableEntity:
+		callErr.Code = rpcInvalidParams
+	case rec.status < http.StatusInternalServerError:
+		callErr.Code = rpcServerError - (rec.status - http.StatusBadRequest)
+	default:
+		callErr.Code = rpcInternalError
+	}
+	return nil, callErr
+}
+
+// handleRPC разбирает и выполняет один вызов пакета. Для уведомлений
+// возвращает nil.
+func handleRPC(r *http.Request, raw json.RawMessage) *rpcResponse {
+	var call rpcRequest
+	if err := json.Unmarshal(raw, &call); err != nil || call.JSONRPC != "2.0" || call.Method == "" {
+		return &rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+			Error: &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}}
+	}
+
+	result, callErr := callRPC(r, call)
+	if call.ID == nil {
+		return nil
+	}
+	if callErr != nil {
+		return &rpcResponse{JSONRPC: "2.0", ID: call.ID, Error: callErr}
+	}
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", ID: call.ID, Result: result}
+}
+
+// rpcHandler обработчик JSON-RPC 2.0 (POST /rpc). Поддерживаются пакетные
+// вызовы и уведомления; методы перечислены в rpcMethods. Если в запросе
+// только уведомления, отправляется 204 без тела.
+func rpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusOK, rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+			Error: &rpcError{Code: rpcParseError, Message: fmt.Sprintf("parse error: %v", err)}})
+		return
+	}
+
+	if trimmed := bytes.TrimSpace(body); len(trimmed) == 0 || trimmed[0] != '[' {
+		if response := handleRPC(r, body); response != nil {
+			writeJSON(w, http.StatusOK, response)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	var calls []json.RawMessage
+	json.Unmarshal(body, &calls)
+	if len(calls) == 0 || len(calls) > maxRPCBatch {
+		message := "invalid request: empty batch"
+		if len(calls) > maxRPCBatch {
+			message = fmt.Sprintf("invalid request: at most %d calls per batch", maxRPCBatch)
+		}
+		writeJSON(w, http.StatusOK, rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+			Error: &rpcError{Code: rpcInvalidRequest, Message: message}})
+		return
+	}
+
+	responses := []*rpcResponse{}
+	for _, call := range calls {
+		if response := handleRPC(r, call); response != nil {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
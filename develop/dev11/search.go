@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
+
+// titleTokens разбивает название на уникальные слова в нижнем регистре
+func titleTokens(title string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	seen := make(map[string]struct{}, len(fields))
+	tokens := fields[:0]
+	for _, field := range fields {
+		if _, dup := seen[field]; !dup {
+			seen[field] = struct{}{}
+			tokens = append(tokens, field)
+		}
+	}
+	return tokens
+}
+
+// SearchResponse страница результатов поиска. NextCursor передается в
+// параметре cursor для получения следующей страницы.
+type SearchResponse struct {
+	Events     []Event `json:"events"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// searchQuery параметры поиска
+type searchQuery struct {
+	tokens       []string
+	contains     string
+	userID       string
+	from, to     time.Time
+	minDuration  time.Duration
+	maxDuration  time.Duration
+	descending   bool
+	limit        int
+	afterStart   time.Time
+	afterID      string
+	afterEnabled bool
+}
+
+// encodeCursor кодирует позицию последнего события страницы
+func encodeCursor(event Event) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d|%s", event.StartTime.UnixNano(), event.ID)))
+}
+
+// decodeCursor разбирает позицию, закодированную encodeCursor
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid cursor")
+	}
+	startStr, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return time.Time{}, "", fmt.Errorf("invalid cursor")
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid cursor")
+	}
+	return time.Unix(0, start).UTC(), id, nil
+}
+
+// parseSearchQuery парсит и валидирует параметры поиска
+func parseSearchQuery(r *http.Request) (searchQuery, error) {
+	query := r.URL.Query()
+	q := searchQuery{
+		tokens:   titleTokens(query.Get("q")),
+		contains: strings.ToLower(query.Get("contains")),
+		userID:   query.Get("user_id"),
+		limit:    defaultSearchLimit,
+	}
+
+	fromStr, toStr := query.Get("from"), query.Get("to")
+	if (fromStr == "") != (toStr == "") {
+		return q, fmt.Errorf("from and to must be used together")
+	}
+	if fromStr != "" {
+		var ferr, terr error
+		q.from, ferr = time.Parse(time.RFC3339, fromStr)
+		q.to, terr = time.Parse(time.RFC3339, toStr)
+		if ferr != nil || terr != nil {
+			return q, fmt.Errorf("from and to must be RFC 3339 timestamps")
+		}
+		if !q.to.After(q.from) {
+			return q, fmt.Errorf("to must be after from")
+		}
+	}
+
+	var err error
+	if value := query.Get("min_duration"); value != "" {
+		if q.minDuration, err = time.ParseDuration(value); err != nil || q.minDuration < 0 {
+			return q, fmt.Errorf("invalid min_duration")
+		}
+	}
+	if value := query.Get("max_duration"); value != "" {
+		if q.maxDuration, err = time.ParseDuration(value); err != nil || q.maxDuration < q.minDuration {
+			return q, fmt.Errorf("invalid max_duration")
+		}
+	}
+
+	switch query.Get("sort") {
+	case "", "start":
+	case "-start":
+		q.descending = true
+	default:
+		return q, fmt.Errorf("invalid sort: must be start or -start")
+	}
+
+	if value := query.Get("limit"); value != "" {
+		if q.limit, err = strconv.Atoi(value); err != nil || q.limit < 1 || q.limit > maxSearchLimit {
+			return q, fmt.Errorf("invalid limit: must be between 1 and %d", maxSearchLimit)
+		}
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		if q.afterStart, q.afterID, err = decodeCursor(cursor); err != nil {
+			return q, err
+		}
+		q.afterEnabled = true
+	}
+	return q, nil
+}
+
+// matches проверяет событие по фильтрам поиска
+func (q searchQuery) matches(event Event) bool {
+	if q.userID != "" && roleOf(event, q.userID) == "" {
+		return false
+	}
+	if q.contains != "" && !strings.Contains(strings.ToLower(event.Title), q.contains) {
+		return false
+	}
+	duration := event.EndTime.Sub(event.StartTime)
+	if duration < q.minDuration || (q.maxDuration > 0 && duration > q.maxDuration) {
+		return false
+	}
+	if !q.from.IsZero() && len(occurrencesBetween(event, q.from, q.to)) == 0 {
+		return false
+	}
+	return true
+}
+
+// before сравнивает события в порядке сортировки выдачи
+func (q searchQuery) before(a, b Event) bool {
+	if !a.StartTime.Equal(b.StartTime) {
+		return a.StartTime.Before(b.StartTime) != q.descending
+	}
+	return (a.ID < b.ID) != q.descending
+}
+
+// searchHandler обработчик для поиска событий (GET /search). Параметры:
+// q — слова названия (все должны встретиться), contains — подстрока
+// названия, user_id — владелец или участник, from и to — хотя бы одно
+// повторение в интервале, min_duration и max_duration — длительность,
+// sort — start или -start, limit и cursor — постраничная выдача. Серии
+// возвращаются целиком, без разворачивания в повторения.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearchQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Кандидаты берутся из самого узкого индекса
+	var candidates []Event
+	actor, authenticated := userFromContext(r.Context())
+	switch {
+	case len(q.tokens) > 0:
+		candidates, err = store.SearchTitle(r.Context(), q.tokens)
+	case q.userID != "":
+		candidates, err = store.ListByUser(r.Context(), q.userID)
+	case authenticated:
+		candidates, err = store.ListByUser(r.Context(), actor)
+	default:
+		candidates, err = store.All(r.Context())
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var results []Event
+	for _, event := range readableEvents(r.Context(), candidates) {
+		if !q.matches(event) {
+			continue
+		}
+		if q.afterEnabled && !q.before(Event{ID: q.afterID, StartTime: q.afterStart}, event) {
+			continue
+		}
+		results = append(results, event)
+	}
+	sort.Slice(results, func(i, j int) bool { return q.before(results[i], results[j]) })
+
+	response := SearchResponse{Events: results}
+	if len(results) > q.limit {
+		response.Events = results[:q.limit]
+		response.NextCursor = encodeCursor(response.Events[q.limit-1])
+	}
+	if response.Events == nil {
+		response.Events = []Event{}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
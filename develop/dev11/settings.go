@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserSettings персональные настройки пользователя календаря. Без рабочих
+// часов действуют defaultWorkingHours; Holidays — выходные дни YYYY-MM-DD
+// в часовом поясе пользователя.
+type UserSettings struct {
+	TimeZone     string         `json:"tz,omitempty"`
+	WorkingHours []WorkingHours `json:"working_hours,omitempty"`
+	Holidays     []string       `json:"holidays,omitempty"`
+}
+
+// settingsStore хранит настройки пользователей в памяти и, если задан путь,
+// сохраняет их в JSON-файл при каждом изменении
+type settingsStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]UserSettings
+}
+
+var settings = newSettingsStore() // Настройки пользователей
+
+// newSettingsStore создает хранилище настроек в памяти
+func newSettingsStore() *settingsStore {
+	return &settingsStore{users: make(map[string]UserSettings)}
+}
+
+// openSettingsStore загружает настройки из файла path
+func openSettingsStore(path string) (*settingsStore, error) {
+	s := newSettingsStore()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read settings: %w", err)
+	}
+	if err := fromJSON(data, &s.users); err != nil {
+		return nil, fmt.Errorf("decode settings: %w", err)
+	}
+	return s, nil
+}
+
+// Get возвращает настройки пользователя
+func (s *settingsStore) Get(userID string) UserSettings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.users[userID]
+}
+
+// Update изменяет настройки пользователя функцией fn и сохраняет результат
+func (s *settingsStore) Update(userID string, fn func(*UserSettings)) (UserSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.users[userID]
+	fn(&current)
+
+	// Изменение попадает в память только после записи в файл, чтобы при
+	// ошибке они не расходились
+	if s.path != "" {
+		users := make(map[string]UserSettings, len(s.users)+1)
+		for id, us := range s.users {
+			users[id] = us
+		}
+		users[userID] = current
+		data, err := toJSON(users)
+		if err != nil {
+			return s.users[userID], err
+		}
+		tmp := s.path + ".tmp"
+		if err := writeFileSync(tmp, data); err != nil {
+			return s.users[userID], fmt.Errorf("write settings: %w", err)
+		}
+		if err := os.Rename(tmp, s.path); err != nil {
+			return s.users[userID], fmt.Errorf("rename settings: %w", err)
+		}
+	}
+	s.users[userID] = current
+	return current, nil
+}
+
+// location возвращает часовой пояс пользователя по умолчанию или UTC
+func (s *settingsStore) location(userID string) *time.Location {
+	if tz := s.Get(userID).TimeZone; tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// userSettingsHandler обработчик для чтения (GET) и изменения (POST)
+// настроек пользователя: tz, working_hours вида "mon-fri 09:00-17:00"
+// (можно повторять) и holidays — даты через запятую
+func userSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := actingUser(r, r.FormValue("user_id"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if userID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing user_id"))
+		return
+	}
+
+	result := settings.Get(userID)
+	if r.Method == http.MethodPost {
+		tz := r.FormValue("tz")
+		if tz != "" {
+			if _, err := time.LoadLocation(tz); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid tz: %v", err))
+				return
+			}
+		}
+
+		// Пустое значение сбрасывает настройку, отсутствующий параметр
+		// оставляет ее прежней
+		var hours []WorkingHours
+		for _, spec := range r.Form["working_hours"] {
+			if strings.TrimSpace(spec) == "" {
+				continue
+			}
+			wh, err := parseWorkingHours(spec)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			hours = append(hours, wh)
+		}
+		holidays, err := parseHolidays(r.Form["holidays"])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result, err = settings.Update(userID, func(us *UserSettings) {
+			if _, ok := r.Form["tz"]; ok {
+				us.TimeZone = tz
+			}
+			if _, ok := r.Form["working_hours"]; ok {
+				us.WorkingHours = hours
+			}
+			if _, ok := r.Form["holidays"]; ok {
+				us.Holidays = holidays
+			}
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
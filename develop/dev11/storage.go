@@ -0,0 +1,790 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Ошибки хранилища событий
+var (
+	ErrEventNotFound = errors.New("event not found")
+	ErrEventExists   = errors.New("event already exists")
+)
+
+// EventStore описывает хранилище событий календаря
+type EventStore interface {
+	Create(ctx context.Context, event Event) error
+	Update(ctx context.Context, event Event) error
+	Delete(ctx context.Context, id string) error
+	Get(ctx context.Context, id string) (Event, error)
+	ListByUser(ctx context.Context, userID string) ([]Event, error)
+	Overlapping(ctx context.Context, userID string, from, to time.Time) ([]Event, error)
+	SearchTitle(ctx context.Context, tokens []string) ([]Event, error)
+	All(ctx context.Context) ([]Event, error)
+	Apply(ctx context.Context, ops []storeOp) error
+	Close() error
+}
+
+// Имена поддерживаемых хранилищ
+const (
+	storageMemory = "memory"
+	storageFile   = "file"
+)
+
+// openStore создает хранилище по имени бэкенда
+func openStore(backend, dir string) (EventStore, error) {
+	switch backend {
+	case "", storageMemory:
+		return newMemoryStore(), nil
+	case storageFile:
+		return openFileStore(dir, defaultSnapshotInterval)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %q", backend)
+	}
+}
+
+// memoryStore хранит события в памяти процесса. Безопасен для конкурентного
+// использования: чтения выполняются параллельно под RWMutex, а индексы по
+// пользователям избавляют ListByUser и Overlapping от полного перебора событий.
+// Событие индексируется у владельца и у каждого участника.
+type memoryStore struct {
+	mu        sync.RWMutex
+	events    map[string]Event
+	byUser    map[string]map[string]struct{}
+	intervals map[string]*intervalIndex
+	byToken   map[string]map[string]struct{} // инвертированный индекс слов названия
+}
+
+// newMemoryStore создает пустое хранилище в памяти
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		events:    make(map[string]Event),
+		byUser:    make(map[string]map[string]struct{}),
+		intervals: make(map[string]*intervalIndex),
+		byToken:   make(map[string]map[string]struct{}),
+	}
+}
+
+// put сохраняет событие и обновляет индексы; вызывающий должен держать s.mu
+func (s *memoryStore) put(event Event) {
+	if old, exists := s.events[event.ID]; exists {
+		s.unindex(old)
+	}
+	s.events[event.ID] = event
+
+	for _, userID := range event.participants() {
+		ids, ok := s.byUser[userID]
+		if !ok {
+			ids = make(map[string]struct{})
+			s.byUser[userID] = ids
+		}
+		ids[event.ID] = struct{}{}
+
+		ix, ok := s.intervals[userID]
+		if !ok {
+			ix = &intervalIndex{}
+			s.intervals[userID] = ix
+		}
+		ix.insert(event.ID, eventSpan(event))
+	}
+
+	for _, token := range titleTokens(event.Title) {
+		ids, ok := s.byToken[token]
+		if !ok {
+			ids = make(map[string]struct{})
+			s.byToken[token] = ids
+		}
+		ids[event.ID] = struct{}{}
+	}
+}
+
+// remove удаляет событие и его записи в индексах; вызывающий должен держать s.mu
+func (s *memoryStore) remove(id string) {
+	event, exists := s.events[id]
+	if !exists {
+		return
+	}
+	delete(s.events, id)
+	s.unindex(event)
+}
+
+// unindex удаляет событие из индексов по пользователям и словам названия
+func (s *memoryStore) unindex(event Event) {
+	for _, userID := range event.participants() {
+		ids := s.byUser[userID]
+		delete(ids, event.ID)
+		if len(ids) == 0 {
+			delete(s.byUser, userID)
+		}
+
+		if ix, ok := s.intervals[userID]; ok {
+			ix.remove(event.ID, eventSpan(event))
+			if ix.len() == 0 {
+				delete(s.intervals, userID)
+			}
+		}
+	}
+
+	for _, token := range titleTokens(event.Title) {
+		ids := s.byToken[token]
+		delete(ids, event.ID)
+		if len(ids) == 0 {
+			delete(s.byToken, token)
+		}
+	}
+}
+
+// Create добавляет новое событие
+func (s *memoryStore) Create(_ context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.events[event.ID]; exists {
+		return ErrEventExists
+	}
+	s.put(event)
+	return nil
+}
+
+// Update заменяет существующее событие
+func (s *memoryStore) Update(_ context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.events[event.ID]; !exists {
+		return ErrEventNotFound
+	}
+	s.put(event)
+	return nil
+}
+
+// Delete удаляет событие по ID
+func (s *memoryStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.events[id]; !exists {
+		return ErrEventNotFound
+	}
+	s.remove(id)
+	return nil
+}
+
+// Apply атомарно выполняет пакет операций: либо все, либо ни одной
+func (s *memoryStore) Apply(_ context.Context, ops []storeOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := checkOps(ops, func(id string) bool {
+		_, exists := s.events[id]
+		return exists
+	})
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		s.applyOp(op)
+	}
+	return nil
+}
+
+// applyOp применяет проверенную операцию; вызывающий должен держать s.mu
+func (s *memoryStore) applyOp(op storeOp) {
+	if op.Op == changeDelete {
+		s.remove(op.ID)
+	} else {
+		s.put(op.Event)
+	}
+}
+
+// Get возвращает событие по ID
+func (s *memoryStore) Get(_ context.Context, id string) (Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	event, exists := s.events[id]
+	if !exists {
+		return Event{}, ErrEventNotFound
+	}
+	return event, nil
+}
+
+// ListByUser возвращает все события, в которых пользователь — владелец или участник
+func (s *memoryStore) ListByUser(_ context.Context, userID string) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := s.byUser[userID]
+	results := make([]Event, 0, len(ids))
+	for id := range ids {
+		results = append(results, s.events[id])
+	}
+	return results, nil
+}
+
+// Overlapping возвращает события пользователя (владельца или участника),
+// которые могут пересекаться с интервалом [from, to). Серии повторений
+// возвращаются целиком, если их период пересекается с интервалом.
+func (s *memoryStore) Overlapping(_ context.Context, userID string, from, to time.Time) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ix, ok := s.intervals[userID]
+	if !ok {
+		return nil, nil
+	}
+	ids := ix.query(from, to)
+	results := make([]Event, 0, len(ids))
+	for _, id := range ids {
+		results = append(results, s.events[id])
+	}
+	return results, nil
+}
+
+// SearchTitle возвращает события, в названии которых встречаются все слова
+// tokens. Поиск идет от самого редкого слова, остальные проверяются по индексу.
+func (s *memoryStore) SearchTitle(_ context.Context, tokens []string) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	rarest := s.byToken[tokens[0]]
+	for _, token := range tokens[1:] {
+		if ids := s.byToken[token]; len(ids) < len(rarest) {
+			rarest = ids
+		}
+	}
+
+	var results []Event
+	for id := range rarest {
+		matched := true
+		for _, token := range tokens {
+			if _, ok := s.byToken[token][id]; !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			results = append(results, s.events[id])
+		}
+	}
+	return results, nil
+}
+
+// All возвращает все события хранилища
+func (s *memoryStore) All(_ context.Context) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([]Event, 0, len(s.events))
+	for _, event := range s.events {
+		results = append(results, event)
+	}
+	return results, nil
+}
+
+// Close ничего не делает для хранилища в памяти
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+const (
+	walFileName             = "events.wal"
+	snapshotFileName        = "events.snapshot.json"
+	defaultSnapshotInterval = 5 * time.Minute
+)
+
+// Операции журнала упреждающей записи
+const (
+	walPut    = "put"
+	walDelete = "delete"
+	walBatch  = "batch"
+)
+
+// walRecord запись журнала упреждающей записи. Пакет операций записывается
+// одной записью walBatch, поэтому после сбоя он либо применяется целиком,
+// либо отбрасывается вместе с недописанной строкой.
+type walRecord struct {
+	Op      string      `json:"op"`
+	ID      string      `json:"id,omitempty"`
+	Event   *Event      `json:"event,omitempty"`
+	Records []walRecord `json:"records,omitempty"`
+}
+
+// fileStore хранит события в памяти, а каждое изменение дописывает в журнал
+// на диске. Журнал периодически сворачивается в снапшот. Мьютекс fileStore
+// упорядочивает записи в журнал, чтения обслуживаются напрямую memoryStore.
+type fileStore struct {
+	mu      sync.Mutex
+	dir     string
+	mem     *memoryStore
+	wal     *os.File
+	records int
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// openFileStore открывает файловое хранилище в каталоге dir и восстанавливает
+// состояние из снапшота и журнала
+func openFileStore(dir string, snapshotInterval time.Duration) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create storage dir: %w", err)
+	}
+
+	s := &fileStore{
+		dir:  dir,
+		mem:  newMemoryStore(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open wal: %w", err)
+	}
+	s.wal = wal
+
+	go s.snapshotLoop(snapshotInterval)
+	return s, nil
+}
+
+// loadSnapshot загружает последний снапшот, если он есть
+func (s *fileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+
+	var snapshot []Event
+	if err := fromJSON(data, &snapshot); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	for _, event := range snapshot {
+		s.mem.put(event)
+	}
+	return nil
+}
+
+// replayWAL применяет записи журнала поверх снапшота. Недописанная последняя
+// запись (падение посреди записи) отбрасывается, а журнал обрезается до
+// последней целой записи.
+func (s *fileStore) replayWAL() error {
+	path := filepath.Join(s.dir, walFileName)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("storage: discarding incomplete wal record at offset %d", valid)
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read wal: %w", err)
+		}
+
+		var record walRecord
+		if err := fromJSON(line, &record); err != nil {
+			log.Printf("storage: discarding corrupted wal tail at offset %d: %v", valid, err)
+			break
+		}
+		s.apply(record)
+		s.records++
+		valid += int64(len(line))
+	}
+
+	if info, err := f.Stat(); err == nil && info.Size() > valid {
+		if err := os.Truncate(path, valid); err != nil {
+			return fmt.Errorf("truncate wal: %w", err)
+		}
+	}
+	return nil
+}
+
+// apply применяет запись журнала к состоянию в памяти. Повторное применение
+// записи безопасно.
+func (s *fileStore) apply(record walRecord) {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	s.applyLocked(record)
+}
+
+// applyLocked применяет запись; вызывающий должен держать s.mem.mu
+func (s *fileStore) applyLocked(record walRecord) {
+	switch record.Op {
+	case walPut:
+		if record.Event != nil {
+			s.mem.put(*record.Event)
+		}
+	case walDelete:
+		s.mem.remove(record.ID)
+	case walBatch:
+		for _, nested := range record.Records {
+			s.applyLocked(nested)
+		}
+	}
+}
+
+// appendWAL дописывает запись в журнал и сбрасывает ее на диск
+func (s *fileStore) appendWAL(record walRecord) error {
+	data, err := toJSON(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := s.wal.Write(data); err != nil {
+		return fmt.Errorf("write wal: %w", err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	s.records++
+	return nil
+}
+
+// Create добавляет новое событие
+func (s *fileStore) Create(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.mem.Get(ctx, event.ID); err == nil {
+		return ErrEventExists
+	}
+	record := walRecord{Op: walPut, Event: &event}
+	if err := s.appendWAL(record); err != nil {
+		return err
+	}
+	s.apply(record)
+	return nil
+}
+
+// Update заменяет существующее событие
+func (s *fileStore) Update(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.mem.Get(ctx, event.ID); err != nil {
+		return err
+	}
+	record := walRecord{Op: walPut, Event: &event}
+	if err := s.appendWAL(record); err != nil {
+		return err
+	}
+	s.apply(record)
+	return nil
+}
+
+// Delete удаляет событие по ID
+func (s *fileStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.mem.Get(ctx, id); err != nil {
+		return err
+	}
+	record := walRecord{Op: walDelete, ID: id}
+	if err := s.appendWAL(record); err != nil {
+		return err
+	}
+	s.apply(record)
+	return nil
+}
+
+// Apply атомарно выполняет пакет операций одной записью журнала
+func (s *fileStore) Apply(ctx context.Context, ops []storeOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := checkOps(ops, func(id string) bool {
+		_, err := s.mem.Get(ctx, id)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	record := walRecord{Op: walBatch, Records: make([]walRecord, 0, len(ops))}
+	for _, op := range ops {
+		if op.Op == changeDelete {
+			record.Records = append(record.Records, walRecord{Op: walDelete, ID: op.ID})
+		} else {
+			event := op.Event
+			record.Records = append(record.Records, walRecord{Op: walPut, Event: &event})
+		}
+	}
+	if err := s.appendWAL(record); err != nil {
+		return err
+	}
+	s.apply(record)
+	return nil
+}
+
+// Get возвращает событие по ID
+func (s *fileStore) Get(ctx context.Context, id string) (Event, error) {
+	return s.mem.Get(ctx, id)
+}
+
+// ListByUser возвращает все события пользователя
+func (s *fileStore) ListByUser(ctx context.Context, userID string) ([]Event, error) {
+	return s.mem.ListByUser(ctx, userID)
+}
+
+// Overlapping возвращает события пользователя, пересекающиеся с [from, to)
+func (s *fileStore) Overlapping(ctx context.Context, userID string, from, to time.Time) ([]Event, error) {
+	return s.mem.Overlapping(ctx, userID, from, to)
+}
+
+// All возвращает все события хранилища
+func (s *fileStore) All(ctx context.Context) ([]Event, error) {
+	return s.mem.All(ctx)
+}
+
+// SearchTitle возвращает события, в названии которых встречаются все слова tokens
+func (s *fileStore) SearchTitle(ctx context.Context, tokens []string) ([]Event, error) {
+	return s.mem.SearchTitle(ctx, tokens)
+}
+
+// snapshotLoop периодически сворачивает журнал в снапшот
+func (s *fileStore) snapshotLoop(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				log.Printf("storage: snapshot failed: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Snapshot записывает текущее состояние в снапшот и очищает журнал
+func (s *fileStore) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshotLocked()
+}
+
+// snapshotLocked выполняет снапшот; вызывающий должен держать s.mu.
+// Снапшот пишется во временный файл и атомарно переименовывается, поэтому
+// падение на любом шаге оставляет на диске согласованные данные.
+func (s *fileStore) snapshotLocked() error {
+	if s.records == 0 {
+		return nil
+	}
+
+	all, _ := s.mem.All(context.Background())
+	data, err := toJSON(all)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, snapshotFileName+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFileName)); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+
+	if err := s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	s.records = 0
+	return nil
+}
+
+// Close делает финальный снапшот и закрывает журнал
+func (s *fileStore) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.snapshotLocked()
+	if cerr := s.wal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileSync записывает файл и сбрасывает его содержимое на диск
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Виды изменений событий
+const (
+	changeCreate = "create"
+	changeUpdate = "update"
+	changeDelete = "delete"
+)
+
+// storeChange изменение события, о котором уведомляются наблюдатели
+// хранилища. Event — новое состояние (nil при удалении), Old — прежнее
+// (nil при создании). Actor — аутентифицированный пользователь запроса,
+// пустой без аутентификации.
+type storeChange struct {
+	Op    string
+	ID    string
+	Event *Event
+	Old   *Event
+	Actor string
+	At    time.Time
+}
+
+// observedStore оборачивает хранилище и после каждой успешной записи
+// уведомляет наблюдателей. Записи и уведомления упорядочены мьютексом, поэтому
+// наблюдатели видят изменения в том же порядке, в каком они применены.
+// Наблюдатели вызываются под мьютексом и не должны блокироваться.
+type observedStore struct {
+	EventStore
+	mu        sync.Mutex
+	observers []func(storeChange)
+}
+
+// observeStore оборачивает хранилище, подписывая наблюдателей на изменения
+func observeStore(s EventStore, observers ...func(storeChange)) *observedStore {
+	return &observedStore{EventStore: s, observers: observers}
+}
+
+// notify передает изменение всем наблюдателям
+func (s *observedStore) notify(ctx context.Context, change storeChange) {
+	change.Actor, _ = userFromContext(ctx)
+	change.At = time.Now().UTC()
+	for _, observer := range s.observers {
+		observer(change)
+	}
+}
+
+// Create добавляет событие и уведомляет наблюдателей
+func (s *observedStore) Create(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.EventStore.Create(ctx, event); err != nil {
+		return err
+	}
+	s.notify(ctx, storeChange{Op: changeCreate, ID: event.ID, Event: &event})
+	return nil
+}
+
+// Update заменяет событие и уведомляет наблюдателей
+func (s *observedStore) Update(ctx context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, err := s.EventStore.Get(ctx, event.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.EventStore.Update(ctx, event); err != nil {
+		return err
+	}
+	s.notify(ctx, storeChange{Op: changeUpdate, ID: event.ID, Event: &event, Old: &old})
+	return nil
+}
+
+// Delete удаляет событие и уведомляет наблюдателей
+func (s *observedStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, err := s.EventStore.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.EventStore.Delete(ctx, id); err != nil {
+		return err
+	}
+	s.notify(ctx, storeChange{Op: changeDelete, ID: id, Old: &old})
+	return nil
+}
+
+// Apply выполняет пакет операций и уведомляет наблюдателей о каждом
+// изменении в порядке операций
+func (s *observedStore) Apply(ctx context.Context, ops []storeOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Прежнее состояние может быть результатом предыдущей операции пакета
+	view := make(map[string]*Event)
+	changes := make([]storeChange, 0, len(ops))
+	for _, op := range ops {
+		id := op.id()
+		old, seen := view[id]
+		if !seen {
+			if event, err := s.EventStore.Get(ctx, id); err == nil {
+				old = &event
+			}
+		}
+		change := storeChange{Op: op.Op, ID: id, Old: old}
+		if op.Op == changeDelete {
+			view[id] = nil
+		} else {
+			event := op.Event
+			change.Event = &event
+			view[id] = &event
+		}
+		if op.Op == changeCreate {
+			change.Old = nil
+		}
+		changes = append(changes, change)
+	}
+
+	if err := s.EventStore.Apply(ctx, ops); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		s.notify(ctx, change)
+	}
+	return nil
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -16,15 +25,42 @@ type Event struct {
 	UserID    string    `json:"user_id"`
 	StartTime time.Time `json:"start_time"`
 	EndTime   time.Time `json:"end_time"`
+
+	// Календарь владельца; пусто — календарь по умолчанию. Отдельно
+	// измененное повторение всегда находится в календаре серии.
+	CalendarID string `json:"calendar_id,omitempty"`
+
+	// Повторение: правило RRULE и исключенные даты серии
+	RRule   string      `json:"rrule,omitempty"`
+	ExDates []time.Time `json:"exdates,omitempty"`
+
+	// Часовой пояс серии (имя IANA): повторения разворачиваются по местному
+	// времени и не сдвигаются при переходе на летнее время
+	TimeZone string `json:"time_zone,omitempty"`
+
+	// Отдельно измененное повторение серии: ID серии и исходное начало
+	// повторения. RecurrenceID также заполняется у развернутых повторений.
+	SeriesID     string     `json:"series_id,omitempty"`
+	RecurrenceID *time.Time `json:"recurrence_id,omitempty"`
+
+	// Приглашенные участники с ролями и ответами на приглашение; владелец
+	// (UserID) в список не входит
+	Attendees []Attendee `json:"attendees,omitempty"`
+
+	// За сколько до начала каждого повторения напоминать участникам
+	Reminders []Duration `json:"reminders,omitempty"`
 }
 
 // JSONResponse представляет стандартный ответ в формате JSON
 type JSONResponse struct {
-	Result string `json:"result,omitempty"`
-	Error  string `json:"error,omitempty"`
+	Result string   `json:"result,omitempty"`
+	Error  string   `json:"error,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+
+	Conflicts []string `json:"conflicts,omitempty"`
 }
 
-var events = make(map[string]Event) // In-memory store for events
+var store EventStore = newMemoryStore() // Хранилище событий, выбирается при старте
 
 // toJSON сериализует объект в JSON
 func toJSON(v interface{}) ([]byte, error) {
@@ -36,15 +72,41 @@ func fromJSON(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
 
-// parseAndValidateEvent парсит и валидирует входные данные для события
-func parseAndValidateEvent(r *http.Request) (Event, error) {
-	var event Event
+// writeJSON отправляет объект в формате JSON с указанным статусом
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	response, err := toJSON(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		response, _ = toJSON(JSONResponse{Error: err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// writeError отправляет ошибку в формате JSON ({"error": "..."})
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, JSONResponse{Error: err.Error()})
+}
+
+// parseAndValidateEvent парсит и валидирует входные данные для события.
+// Ошибки валидации записываются в журнал с ID запроса.
+func parseAndValidateEvent(r *http.Request) (event Event, err error) {
+	defer func() {
+		if err != nil {
+			requestLogger(r.Context()).Warn("invalid event", "path", r.URL.Path, "error", err.Error())
+		}
+	}()
+
 	if err := r.ParseForm(); err != nil {
 		return event, fmt.Errorf("invalid request body: %v", err)
 	}
 
 	event.Title = r.FormValue("title")
 	event.UserID = r.FormValue("user_id")
+	if actor, ok := userFromContext(r.Context()); ok && event.UserID == "" {
+		event.UserID = actor
+	}
 	startTimeStr := r.FormValue("start_time")
 	endTimeStr := r.FormValue("end_time")
 
@@ -52,7 +114,6 @@ func parseAndValidateEvent(r *http.Request) (Event, error) {
 		return event, fmt.Errorf("missing required fields")
 	}
 
-	var err error
 	event.StartTime, err = time.Parse(time.RFC3339, startTimeStr)
 	if err != nil {
 		return event, fmt.Errorf("invalid start_time: %v", err)
@@ -63,11 +124,88 @@ func parseAndValidateEvent(r *http.Request) (Event, error) {
 		return event, fmt.Errorf("invalid end_time: %v", err)
 	}
 
+	event.CalendarID = r.FormValue("calendar_id")
+	if event.CalendarID != "" && !validID(event.CalendarID) {
+		return event, fmt.Errorf("invalid calendar_id")
+	}
+
+	event.RRule = r.FormValue("rrule")
+	for _, value := range r.Form["exdate"] {
+		for _, exdateStr := range strings.Split(value, ",") {
+			exdate, err := time.Parse(time.RFC3339, strings.TrimSpace(exdateStr))
+			if err != nil {
+				return event, fmt.Errorf("invalid exdate: %v", err)
+			}
+			event.ExDates = append(event.ExDates, exdate)
+		}
+	}
+	event.TimeZone = r.FormValue("time_zone")
+
+	if event.Reminders, err = parseReminders(r.Form["reminders"]); err != nil {
+		return event, err
+	}
+
+	return event, validateEvent(event)
+}
+
+// validateEvent проверяет согласованность полей события независимо от того,
+// откуда оно получено
+func validateEvent(event Event) error {
+	if event.Title == "" || event.UserID == "" || event.StartTime.IsZero() || event.EndTime.IsZero() {
+		return fmt.Errorf("missing required fields")
+	}
+
 	if event.EndTime.Before(event.StartTime) {
-		return event, fmt.Errorf("end_time cannot be before start_time")
+		return fmt.Errorf("end_time cannot be before start_time")
 	}
 
-	return event, nil
+	if event.RRule != "" {
+		if _, err := parseRRule(event.RRule); err != nil {
+			return fmt.Errorf("invalid rrule: %v", err)
+		}
+	}
+	if len(event.ExDates) > 0 && event.RRule == "" {
+		return fmt.Errorf("exdate requires rrule")
+	}
+	if event.TimeZone != "" {
+		if _, err := time.LoadLocation(event.TimeZone); err != nil {
+			return fmt.Errorf("invalid time_zone: %v", err)
+		}
+	}
+	if err := validateReminders(event.Reminders); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// keepServerFields переносит в обновленное событие поля, которые не
+// передаются в запросе на изменение и управляются сервером. Исключения серии,
+// добавленные при переносе и удалении повторений, объединяются с
+// переданными клиентом.
+func keepServerFields(event *Event, existing Event) {
+	event.SeriesID, event.RecurrenceID = existing.SeriesID, existing.RecurrenceID
+	event.Attendees = existing.Attendees
+	if event.RRule != "" {
+		event.ExDates = mergeExDates(event.ExDates, existing.ExDates)
+	}
+	if existing.SeriesID != "" {
+		event.CalendarID = existing.CalendarID
+	}
+}
+
+// parseRecurrenceID парсит необязательный recurrence_id — начало отдельного
+// повторения серии
+func parseRecurrenceID(r *http.Request) (*time.Time, error) {
+	value := r.FormValue("recurrence_id")
+	if value == "" {
+		return nil, nil
+	}
+	recurrenceID, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recurrence_id: %v", err)
+	}
+	return &recurrenceID, nil
 }
 
 // parseAndValidateID парсит и валидирует ID события
@@ -76,19 +214,31 @@ func parseAndValidateID(r *http.Request) (string, error) {
 	if id == "" {
 		return "", fmt.Errorf("missing id")
 	}
+	if !validID(id) {
+		return "", fmt.Errorf("invalid id")
+	}
 	return id, nil
 }
 
-// parseAndValidateUserIDAndDate парсит и валидирует user_id и дату
+// parseAndValidateUserIDAndDate парсит и валидирует user_id и дату. Дата
+// возвращается как полночь в часовом поясе запроса (см. requestLocation).
 func parseAndValidateUserIDAndDate(r *http.Request) (string, time.Time, error) {
 	userID := r.URL.Query().Get("user_id")
 	dateStr := r.URL.Query().Get("date")
+	if actor, ok := userFromContext(r.Context()); ok && userID == "" {
+		userID = actor
+	}
 
 	if userID == "" || dateStr == "" {
 		return "", time.Time{}, fmt.Errorf("missing user_id or date")
 	}
 
-	date, err := time.Parse("2006-01-02", dateStr)
+	loc, err := requestLocation(r, userID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", dateStr, loc)
 	if err != nil {
 		return "", time.Time{}, fmt.Errorf("invalid date: %v", err)
 	}
@@ -96,154 +246,306 @@ func parseAndValidateUserIDAndDate(r *http.Request) (string, time.Time, error) {
 	return userID, date, nil
 }
 
+// writeStoreError отправляет ответ с ошибкой хранилища
+func writeStoreError(w http.ResponseWriter, err error) {
+	writeError(w, storeErrorStatus(err), err)
+}
+
+// storeErrorStatus возвращает HTTP-статус для ошибки хранилища
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrEventNotFound), errors.Is(err, ErrOccurrenceNotFound), errors.Is(err, ErrCalendarNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrEventExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrEventLimit):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// eventsBetween возвращает события пользователя, начинающиеся в интервале
+// [from, to). Повторяющиеся события разворачиваются в отдельные повторения.
+func eventsBetween(ctx context.Context, userID string, from, to time.Time) ([]Event, error) {
+	userEvents, err := store.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Event
+	for _, event := range userEvents {
+		results = append(results, occurrencesBetween(event, from, to)...)
+	}
+	sortEvents(results)
+	return results, nil
+}
+
+// sortEvents упорядочивает события по времени начала
+func sortEvents(events []Event) {
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].StartTime.Equal(events[j].StartTime) {
+			return events[i].StartTime.Before(events[j].StartTime)
+		}
+		return events[i].ID < events[j].ID
+	})
+}
+
 // createEventHandler обработчик для создания события
 func createEventHandler(w http.ResponseWriter, r *http.Request) {
 	event, err := parseAndValidateEvent(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	event.ID = fmt.Sprintf("%d", time.Now().UnixNano())
-	events[event.ID] = event
+	rejectOverlap, err := parseRejectOverlap(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
-	response, _ := toJSON(JSONResponse{Result: "event created"})
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	w.Write(response)
+	if event.UserID, err = actingUser(r, event.UserID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	event.ID = newEventID()
+
+	unlock := userLocks.lock(event.UserID)
+	defer unlock()
+
+	if err := validateCalendar(event); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !checkConflicts(w, r, event, rejectOverlap) {
+		return
+	}
+
+	if err := store.Create(r.Context(), event); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, JSONResponse{Result: "event created"})
 }
 
-// updateEventHandler обработчик для обновления события
+// updateEventHandler обработчик для обновления события. Исключения серии,
+// добавленные сервером при переносе и удалении повторений, сохраняются,
+// даже если клиент их не передал.
 func updateEventHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
 	id, err := parseAndValidateID(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
 	event, err := parseAndValidateEvent(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	if _, exists := events[id]; !exists {
-		http.Error(w, `{"error": "event not found"}`, http.StatusNotFound)
+	recurrenceID, err := parseRecurrenceID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	event.ID = id
-	events[id] = event
+	rejectOverlap, err := parseRejectOverlap(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
-	response, _ := toJSON(JSONResponse{Result: "event updated"})
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(response)
+	existing, err := store.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !canModify(r.Context(), existing) {
+		writeStoreError(w, ErrForbidden)
+		return
+	}
+
+	// Редактор изменяет событие от имени владельца, передать событие
+	// другому пользователю при включенной аутентификации нельзя
+	if actor, ok := userFromContext(r.Context()); ok {
+		if event.UserID != actor && event.UserID != existing.UserID {
+			writeStoreError(w, ErrForbidden)
+			return
+		}
+		event.UserID = existing.UserID
+	}
+
+	if recurrenceID != nil {
+		if event.RRule != "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("rrule is not allowed for a single occurrence"))
+			return
+		}
+		event.ID = newEventID()
+		event.SeriesID = id
+		event.RecurrenceID = recurrenceID
+		event.Attendees = existing.Attendees
+		event.CalendarID = existing.CalendarID
+	} else {
+		event.ID = id
+		keepServerFields(&event, existing)
+	}
+
+	unlock := userLocks.lock(event.UserID)
+	defer unlock()
+
+	if err := validateCalendar(event); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !checkConflicts(w, r, event, rejectOverlap) {
+		return
+	}
+
+	if recurrenceID != nil {
+		err = updateOccurrence(r.Context(), id, *recurrenceID, event)
+	} else {
+		err = store.Update(r.Context(), event)
+		if err == nil && event.CalendarID != existing.CalendarID {
+			err = moveOverrides(r.Context(), event)
+		}
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, JSONResponse{Result: "event updated"})
 }
 
 // deleteEventHandler обработчик для удаления события
 func deleteEventHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
 	id, err := parseAndValidateID(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	if _, exists := events[id]; !exists {
-		http.Error(w, `{"error": "event not found"}`, http.StatusNotFound)
+	recurrenceID, err := parseRecurrenceID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	delete(events, id)
+	existing, err := store.Get(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !canDelete(r.Context(), existing) {
+		writeStoreError(w, ErrForbidden)
+		return
+	}
 
-	response, _ := toJSON(JSONResponse{Result: "event deleted"})
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(response)
+	if recurrenceID != nil {
+		err = deleteOccurrence(r.Context(), id, *recurrenceID)
+	} else {
+		err = deleteSeries(r.Context(), id)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, JSONResponse{Result: "event deleted"})
 }
 
 // eventsForDayHandler обработчик для получения событий за день
 func eventsForDayHandler(w http.ResponseWriter, r *http.Request) {
 	userID, date, err := parseAndValidateUserIDAndDate(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	filter, err := parseCalendarFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	startOfDay := date
-	endOfDay := date.Add(24 * time.Hour)
+	startOfDay, endOfDay := dayWindow(date)
 
-	var results []Event
-	for _, event := range events {
-		if event.UserID == userID && event.StartTime.After(startOfDay) && event.StartTime.Before(endOfDay) {
-			results = append(results, event)
-		}
+	results, err := eventsBetween(r.Context(), userID, startOfDay, endOfDay)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
+	results = readableEvents(r.Context(), inCalendars(results, filter))
+	inLocation(results, date.Location())
 
-	response, _ := toJSON(results)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(response)
+	writeJSON(w, http.StatusOK, results)
 }
 
 // eventsForWeekHandler обработчик для получения событий за неделю
 func eventsForWeekHandler(w http.ResponseWriter, r *http.Request) {
 	userID, date, err := parseAndValidateUserIDAndDate(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	filter, err := parseCalendarFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	startOfWeek := date
-	endOfWeek := date.AddDate(0, 0, 7)
+	startOfWeek, endOfWeek := isoWeekWindow(date)
 
-	var results []Event
-	for _, event := range events {
-		if event.UserID == userID && event.StartTime.After(startOfWeek) && event.StartTime.Before(endOfWeek) {
-			results = append(results, event)
-		}
+	results, err := eventsBetween(r.Context(), userID, startOfWeek, endOfWeek)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
+	results = readableEvents(r.Context(), inCalendars(results, filter))
+	inLocation(results, date.Location())
 
-	response, _ := toJSON(results)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(response)
+	writeJSON(w, http.StatusOK, results)
 }
 
 // eventsForMonthHandler обработчик для получения событий за месяц
 func eventsForMonthHandler(w http.ResponseWriter, r *http.Request) {
 	userID, date, err := parseAndValidateUserIDAndDate(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	filter, err := parseCalendarFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	startOfMonth := date
-	endOfMonth := date.AddDate(0, 1, 0)
+	startOfMonth, endOfMonth := monthWindow(date)
 
-	var results []Event
-	for _, event := range events {
-		if event.UserID == userID && event.StartTime.After(startOfMonth) && event.StartTime.Before(endOfMonth) {
-			results = append(results, event)
-		}
+	results, err := eventsBetween(r.Context(), userID, startOfMonth, endOfMonth)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
+	results = readableEvents(r.Context(), inCalendars(results, filter))
+	inLocation(results, date.Location())
 
-	response, _ := toJSON(results)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(response)
+	writeJSON(w, http.StatusOK, results)
 }
 
-// loggingMiddleware middleware для логирования запросов
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s", r.Method, r.RequestURI, r.RemoteAddr)
-		next.ServeHTTP(w, r)
-	})
-}
-
-// main основная функция, запускающая сервер
-func main() {
+// newMux регистрирует обработчики всех методов API
+func newMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/create_event", createEventHandler)
@@ -252,21 +554,194 @@ func main() {
 	mux.HandleFunc("/events_for_day", eventsForDayHandler)
 	mux.HandleFunc("/events_for_week", eventsForWeekHandler)
 	mux.HandleFunc("/events_for_month", eventsForMonthHandler)
+	mux.HandleFunc("/free_busy", freeBusyHandler)
+	mux.HandleFunc("/suggest_meeting", suggestMeetingHandler)
+	mux.HandleFunc("/user_settings", userSettingsHandler)
+	mux.HandleFunc(v2UsersPrefix, apiV2Handler)
+	mux.HandleFunc("/invite_attendee", inviteAttendeeHandler)
+	mux.HandleFunc("/respond_invite", respondInviteHandler)
+	mux.HandleFunc("/remove_attendee", removeAttendeeHandler)
+	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc("/export_ics", exportICSHandler)
+	mux.HandleFunc("/import_ics", importICSHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/search", searchHandler)
+	mux.HandleFunc("/changes", changesHandler)
+	mux.HandleFunc("/event_history", eventHistoryHandler)
+	mux.HandleFunc("/revert_event", revertEventHandler)
+	mux.HandleFunc("/batch", batchHandler)
+	mux.HandleFunc("/calendars", calendarsHandler)
+	mux.HandleFunc("/create_calendar", createCalendarHandler)
+	mux.HandleFunc("/update_calendar", updateCalendarHandler)
+	mux.HandleFunc("/delete_calendar", deleteCalendarHandler)
+	mux.HandleFunc("/rpc", rpcHandler)
+	mux.HandleFunc("/openapi.json", openAPIHandler)
+
+	return mux
+}
+
+// openBackends загружает хранилище событий, настройки пользователей и
+// запускает планировщик напоминаний. Хранилище оборачивается лимитом событий
+// на пользователя и наблюдателем, через который планировщик, лента
+// изменений и история узнают об изменениях событий.
+func openBackends(backend, storageDir string, maxEventsPerUser int) (EventStore, *reminderScheduler, error) {
+	eventStore, err := openStore(backend, storageDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open storage: %w", err)
+	}
+
+	var reminderStatePath string
+	if backend == storageFile {
+		settings, err = openSettingsStore(filepath.Join(storageDir, "user_settings.json"))
+		if err != nil {
+			eventStore.Close()
+			return nil, nil, fmt.Errorf("open user settings: %w", err)
+		}
+		calendars, err = openCalendarStore(filepath.Join(storageDir, "calendars.json"))
+		if err != nil {
+			eventStore.Close()
+			return nil, nil, fmt.Errorf("open calendars: %w", err)
+		}
+		history, err = openHistoryStore(filepath.Join(storageDir, "history.jsonl"), defaultHistoryRetention)
+		if err != nil {
+			eventStore.Close()
+			return nil, nil, fmt.Errorf("open history: %w", err)
+		}
+		reminderStatePath = filepath.Join(storageDir, "reminders.json")
+	}
+
+	var notifier Notifier = logNotifier{}
+	if url := os.Getenv("REMINDER_WEBHOOK_URL"); url != "" {
+		notifier = newWebhookNotifier(url)
+	}
+	reminders := newReminderScheduler(eventStore, notifier, reminderStatePath)
+	if err := reminders.Start(context.Background()); err != nil {
+		eventStore.Close()
+		return nil, nil, fmt.Errorf("start reminders: %w", err)
+	}
+
+	store = observeStore(limitStore(eventStore, maxEventsPerUser), reminders.onChange, feed.onChange, history.onChange)
+	return eventStore, reminders, nil
+}
 
-	loggedMux := loggingMiddleware(mux)
+func main() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// hash-password печатает хэш пароля для записи в реестр пользователей
+	if len(os.Args) == 3 && os.Args[1] == "hash-password" {
+		hash, err := hashPassword(os.Args[2])
+		if err != nil {
+			log.Fatalf("Could not hash password: %s\n", err)
+		}
+		fmt.Println(hash)
+		return
 	}
 
+	config, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s\n", err)
+	}
+	level, _ := config.logLevel()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	mux := newMux()
+	rejectOverlapDefault = config.RejectOverlap
+	quotas, _ := parseRateLimits(config.RateLimits)
+
+	var handler http.Handler = rateLimitMiddleware(newRateLimiter(quotas), mux, validationMiddleware(mux))
+	if config.AuthUsersFile != "" {
+		auth, err = loadAuthenticator(config.AuthUsersFile, []byte(os.Getenv("AUTH_SECRET")), defaultTokenTTL)
+		if err != nil {
+			log.Fatalf("Could not load authentication: %s\n", err)
+		}
+		handler = authMiddleware(auth, handler)
+	}
+
+	handler = bodyLimitMiddleware(config.MaxBodyBytes, handler)
+	loggedMux := loggingMiddleware(metricsMiddleware(mux, readinessMiddleware(handler)))
+
 	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: loggedMux,
+		Addr:              config.Listen,
+		Handler:           loggedMux,
+		ReadHeaderTimeout: time.Duration(config.Timeouts.ReadHeader),
+		ReadTimeout:       time.Duration(config.Timeouts.Read),
+		WriteTimeout:      time.Duration(config.Timeouts.Write),
+		IdleTimeout:       time.Duration(config.Timeouts.Idle),
 	}
+	// Потоки ленты изменений не завершаются сами и задержали бы остановку
+	server.RegisterOnShutdown(feed.Close)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Сервер начинает слушать порт сразу, чтобы проверка живости проходила,
+	// пока хранилище загружается; до готовности API отвечает 503
+	serverErr := make(chan error, 2)
+	go func() {
+		if config.tls() {
+			log.Println("Starting HTTPS server on", config.Listen)
+			serverErr <- server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+			return
+		}
+		log.Println("Starting server on", config.Listen)
+		serverErr <- server.ListenAndServe()
+	}()
 
-	log.Println("Starting server on port", port)
-	if err := server.ListenAndServe(); err != nil {
+	eventStore, reminders, err := openBackends(config.Storage, config.StorageDir, config.MaxEventsPerUser)
+	if err != nil {
+		log.Fatalf("Could not load storage: %s\n", err)
+	}
+
+	// Метрики слушают отдельный адрес, закрытый от клиентов API. Сервер
+	// метрик запускается после загрузки хранилища, которое он читает.
+	var metricsServer *http.Server
+	if config.MetricsListen != "" {
+		metricsServer = &http.Server{
+			Addr:              config.MetricsListen,
+			Handler:           newMetricsMux(),
+			ReadHeaderTimeout: time.Duration(config.Timeouts.ReadHeader),
+		}
+		go func() {
+			log.Println("Serving metrics on", config.MetricsListen)
+			serverErr <- metricsServer.ListenAndServe()
+		}()
+	}
+	ready.Store(true)
+	log.Println("Storage loaded, server is ready")
+
+	select {
+	case err := <-serverErr:
 		log.Fatalf("Could not start server: %s\n", err)
+	case <-ctx.Done():
+	}
+
+	// Остановка: снимаем готовность, даем текущим запросам завершиться до
+	// истечения таймаута остановки, затем сохраняем напоминания и хранилище
+	log.Println("Shutting down")
+	ready.Store(false)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeouts.Shutdown))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Could not drain connections: %s\n", err)
+		server.Close()
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	remindersCtx, cancelReminders := context.WithTimeout(context.Background(), reminderShutdownTimeout)
+	defer cancelReminders()
+	if err := reminders.Shutdown(remindersCtx); err != nil {
+		log.Printf("Could not save reminders: %s\n", err)
+	}
+	if err := eventStore.Close(); err != nil {
+		log.Printf("Could not close storage: %s\n", err)
+	}
+	if err := history.Close(); err != nil {
+		log.Printf("Could not close history: %s\n", err)
 	}
 }
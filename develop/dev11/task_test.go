@@ -1,19 +1,65 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
-func setup() {
-	events = make(map[string]Event)
+// setup заменяет глобальные хранилища пустыми на время теста и
+// восстанавливает прежние глобальные переменные после него
+func setup(t *testing.T) {
+	previousStore, previousSettings, previousCalendars := store, settings, calendars
+	previousAuth, previousMetrics, previousFeed, previousHistory := auth, metrics, feed, history
+	wasReady := ready.Load()
+	t.Cleanup(func() {
+		store, settings, calendars = previousStore, previousSettings, previousCalendars
+		auth, metrics, feed, history = previousAuth, previousMetrics, previousFeed, previousHistory
+		ready.Store(wasReady)
+	})
+
+	store = newMemoryStore()
+	settings = newSettingsStore()
+	calendars = newCalendarStore()
+}
+
+func addEvent(t *testing.T, event Event) {
+	t.Helper()
+	if err := store.Create(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// formRequest создает POST-запрос с телом-формой form
+func formRequest(target, form string) *http.Request {
+	req := httptest.NewRequest("POST", target, strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+// post отправляет форму form обработчику handler
+func post(handler http.HandlerFunc, form string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler(rr, formRequest("/", form))
+	return rr
 }
 
 func TestCreateEvent(t *testing.T) {
-	setup()
+	setup(t)
 
 	form := "title=TestEvent&user_id=1&start_time=2024-07-25T15:00:00Z&end_time=2024-07-25T16:00:00Z"
 	req, err := http.NewRequest("POST", "/create_event", strings.NewReader(form))
@@ -39,7 +85,7 @@ func TestCreateEvent(t *testing.T) {
 }
 
 func TestUpdateEvent(t *testing.T) {
-	setup()
+	setup(t)
 
 	// First create an event to update
 	event := Event{
@@ -49,7 +95,7 @@ func TestUpdateEvent(t *testing.T) {
 		StartTime: time.Date(2024, 7, 25, 15, 0, 0, 0, time.UTC),
 		EndTime:   time.Date(2024, 7, 25, 16, 0, 0, 0, time.UTC),
 	}
-	events[event.ID] = event
+	addEvent(t, event)
 
 	form := "id=12345&title=UpdatedEvent&user_id=1&start_time=2024-07-25T15:00:00Z&end_time=2024-07-25T17:00:00Z"
 	req, err := http.NewRequest("POST", "/update_event", strings.NewReader(form))
@@ -75,7 +121,7 @@ func TestUpdateEvent(t *testing.T) {
 }
 
 func TestDeleteEvent(t *testing.T) {
-	setup()
+	setup(t)
 
 	// First create an event to delete
 	event := Event{
@@ -85,7 +131,7 @@ func TestDeleteEvent(t *testing.T) {
 		StartTime: time.Date(2024, 7, 25, 15, 0, 0, 0, time.UTC),
 		EndTime:   time.Date(2024, 7, 25, 16, 0, 0, 0, time.UTC),
 	}
-	events[event.ID] = event
+	addEvent(t, event)
 
 	form := "id=12345"
 	req, err := http.NewRequest("POST", "/delete_event", strings.NewReader(form))
@@ -111,7 +157,7 @@ func TestDeleteEvent(t *testing.T) {
 }
 
 func TestEventsForDay(t *testing.T) {
-	setup()
+	setup(t)
 
 	// Create an event
 	event := Event{
@@ -121,7 +167,7 @@ func TestEventsForDay(t *testing.T) {
 		StartTime: time.Date(2024, 7, 25, 15, 0, 0, 0, time.UTC),
 		EndTime:   time.Date(2024, 7, 25, 16, 0, 0, 0, time.UTC),
 	}
-	events[event.ID] = event
+	addEvent(t, event)
 
 	req, err := http.NewRequest("GET", "/events_for_day?user_id=1&date=2024-07-25", nil)
 	if err != nil {
@@ -143,3 +189,2318 @@ func TestEventsForDay(t *testing.T) {
 			rr.Body.String(), expected)
 	}
 }
+
+func TestFileStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	fs, err := openFileStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := Event{ID: "1", Title: "First", UserID: "1",
+		StartTime: time.Date(2024, 7, 25, 15, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2024, 7, 25, 16, 0, 0, 0, time.UTC)}
+	second := first
+	second.ID, second.Title = "2", "Second"
+
+	if err := fs.Create(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Create(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	first.Title = "First updated"
+	if err := fs.Update(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete(ctx, second.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Имитируем падение: журнал не сворачивается, а в конец дописана
+	// недописанная запись
+	close(fs.stop)
+	<-fs.done
+	fs.wal.Write([]byte(`{"op":"put","event":{"id":"3"`))
+	fs.wal.Close()
+
+	restored, err := openFileStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	all, _ := restored.All(ctx)
+	if len(all) != 1 {
+		t.Fatalf("expected 1 event after replay, got %d: %v", len(all), all)
+	}
+	if all[0].Title != "First updated" {
+		t.Errorf("expected replayed update, got %q", all[0].Title)
+	}
+
+	if err := restored.Create(ctx, second); err != nil {
+		t.Fatalf("wal must accept writes after truncating broken tail: %v", err)
+	}
+}
+
+func TestConcurrentHandlers(t *testing.T) {
+	setup(t)
+	backends := map[string]func(t *testing.T) EventStore{
+		"memory": func(t *testing.T) EventStore { return newMemoryStore() },
+		"file": func(t *testing.T) EventStore {
+			fs, err := openFileStore(t.TempDir(), 10*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fs
+		},
+	}
+
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			store = open(t)
+			defer store.Close()
+
+			const workers = 8
+			const iterations = 50
+
+			for i := 0; i < workers*iterations; i++ {
+				addEvent(t, Event{ID: fmt.Sprintf("%d", i), Title: "Seed", UserID: fmt.Sprintf("%d", i%workers),
+					StartTime: time.Date(2024, 7, 25, 15, 0, 0, 0, time.UTC),
+					EndTime:   time.Date(2024, 7, 25, 16, 0, 0, 0, time.UTC)})
+			}
+
+			get := func(handler http.HandlerFunc, query string) int {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest("GET", "/?"+query, nil))
+				return rr.Code
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan string, workers*iterations*6)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < iterations; i++ {
+						id := fmt.Sprintf("%d", w*iterations+i)
+						user := fmt.Sprintf("%d", (w+i)%workers)
+						fields := "title=T&user_id=" + user + "&start_time=2024-07-25T15:00:00Z&end_time=2024-07-25T16:00:00Z"
+						query := "user_id=" + user + "&date=2024-07-25"
+
+						if code := post(createEventHandler, fields).Code; code != http.StatusCreated {
+							errs <- fmt.Sprintf("create: %d", code)
+						}
+						if code := post(updateEventHandler, "id="+id+"&"+fields).Code; code != http.StatusOK {
+							errs <- fmt.Sprintf("update %s: %d", id, code)
+						}
+						for _, h := range []http.HandlerFunc{eventsForDayHandler, eventsForWeekHandler, eventsForMonthHandler} {
+							if code := get(h, query); code != http.StatusOK {
+								errs <- fmt.Sprintf("list: %d", code)
+							}
+						}
+						if code := post(deleteEventHandler, "id="+id).Code; code != http.StatusOK {
+							errs <- fmt.Sprintf("delete %s: %d", id, code)
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Error(err)
+			}
+
+			all, _ := store.All(context.Background())
+			if len(all) != workers*iterations {
+				t.Errorf("expected %d created events to remain, got %d", workers*iterations, len(all))
+			}
+		})
+	}
+}
+
+func TestExpandRecurrence(t *testing.T) {
+	start := time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC) // понедельник
+	from := time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		rrule   string
+		exdates []time.Time
+		want    []string
+	}{
+		{"daily count", "FREQ=DAILY;INTERVAL=2;COUNT=3", nil,
+			[]string{"2024-07-01", "2024-07-03", "2024-07-05"}},
+		{"weekly byday with exdate", "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=4",
+			[]time.Time{time.Date(2024, 7, 3, 10, 0, 0, 0, time.UTC)},
+			[]string{"2024-07-01", "2024-07-08", "2024-07-10"}},
+		{"weekly until", "FREQ=WEEKLY;INTERVAL=2;UNTIL=20240730T000000Z", nil,
+			[]string{"2024-07-01", "2024-07-15", "2024-07-29"}},
+		{"monthly last friday", "FREQ=MONTHLY;BYDAY=-1FR;COUNT=2", nil,
+			[]string{"2024-07-26", "2024-08-30"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := parseRRule(tt.rrule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, occurrence := range expandRecurrence(start, rule, tt.exdates, from, to) {
+				got = append(got, occurrence.Format("2006-01-02"))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"", "FREQ=YEARLY", "FREQ=WEEKLY;BYDAY=1MO", "FREQ=DAILY;COUNT=2;UNTIL=20240101"} {
+		if _, err := parseRRule(invalid); err == nil {
+			t.Errorf("expected error for rrule %q", invalid)
+		}
+	}
+}
+
+func TestRecurringEventOccurrences(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+
+	addEvent(t, Event{ID: "100", Title: "Standup", UserID: "1",
+		StartTime: time.Date(2024, 7, 22, 9, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2024, 7, 22, 9, 15, 0, 0, time.UTC),
+		RRule:     "FREQ=DAILY;COUNT=5"})
+
+	events, err := eventsBetween(ctx, "1", time.Date(2024, 7, 22, 0, 0, 0, 0, time.UTC), time.Date(2024, 7, 29, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 5 {
+		t.Fatalf("expected 5 occurrences, got %d", len(events))
+	}
+
+	// Переносим одно повторение и удаляем другое
+	if code := post(updateEventHandler, "id=100&recurrence_id=2024-07-23T09:00:00Z&title=Moved&user_id=1&start_time=2024-07-23T11:00:00Z&end_time=2024-07-23T11:15:00Z").Code; code != http.StatusOK {
+		t.Fatalf("update occurrence: got %d", code)
+	}
+	if code := post(deleteEventHandler, "id=100&recurrence_id=2024-07-24T09:00:00Z").Code; code != http.StatusOK {
+		t.Fatalf("delete occurrence: got %d", code)
+	}
+	if code := post(deleteEventHandler, "id=100&recurrence_id=2024-07-24T10:00:00Z").Code; code != http.StatusNotFound {
+		t.Fatalf("delete missing occurrence: got %d want %d", code, http.StatusNotFound)
+	}
+
+	events, _ = eventsBetween(ctx, "1", time.Date(2024, 7, 22, 0, 0, 0, 0, time.UTC), time.Date(2024, 7, 29, 0, 0, 0, 0, time.UTC))
+	var titles []string
+	for _, e := range events {
+		titles = append(titles, e.StartTime.Format("02T15")+" "+e.Title)
+	}
+	want := "22T09 Standup,23T11 Moved,25T09 Standup,26T09 Standup"
+	if strings.Join(titles, ",") != want {
+		t.Errorf("got %v want %v", strings.Join(titles, ","), want)
+	}
+
+	// Изменение серии без exdate не возвращает перенесенное и удаленное
+	// повторения
+	if code := post(updateEventHandler, "id=100&title=Daily&user_id=1&start_time=2024-07-22T09:00:00Z&end_time=2024-07-22T09:15:00Z&rrule=FREQ%3DDAILY%3BCOUNT%3D5").Code; code != http.StatusOK {
+		t.Fatalf("update series: got %d", code)
+	}
+	events, _ = eventsBetween(ctx, "1", time.Date(2024, 7, 22, 0, 0, 0, 0, time.UTC), time.Date(2024, 7, 29, 0, 0, 0, 0, time.UTC))
+	titles = nil
+	for _, e := range events {
+		titles = append(titles, e.StartTime.Format("02T15")+" "+e.Title)
+	}
+	if want := "22T09 Daily,23T11 Moved,25T09 Daily,26T09 Daily"; strings.Join(titles, ",") != want {
+		t.Errorf("after series update got %v want %v", strings.Join(titles, ","), want)
+	}
+
+	// Неэкранированная ; в теле — ошибка, а не обрезанное правило
+	if code := post(updateEventHandler, "id=100&title=Daily&user_id=1&start_time=2024-07-22T09:00:00Z&end_time=2024-07-22T09:15:00Z&rrule=FREQ=DAILY;COUNT=5").Code; code != http.StatusBadRequest {
+		t.Errorf("malformed body: got %d want %d", code, http.StatusBadRequest)
+	}
+
+	// Удаление серии удаляет и отдельно измененные повторения
+	if code := post(deleteEventHandler, "id=100").Code; code != http.StatusOK {
+		t.Fatalf("delete series: got %d", code)
+	}
+	if all, _ := store.All(ctx); len(all) != 0 {
+		t.Errorf("expected empty store after deleting series, got %v", all)
+	}
+}
+
+func TestICalImportExport(t *testing.T) {
+	setup(t)
+
+	ics := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"BEGIN:VEVENT",
+		"UID:standup@example.com",
+		"DTSTART;TZID=Europe/Moscow:20240722T090000",
+		"DTEND;TZID=Europe/Moscow:20240722T091500",
+		"SUMMARY:Daily standup\\, team",
+		"  sync",
+		"RRULE:FREQ=DAILY;COUNT=3",
+		"BEGIN:VALARM",
+		"ACTION:DISPLAY",
+		"END:VALARM",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:standup@example.com",
+		"RECURRENCE-ID:20240723T060000Z",
+		"DTSTART:20240723T080000Z",
+		"DURATION:PT30M",
+		"SUMMARY:Moved standup",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:broken@example.com",
+		"SUMMARY:No start",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	req := httptest.NewRequest("POST", "/import_ics?user_id=1", strings.NewReader(ics))
+	req.Header.Set("Content-Type", "text/calendar")
+	rr := httptest.NewRecorder()
+	importICSHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("import: got status %d: %s", rr.Code, rr.Body.String())
+	}
+	expected := `{"result":"2 events imported","errors":["event 3 (UID \"broken@example.com\"): missing DTSTART"]}`
+	if rr.Body.String() != expected {
+		t.Errorf("import: got %s want %s", rr.Body.String(), expected)
+	}
+
+	events, _ := eventsBetween(context.Background(), "1", time.Date(2024, 7, 22, 0, 0, 0, 0, time.UTC), time.Date(2024, 7, 25, 0, 0, 0, 0, time.UTC))
+	var got []string
+	for _, e := range events {
+		got = append(got, e.StartTime.Format("02T15:04")+" "+e.Title)
+	}
+	want := "22T06:00 Daily standup, team sync,23T08:00 Moved standup,24T06:00 Daily standup, team sync"
+	if strings.Join(got, ",") != want {
+		t.Errorf("imported events: got %q want %q", strings.Join(got, ","), want)
+	}
+
+	rr = httptest.NewRecorder()
+	exportICSHandler(rr, httptest.NewRequest("GET", "/export_ics?user_id=1", nil))
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+		t.Errorf("export: unexpected content type %q", ct)
+	}
+	exported := rr.Body.String()
+	for _, line := range strings.Split(exported, "\r\n") {
+		if len(line) > icalLineLimit {
+			t.Errorf("export: line is not folded: %q", line)
+		}
+	}
+	for _, fragment := range []string{"SUMMARY:Daily standup\\, team sync", "RRULE:FREQ=DAILY;COUNT=3", "EXDATE:20240723T060000Z", "RECURRENCE-ID:20240723T060000Z", "DTSTART;TZID=Europe/Moscow:20240722T090000"} {
+		if !strings.Contains(exported, fragment) {
+			t.Errorf("export: missing %q in\n%s", fragment, exported)
+		}
+	}
+
+	long := "SUMMARY:" + strings.Repeat("Планирование ", 10)
+	folded := foldICalLine(long)
+	lines, _ := unfoldICalLines(strings.NewReader(folded))
+	if len(lines) != 1 || lines[0] != long {
+		t.Errorf("fold/unfold round trip failed: %q", folded)
+	}
+
+	// Серия в часовом поясе с переходом на летнее время сохраняет местное время
+	ics = strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"BEGIN:VEVENT",
+		"UID:weekly@example.com",
+		"DTSTART;TZID=Europe/Berlin:20240321T100000",
+		"DTEND;TZID=Europe/Berlin:20240321T110000",
+		"SUMMARY;X-NOTE=\"a;b:c\";LANGUAGE=de:Weekly",
+		"RRULE:FREQ=WEEKLY;COUNT=3",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+	req = httptest.NewRequest("POST", "/import_ics?user_id=2", strings.NewReader(ics))
+	rr = httptest.NewRecorder()
+	importICSHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("import DST series: got status %d: %s", rr.Code, rr.Body.String())
+	}
+	events, _ = eventsBetween(context.Background(), "2", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	got = nil
+	for _, e := range events {
+		got = append(got, e.StartTime.UTC().Format("01-02T15:04"))
+	}
+	if want := "03-21T09:00,03-28T09:00,04-04T08:00"; strings.Join(got, ",") != want {
+		t.Errorf("DST series: got %q want %q", strings.Join(got, ","), want)
+	}
+
+	rr = httptest.NewRecorder()
+	exportICSHandler(rr, httptest.NewRequest("GET", "/export_ics?user_id=2", nil))
+	if !strings.Contains(rr.Body.String(), "DTSTART;TZID=Europe/Berlin:20240321T100000") {
+		t.Errorf("export: missing TZID start in\n%s", rr.Body.String())
+	}
+
+	prop, err := parseICalProperty(`SUMMARY;X-NOTE="a;b:c";LANGUAGE=de:Weekly`)
+	if err != nil || prop.Params["X-NOTE"] != "a;b:c" || prop.Params["LANGUAGE"] != "de" || prop.Value != "Weekly" {
+		t.Errorf("quoted parameter: got %+v, %v", prop, err)
+	}
+
+	// Часовой пояс серии задается и формой
+	for form, code := range map[string]int{
+		"title=Sync&user_id=3&start_time=2024-03-28T09:00:00Z&end_time=2024-03-28T10:00:00Z&rrule=FREQ%3DWEEKLY%3BCOUNT%3D2&time_zone=Europe/Berlin": http.StatusCreated,
+		"title=Sync&user_id=3&start_time=2024-03-28T09:00:00Z&end_time=2024-03-28T10:00:00Z&time_zone=Mars/Base":                                     http.StatusBadRequest,
+	} {
+		if rr = post(createEventHandler, form); rr.Code != code {
+			t.Errorf("%s: got %d want %d", form, rr.Code, code)
+		}
+	}
+	events, _ = eventsBetween(context.Background(), "3", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	got = nil
+	for _, e := range events {
+		got = append(got, e.StartTime.UTC().Format("01-02T15:04"))
+	}
+	if want := "03-28T09:00,04-04T08:00"; strings.Join(got, ",") != want {
+		t.Errorf("form series in a time zone: got %q want %q", strings.Join(got, ","), want)
+	}
+}
+
+func TestIntervalIndex(t *testing.T) {
+	base := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	spans := map[string]Interval{}
+	var ix intervalIndex
+	// Бесконечные серии в начале не должны превращать запросы в перебор
+	for _, id := range []string{"open1", "open2"} {
+		spans[id] = Interval{Start: base.Add(-time.Hour), End: farFuture}
+		ix.insert(id, spans[id])
+	}
+	for i := 0; i < 200; i++ {
+		start := base.Add(time.Duration(i*37%500) * time.Hour)
+		span := Interval{Start: start, End: start.Add(time.Duration(1+i%48) * time.Hour)}
+		id := fmt.Sprintf("%d", i)
+		spans[id] = span
+		ix.insert(id, span)
+	}
+	for i := 0; i < 200; i += 3 {
+		id := fmt.Sprintf("%d", i)
+		ix.remove(id, spans[id])
+		delete(spans, id)
+	}
+	ix.remove("open1", spans["open1"])
+	delete(spans, "open1")
+	if last := ix.maxEnd[len(ix.maxEnd)-1]; last.Equal(farFuture) {
+		t.Errorf("open-ended series leaked into maxEnd")
+	}
+
+	for h := 0; h < 520; h += 7 {
+		query := Interval{Start: base.Add(time.Duration(h) * time.Hour), End: base.Add(time.Duration(h+5) * time.Hour)}
+		got := map[string]bool{}
+		for _, id := range ix.query(query.Start, query.End) {
+			got[id] = true
+		}
+		for id, span := range spans {
+			if span.overlaps(query) != got[id] {
+				t.Fatalf("query %v: event %s %v: index=%v", query, id, span, got[id])
+			}
+		}
+	}
+}
+
+func TestRejectOverlapAndFreeBusy(t *testing.T) {
+	setup(t)
+
+	addEvent(t, Event{ID: "meeting", Title: "Meeting", UserID: "1",
+		StartTime: time.Date(2024, 7, 25, 10, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2024, 7, 25, 11, 0, 0, 0, time.UTC)})
+	addEvent(t, Event{ID: "lunch", Title: "Lunch", UserID: "2",
+		StartTime: time.Date(2024, 7, 22, 12, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2024, 7, 22, 13, 0, 0, 0, time.UTC),
+		RRule:     "FREQ=DAILY"})
+
+	create := func(form string) *httptest.ResponseRecorder {
+		return post(createEventHandler, form)
+	}
+
+	rr := create("title=Overlap&user_id=1&start_time=2024-07-25T10:30:00Z&end_time=2024-07-25T11:30:00Z&reject_overlap=true")
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("got status %d want %d", rr.Code, http.StatusConflict)
+	}
+	expected := `{"error":"event overlaps existing events","conflicts":["meeting"]}`
+	if rr.Body.String() != expected {
+		t.Errorf("got %s want %s", rr.Body.String(), expected)
+	}
+
+	rr = create("title=Recurring&user_id=2&start_time=2024-07-30T12:30:00Z&end_time=2024-07-30T12:45:00Z&rrule=FREQ%3DWEEKLY&reject_overlap=true")
+	if rr.Code != http.StatusConflict {
+		t.Errorf("recurring overlap: got status %d want %d", rr.Code, http.StatusConflict)
+	}
+
+	if rr = create("title=Adjacent&user_id=1&start_time=2024-07-25T11:00:00Z&end_time=2024-07-25T12:00:00Z&reject_overlap=true"); rr.Code != http.StatusCreated {
+		t.Errorf("adjacent event: got status %d want %d", rr.Code, http.StatusCreated)
+	}
+	if rr = create("title=Overlap&user_id=1&start_time=2024-07-25T10:30:00Z&end_time=2024-07-25T11:30:00Z"); rr.Code != http.StatusCreated {
+		t.Errorf("overlap without reject mode: got status %d want %d", rr.Code, http.StatusCreated)
+	}
+
+	rr = httptest.NewRecorder()
+	freeBusyHandler(rr, httptest.NewRequest("GET", "/free_busy?user_ids=1,2&from=2024-07-25T09:00:00Z&to=2024-07-25T15:00:00Z&min_duration=45m", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("free_busy: got status %d: %s", rr.Code, rr.Body.String())
+	}
+	expected = `{"busy":[{"start":"2024-07-25T10:00:00Z","end":"2024-07-25T13:00:00Z"}],` +
+		`"free":[{"start":"2024-07-25T09:00:00Z","end":"2024-07-25T10:00:00Z"},{"start":"2024-07-25T13:00:00Z","end":"2024-07-25T15:00:00Z"}]}`
+	if rr.Body.String() != expected {
+		t.Errorf("free_busy: got %s want %s", rr.Body.String(), expected)
+	}
+}
+
+func TestTimeZoneWindows(t *testing.T) {
+	setup(t)
+
+	addEvent(t, Event{ID: "night", Title: "Night call", UserID: "1",
+		StartTime: time.Date(2024, 7, 24, 22, 30, 0, 0, time.UTC),
+		EndTime:   time.Date(2024, 7, 24, 23, 0, 0, 0, time.UTC)})
+	addEvent(t, Event{ID: "dst", Title: "After DST day", UserID: "2",
+		StartTime: time.Date(2024, 3, 31, 22, 30, 0, 0, time.UTC),
+		EndTime:   time.Date(2024, 3, 31, 23, 0, 0, 0, time.UTC)})
+
+	get := func(handler http.HandlerFunc, query string) string {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/?"+query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", query, rr.Code, rr.Body.String())
+		}
+		return rr.Body.String()
+	}
+
+	// В UTC событие относится к 24 июля, в Москве — к 25 июля
+	if body := get(eventsForDayHandler, "user_id=1&date=2024-07-25"); body != "null" {
+		t.Errorf("UTC day: expected no events, got %s", body)
+	}
+	body := get(eventsForDayHandler, "user_id=1&date=2024-07-25&tz=Europe/Moscow")
+	if !strings.Contains(body, `"start_time":"2024-07-25T01:30:00+03:00"`) {
+		t.Errorf("Moscow day: expected event rendered in +03:00, got %s", body)
+	}
+
+	// Часовой пояс пользователя по умолчанию
+	rr := post(userSettingsHandler, "user_id=1&tz=Europe/Moscow")
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"tz":"Europe/Moscow"}` {
+		t.Fatalf("user_settings: got %d %s", rr.Code, rr.Body.String())
+	}
+	if body := get(eventsForDayHandler, "user_id=1&date=2024-07-25"); !strings.Contains(body, `"id":"night"`) {
+		t.Errorf("default tz: expected event, got %s", body)
+	}
+
+	// Неделя ISO начинается с понедельника: воскресенье 28 июля входит в неделю 22–28 июля
+	if body := get(eventsForWeekHandler, "user_id=1&date=2024-07-28"); !strings.Contains(body, `"id":"night"`) {
+		t.Errorf("ISO week: expected event, got %s", body)
+	}
+	if body := get(eventsForMonthHandler, "user_id=1&date=2024-07-01&tz=UTC"); !strings.Contains(body, `"id":"night"`) {
+		t.Errorf("month: expected event, got %s", body)
+	}
+
+	// 31 марта в Берлине длится 23 часа, 00:30 1 апреля уже не входит в этот день
+	if body := get(eventsForDayHandler, "user_id=2&date=2024-03-31&tz=Europe/Berlin"); body != "null" {
+		t.Errorf("DST day: expected no events, got %s", body)
+	}
+	if body := get(eventsForDayHandler, "user_id=2&date=2024-04-01&tz=Europe/Berlin"); !strings.Contains(body, `"start_time":"2024-04-01T00:30:00+02:00"`) {
+		t.Errorf("DST next day: expected event, got %s", body)
+	}
+
+	rr = httptest.NewRecorder()
+	eventsForDayHandler(rr, httptest.NewRequest("GET", "/?user_id=1&date=2024-07-25&tz=Mars/Olympus", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid tz: got status %d want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	// Настройки, которые не удалось записать, не меняются и в памяти
+	broken, err := openSettingsStore(t.TempDir() + "/missing/user_settings.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broken.Update("1", func(us *UserSettings) { us.TimeZone = "Europe/Moscow" }); err == nil {
+		t.Fatal("expected write error")
+	}
+	if got := broken.Get("1"); got.TimeZone != "" {
+		t.Errorf("failed update must not change settings: got %+v", got)
+	}
+}
+
+func TestAPIV2(t *testing.T) {
+	setup(t)
+
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rr := httptest.NewRecorder()
+		apiV2Handler(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/v2/users/1/events", `{"title":"Review","start_time":"2024-07-25T15:00:00Z","end_time":"2024-07-25T16:00:00Z"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: got %d: %s", rr.Code, rr.Body.String())
+	}
+	location := rr.Header().Get("Location")
+	etag := rr.Header().Get("ETag")
+	if !strings.HasPrefix(location, "/v2/users/1/events/") || etag == "" {
+		t.Fatalf("create: missing Location or ETag: %q %q", location, etag)
+	}
+
+	if rr = do("GET", location, ""); rr.Code != http.StatusOK || rr.Header().Get("ETag") != etag {
+		t.Errorf("get: got %d etag %q", rr.Code, rr.Header().Get("ETag"))
+	}
+	if rr = do("GET", strings.Replace(location, "/users/1/", "/users/2/", 1), ""); rr.Code != http.StatusNotFound {
+		t.Errorf("get foreign event: got %d want %d", rr.Code, http.StatusNotFound)
+	}
+
+	if rr = do("PATCH", location, `{"title":"Stale"}`, "If-Match", `"stale"`); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("patch with stale etag: got %d want %d", rr.Code, http.StatusPreconditionFailed)
+	}
+	rr = do("PATCH", location, `{"title":"Design review"}`, "If-Match", etag)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"title":"Design review","user_id":"1","start_time":"2024-07-25T15:00:00Z"`) {
+		t.Errorf("patch: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("ETag") == etag {
+		t.Errorf("patch: ETag must change after update")
+	}
+
+	if rr = do("PUT", location, `{"title":"No times"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("put without times: got %d want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if rr = do("PUT", location, `{"title":"x","unknown":1}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("put with unknown field: got %d want %d", rr.Code, http.StatusBadRequest)
+	}
+	if rr.Body.String() != `{"error":"invalid request body: json: unknown field \"unknown\""}` {
+		t.Errorf("error body is not encoded JSON: %s", rr.Body.String())
+	}
+	if rr = do("POST", location, `{}`); rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") == "" {
+		t.Errorf("post to item: got %d allow %q", rr.Code, rr.Header().Get("Allow"))
+	}
+
+	rr = do("POST", "/v2/users/1/events?reject_overlap=true", `{"title":"Clash","start_time":"2024-07-25T15:30:00Z","end_time":"2024-07-25T16:30:00Z"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("overlapping create: got %d want %d", rr.Code, http.StatusConflict)
+	}
+
+	rr = do("GET", "/v2/users/1/events?from=2024-07-25T00:00:00Z&to=2024-07-26T00:00:00Z", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Design review") {
+		t.Errorf("list range: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr = do("GET", "/v2/users/1/events?from=2024-07-25T00:00:00Z", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("list with half range: got %d want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	if rr = do("DELETE", location, ""); rr.Code != http.StatusNoContent {
+		t.Errorf("delete: got %d want %d", rr.Code, http.StatusNoContent)
+	}
+	if rr = do("DELETE", location, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("repeated delete: got %d want %d", rr.Code, http.StatusNotFound)
+	}
+	if rr = do("GET", "/v2/users/1/events", ""); rr.Body.String() != "[]" {
+		t.Errorf("list after delete: got %s", rr.Body.String())
+	}
+	if rr = do("GET", "/v2/users/1/calendars", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown resource: got %d want %d", rr.Code, http.StatusNotFound)
+	}
+
+	// PUT серии не возвращает перенесенные и удаленные повторения
+	rr = do("POST", "/v2/users/1/events", `{"title":"Standup","start_time":"2024-07-22T09:00:00Z","end_time":"2024-07-22T09:15:00Z","rrule":"FREQ=DAILY;COUNT=4"}`)
+	location = rr.Header().Get("Location")
+	seriesID := strings.TrimPrefix(location, "/v2/users/1/events/")
+	for _, form := range []string{
+		"id=" + seriesID + "&recurrence_id=2024-07-23T09:00:00Z&title=Moved&user_id=1&start_time=2024-07-23T11:00:00Z&end_time=2024-07-23T11:15:00Z",
+		"id=" + seriesID + "&recurrence_id=2024-07-24T09:00:00Z",
+	} {
+		handler := deleteEventHandler
+		if strings.Contains(form, "title=") {
+			handler = updateEventHandler
+		}
+		rr = post(handler, form)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", form, rr.Code, rr.Body.String())
+		}
+	}
+	if rr = do("PUT", location, `{"title":"Daily","start_time":"2024-07-22T09:00:00Z","end_time":"2024-07-22T09:15:00Z","rrule":"FREQ=DAILY;COUNT=4"}`); rr.Code != http.StatusOK {
+		t.Fatalf("put series: got %d: %s", rr.Code, rr.Body.String())
+	}
+	events, _ := eventsBetween(context.Background(), "1", time.Date(2024, 7, 22, 0, 0, 0, 0, time.UTC), time.Date(2024, 7, 29, 0, 0, 0, 0, time.UTC))
+	var got []string
+	for _, e := range events {
+		got = append(got, e.StartTime.Format("02T15")+" "+e.Title)
+	}
+	if want := "22T09 Daily,23T11 Moved,25T09 Daily"; strings.Join(got, ",") != want {
+		t.Errorf("series after put: got %q want %q", strings.Join(got, ","), want)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	setup(t)
+	defer func(cost int) { passwordCost = cost }(passwordCost)
+	passwordCost = bcrypt.MinCost
+
+	hash1, _ := hashPassword("secret1")
+	hash2, _ := hashPassword("secret2")
+	registry := fmt.Sprintf(`[{"user_id":"1","password_hash":%q},{"user_id":"2","password_hash":%q}]`, hash1, hash2)
+	path := t.TempDir() + "/users.json"
+	if err := os.WriteFile(path, []byte(registry), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	if _, err = loadAuthenticator(path, []byte("short"), time.Hour); err == nil {
+		t.Error("expected error for short secret")
+	}
+	auth, err = loadAuthenticator(path, []byte(strings.Repeat("k", minSecretLen)), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := authMiddleware(auth, newMux())
+
+	do := func(method, target, token, form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(userID, password string) string {
+		rr := do("POST", "/login", "", "user_id="+userID+"&password="+password)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("login %s: got %d", userID, rr.Code)
+		}
+		var response LoginResponse
+		fromJSON(rr.Body.Bytes(), &response)
+		return response.Token
+	}
+
+	if rr := do("POST", "/login", "", "user_id=1&password=wrong"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("login with wrong password: got %d", rr.Code)
+	}
+	if rr := do("POST", "/login", "", "user_id=9&password=secret1"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("login of unknown user: got %d", rr.Code)
+	}
+	if !strings.HasPrefix(hash1, "$2a$") || checkPassword(dummyPasswordHash(), "secret1") {
+		t.Errorf("expected bcrypt hashes, got %q", hash1)
+	}
+	token1, token2 := login("1", "secret1"), login("2", "secret2")
+
+	fields := "title=Private&start_time=2024-07-25T15:00:00Z&end_time=2024-07-25T16:00:00Z"
+	if rr := do("POST", "/create_event", "", fields); rr.Code != http.StatusUnauthorized {
+		t.Errorf("create without token: got %d", rr.Code)
+	}
+	if rr := do("POST", "/create_event", token1[:len(token1)-2]+"xx", fields); rr.Code != http.StatusUnauthorized {
+		t.Errorf("create with forged token: got %d", rr.Code)
+	}
+	if rr := do("POST", "/create_event", token1, fields+"&user_id=2"); rr.Code != http.StatusForbidden {
+		t.Errorf("create for another user: got %d", rr.Code)
+	}
+	if rr := do("POST", "/create_event", token1, fields); rr.Code != http.StatusCreated {
+		t.Fatalf("create: got %d", rr.Code)
+	}
+
+	events, _ := store.ListByUser(context.Background(), "1")
+	if len(events) != 1 {
+		t.Fatalf("expected event owned by token user, got %v", events)
+	}
+	id := events[0].ID
+
+	if rr := do("POST", "/delete_event", token2, "id="+id); rr.Code != http.StatusForbidden {
+		t.Errorf("delete foreign event: got %d", rr.Code)
+	}
+	if rr := do("POST", "/update_event", token2, "id="+id+"&"+fields); rr.Code != http.StatusForbidden {
+		t.Errorf("update foreign event: got %d", rr.Code)
+	}
+	if rr := do("GET", "/events_for_day?user_id=1&date=2024-07-25", token2, ""); rr.Body.String() != "null" {
+		t.Errorf("foreign calendar must hide unshared events, got %s", rr.Body.String())
+	}
+	if rr := do("GET", "/v2/users/1/events/"+id, token2, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("v2 get unshared event: got %d", rr.Code)
+	}
+
+	if rr := do("POST", "/invite_attendee", token2, "id="+id+"&attendee=2"); rr.Code != http.StatusForbidden {
+		t.Errorf("invite by non-owner: got %d", rr.Code)
+	}
+	if rr := do("POST", "/invite_attendee", token1, "id="+id+"&attendee=2"); rr.Code != http.StatusOK {
+		t.Fatalf("invite: got %d", rr.Code)
+	}
+	if rr := do("GET", "/events_for_day?user_id=1&date=2024-07-25", token2, ""); !strings.Contains(rr.Body.String(), id) {
+		t.Errorf("shared event must be visible, got %s", rr.Body.String())
+	}
+	if rr := do("POST", "/update_event", token2, "id="+id+"&"+fields); rr.Code != http.StatusForbidden {
+		t.Errorf("viewer must not modify event: got %d", rr.Code)
+	}
+	if rr := do("PATCH", "/v2/users/1/events/"+id, token2, `{"title":"Hijack"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("v2 patch foreign event: got %d", rr.Code)
+	}
+
+	// Просроченный токен отвергается
+	auth.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if rr := do("GET", "/events_for_day?date=2024-07-25", token1, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expired token: got %d", rr.Code)
+	}
+}
+
+func TestAttendees(t *testing.T) {
+	setup(t)
+
+	addEvent(t, Event{ID: "100", Title: "Standup", UserID: "1",
+		StartTime: time.Date(2024, 7, 22, 9, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2024, 7, 22, 9, 15, 0, 0, time.UTC),
+		RRule:     "FREQ=DAILY"})
+	if err := updateOccurrence(context.Background(), "100", time.Date(2024, 7, 24, 9, 0, 0, 0, time.UTC), Event{
+		ID: "101", Title: "Late standup", UserID: "1",
+		StartTime: time.Date(2024, 7, 24, 10, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2024, 7, 24, 10, 15, 0, 0, time.UTC)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := post(inviteAttendeeHandler, "id=100&attendee=2&user_id=2"); rr.Code != http.StatusForbidden {
+		t.Errorf("invite by non-owner: got %d", rr.Code)
+	}
+	if rr := post(inviteAttendeeHandler, "id=100&attendee=1&user_id=1"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invite owner: got %d", rr.Code)
+	}
+	if rr := post(inviteAttendeeHandler, "id=100&attendee=2&role=admin&user_id=1"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid role: got %d", rr.Code)
+	}
+	if rr := post(inviteAttendeeHandler, "id=101&attendee=2&role=editor&user_id=1"); rr.Code != http.StatusOK {
+		t.Fatalf("invite through occurrence: got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Приглашение применяется к серии и ее измененным повторениям
+	for _, id := range []string{"100", "101"} {
+		event, _ := store.Get(context.Background(), id)
+		if len(event.Attendees) != 1 || event.Attendees[0] != (Attendee{UserID: "2", Role: roleEditor, RSVP: rsvpNeedsAction}) {
+			t.Errorf("%s: unexpected attendees %+v", id, event.Attendees)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	eventsForDayHandler(rr, httptest.NewRequest("GET", "/events_for_day?user_id=2&date=2024-07-24", nil))
+	if !strings.Contains(rr.Body.String(), `"title":"Late standup"`) {
+		t.Errorf("attendee calendar must contain the event, got %s", rr.Body.String())
+	}
+
+	if rr := post(respondInviteHandler, "id=100&attendee=3&rsvp=accepted"); rr.Code != http.StatusNotFound {
+		t.Errorf("response by non-attendee: got %d", rr.Code)
+	}
+	if rr := post(respondInviteHandler, "id=100&attendee=2&rsvp=maybe"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid rsvp: got %d", rr.Code)
+	}
+	if rr := post(respondInviteHandler, "id=100&attendee=2&rsvp=declined"); rr.Code != http.StatusOK {
+		t.Fatalf("respond: got %d", rr.Code)
+	}
+
+	// Отклоненное приглашение не занимает время участника
+	busy, err := busyIntervals(context.Background(), []string{"2"},
+		time.Date(2024, 7, 22, 0, 0, 0, 0, time.UTC), time.Date(2024, 7, 23, 0, 0, 0, 0, time.UTC))
+	if err != nil || len(busy) != 0 {
+		t.Errorf("declined event must not be busy: %v %v", busy, err)
+	}
+
+	// Редактор может изменить событие, но не удалить его
+	editor := withUser(context.Background(), "2")
+	event, _ := store.Get(context.Background(), "100")
+	if !canModify(editor, event) || canDelete(editor, event) || !canRead(withUser(context.Background(), "2"), event) {
+		t.Error("unexpected editor permissions")
+	}
+	if canRead(withUser(context.Background(), "3"), event) {
+		t.Error("non-attendee must not read the event")
+	}
+
+	if rr := post(removeAttendeeHandler, "id=100&attendee=2&user_id=1"); rr.Code != http.StatusOK {
+		t.Fatalf("remove: got %d", rr.Code)
+	}
+	if rr := post(removeAttendeeHandler, "id=100&attendee=2&user_id=1"); rr.Code != http.StatusNotFound {
+		t.Errorf("remove twice: got %d", rr.Code)
+	}
+	if events, _ := store.ListByUser(context.Background(), "2"); len(events) != 0 {
+		t.Errorf("removed attendee still indexed: %+v", events)
+	}
+}
+
+// chanNotifier передает напоминания в канал; с block ждет отмены контекста
+type chanNotifier struct {
+	ch    chan Notification
+	block bool
+}
+
+func (n chanNotifier) Notify(ctx context.Context, notification Notification) error {
+	if n.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	n.ch <- notification
+	return nil
+}
+
+func TestReminders(t *testing.T) {
+	setup(t)
+
+	base := time.Date(2024, 7, 22, 8, 0, 0, 0, time.UTC)
+	daily := Event{ID: "standup", Title: "Standup", UserID: "1",
+		StartTime: time.Date(2024, 7, 22, 9, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2024, 7, 22, 9, 15, 0, 0, time.UTC),
+		RRule:     "FREQ=DAILY",
+		Reminders: []Duration{Duration(10 * time.Minute), Duration(time.Hour)},
+		Attendees: []Attendee{{UserID: "2", Role: roleViewer, RSVP: rsvpDeclined}, {UserID: "3", Role: roleViewer, RSVP: rsvpAccepted}}}
+
+	item, ok := nextReminder(daily, base)
+	if !ok || !item.fireAt.Equal(base.Add(50*time.Minute)) || item.offset != Duration(10*time.Minute) {
+		t.Fatalf("unexpected next reminder %+v", item)
+	}
+	if item, _ = nextReminder(daily, item.fireAt); !item.fireAt.Equal(base.Add(24 * time.Hour)) {
+		t.Errorf("expected the next day's 1h reminder, got %v", item.fireAt)
+	}
+	if n := item.notification(); fmt.Sprint(n.Recipients) != "[1 3]" {
+		t.Errorf("declined attendee must not be notified: %v", n.Recipients)
+	}
+
+	var mu sync.Mutex
+	clock := base
+	now := func() time.Time { mu.Lock(); defer mu.Unlock(); return clock }
+	advance := func(s *reminderScheduler, d time.Duration) {
+		mu.Lock()
+		clock = clock.Add(d)
+		mu.Unlock()
+		wakeUp(s.wake)
+	}
+
+	path := t.TempDir() + "/reminders.json"
+	notifications := make(chan Notification, 10)
+	inner := newMemoryStore()
+	scheduler := newReminderScheduler(inner, chanNotifier{ch: notifications}, path)
+	scheduler.now = now
+	store = observeStore(inner, scheduler.onChange)
+	if err := scheduler.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	addEvent(t, daily)
+	advance(scheduler, 5*time.Minute) // только что созданное событие не срабатывает раньше времени
+	advance(scheduler, 50*time.Minute)
+	select {
+	case n := <-notifications:
+		if n.EventID != "standup" || !n.StartTime.Equal(daily.StartTime) || n.Offset != Duration(10*time.Minute) {
+			t.Errorf("unexpected notification %+v", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reminder did not fire")
+	}
+
+	// Событие без напоминаний снимается с планирования
+	daily.Reminders = nil
+	if err := store.Update(context.Background(), daily); err != nil {
+		t.Fatal(err)
+	}
+	advance(scheduler, 24*time.Hour)
+	select {
+	case n := <-notifications:
+		t.Errorf("unexpected notification after update %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := scheduler.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Недоставленное при остановке напоминание сохраняется и доставляется
+	// после перезапуска
+	daily.Reminders = []Duration{0}
+	inner = newMemoryStore()
+	scheduler = newReminderScheduler(inner, chanNotifier{block: true}, path)
+	scheduler.now = now
+	store = observeStore(inner, scheduler.onChange)
+	if err := scheduler.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	addEvent(t, daily)
+	advance(scheduler, 10*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := scheduler.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler = newReminderScheduler(inner, chanNotifier{ch: notifications}, path)
+	scheduler.now = now
+	if err := scheduler.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-notifications:
+		if !n.StartTime.Equal(time.Date(2024, 7, 23, 9, 0, 0, 0, time.UTC)) {
+			t.Errorf("unexpected restored notification %+v", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pending reminder was lost")
+	}
+	if err := scheduler.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Событие за горизонтом планируется при ежедневной перепроверке, а
+	// watermark сохраняется после срабатывания без остановки планировщика
+	eventually := func(cond func() bool) bool {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if cond() {
+				return true
+			}
+		}
+		return false
+	}
+	farPath := t.TempDir() + "/reminders.json"
+	far := newMemoryStore()
+	notifications = make(chan Notification, 10)
+	scheduler = newReminderScheduler(far, chanNotifier{ch: notifications}, farPath)
+	scheduler.now = now
+	store = observeStore(far, scheduler.onChange)
+	if err := scheduler.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer scheduler.Shutdown(context.Background())
+	start := now().Add(500 * 24 * time.Hour)
+	addEvent(t, Event{ID: "far", Title: "Far", UserID: "1", StartTime: start, EndTime: start.Add(time.Hour),
+		Reminders: []Duration{Duration(time.Hour)}})
+	scheduled := func() bool {
+		scheduler.mu.Lock()
+		defer scheduler.mu.Unlock()
+		return scheduler.scheduled["far"] != nil
+	}
+	if scheduled() {
+		t.Fatal("reminder beyond the horizon must not be scheduled yet")
+	}
+	advance(scheduler, 200*24*time.Hour)
+	if !eventually(scheduled) {
+		t.Fatal("rescan did not schedule the reminder")
+	}
+	advance(scheduler, 300*24*time.Hour)
+	select {
+	case n := <-notifications:
+		if n.EventID != "far" {
+			t.Errorf("unexpected notification %+v", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("rescanned reminder did not fire")
+	}
+	if !eventually(func() bool {
+		data, err := os.ReadFile(farPath)
+		var state reminderState
+		return err == nil && fromJSON(data, &state) == nil && !state.Watermark.Before(start.Add(-time.Hour))
+	}) {
+		t.Error("watermark was not saved after firing")
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts++; attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	notifier := newWebhookNotifier(server.URL)
+	notifier.backoff = time.Millisecond
+	if err := notifier.Notify(context.Background(), Notification{EventID: "1"}); err != nil || attempts != 3 {
+		t.Errorf("expected delivery on third attempt, got %v after %d attempts", err, attempts)
+	}
+
+	notifier.retries = 1
+	attempts = 0
+	if err := notifier.Notify(context.Background(), Notification{EventID: "1"}); err == nil {
+		t.Error("expected error after exhausting retries")
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	setup(t)
+	defer ready.Store(false)
+
+	handler := readinessMiddleware(newMux())
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		return rr
+	}
+
+	ready.Store(false)
+	if rr := get("/healthz"); rr.Code != http.StatusOK || rr.Body.String() != `{"status":"ok"}` {
+		t.Errorf("healthz: got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get("/readyz"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz before load: got %d", rr.Code)
+	}
+	if rr := get("/events_for_day?user_id=1&date=2024-07-25"); rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("API before load: got %d", rr.Code)
+	}
+
+	ready.Store(true)
+	if rr := get("/readyz"); rr.Code != http.StatusOK {
+		t.Errorf("readyz after load: got %d", rr.Code)
+	}
+	if rr := get("/events_for_day?user_id=1&date=2024-07-25"); rr.Code != http.StatusOK {
+		t.Errorf("API after load: got %d", rr.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	setup(t)
+	metrics = newHTTPMetrics()
+
+	addEvent(t, Event{ID: "1", Title: "A", UserID: "alice",
+		StartTime: time.Date(2024, 7, 25, 10, 0, 0, 0, time.UTC), EndTime: time.Date(2024, 7, 25, 11, 0, 0, 0, time.UTC)})
+	addEvent(t, Event{ID: "2", Title: "B", UserID: "alice",
+		StartTime: time.Date(2024, 7, 26, 10, 0, 0, 0, time.UTC), EndTime: time.Date(2024, 7, 26, 11, 0, 0, 0, time.UTC)})
+
+	mux := newMux()
+	handler := metricsMiddleware(mux, mux)
+	for _, target := range []string{"/events_for_day?user_id=alice&date=2024-07-25", "/events_for_day", "/v2/users/alice/events/1", "/nowhere"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	addEvent(t, Event{ID: "3", Title: "C", UserID: "bob",
+		StartTime: time.Date(2024, 7, 26, 10, 0, 0, 0, time.UTC), EndTime: time.Date(2024, 7, 26, 11, 0, 0, 0, time.UTC)})
+
+	rr := httptest.NewRecorder()
+	newMetricsMux().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	for _, line := range []string{
+		`calendar_http_requests_total{route="/events_for_day",method="GET",code="200"} 1`,
+		`calendar_http_requests_total{route="/events_for_day",method="GET",code="400"} 1`,
+		`calendar_http_requests_total{route="/v2/users/",method="GET",code="200"} 1`,
+		`calendar_http_requests_total{route="other",method="GET",code="404"} 1`,
+		`calendar_http_request_duration_seconds_bucket{route="/events_for_day",le="+Inf"} 2`,
+		`calendar_http_request_duration_seconds_count{route="/events_for_day"} 2`,
+		`calendar_http_requests_in_flight 0`,
+		`calendar_events_total 3`,
+		`calendar_user_events_bucket{le="1"} 1`,
+		`calendar_user_events_bucket{le="10"} 2`,
+		`calendar_user_events_bucket{le="+Inf"} 2`,
+		`calendar_user_events_count 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics output is missing %q:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "alice") {
+		t.Errorf("metrics must not be labelled by user:\n%s", body)
+	}
+
+	// /metrics доступен только на отдельном адресе
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("/metrics must not be served with the API, got %d", rr.Code)
+	}
+}
+
+func TestAccessLogging(t *testing.T) {
+	setup(t)
+
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(previous)
+
+	handler := loggingMiddleware(newMux())
+	req := formRequest("/create_event", "title=&user_id=1")
+	req.Header.Set(requestIDHeader, "req-42")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Header().Get(requestIDHeader) != "req-42" {
+		t.Errorf("request ID must be propagated, got %q", rr.Header().Get(requestIDHeader))
+	}
+
+	var records []map[string]any
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var record map[string]any
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected validation and access records, got %v", records)
+	}
+	if records[0]["msg"] != "invalid event" || records[0]["request_id"] != "req-42" || records[0]["error"] != "missing required fields" {
+		t.Errorf("unexpected validation record %v", records[0])
+	}
+	access := records[1]
+	if access["msg"] != "request" || access["request_id"] != "req-42" || access["status"] != float64(http.StatusBadRequest) ||
+		access["bytes"] != float64(rr.Body.Len()) || access["method"] != "POST" || access["path"] != "/create_event" {
+		t.Errorf("unexpected access record %v", access)
+	}
+
+	// Недопустимый ID клиента заменяется сгенерированным, строка запроса в
+	// журнал не попадает
+	buf.Reset()
+	req = httptest.NewRequest("GET", "/healthz?user_id=1&password=secret1", nil)
+	req.Header.Set(requestIDHeader, "bad id\n")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if id := rr.Header().Get(requestIDHeader); len(id) != 32 {
+		t.Errorf("expected generated request ID, got %q", id)
+	}
+	if strings.Contains(buf.String(), "secret1") {
+		t.Errorf("query string must not be logged: %s", buf.String())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	setup(t)
+
+	if _, err := parseRateLimits("default=0:1"); err == nil {
+		t.Error("expected error for zero rate")
+	}
+	quotas, err := parseRateLimits("default=10:20, /create_event=1:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := newRateLimiter(quotas)
+	clock := time.Date(2024, 7, 25, 10, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return clock }
+
+	mux := newMux()
+	handler := bodyLimitMiddleware(64, rateLimitMiddleware(limiter, mux, mux))
+	send := func(target, form, remote string) *httptest.ResponseRecorder {
+		req := formRequest(target, form)
+		req.RemoteAddr = remote
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	form := "title=T&user_id=1&start_time=2024-07-25T15:00:00Z&end_time=2024-07-25T16:00:00Z"
+	if rr := send("/create_event", form, "10.0.0.1:1234"); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: got %d", rr.Code)
+	}
+
+	form = "title=T&user_id=1"
+	for i := 0; i < 2; i++ {
+		if rr := send("/create_event", form, "10.0.0.1:1234"); rr.Code != http.StatusBadRequest {
+			t.Errorf("request %d within burst: got %d", i, rr.Code)
+		}
+	}
+	rr := send("/create_event", form, "10.0.0.1:5678")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("burst exhausted: got %d, Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if rr := send("/create_event", form, "10.0.0.2:1234"); rr.Code == http.StatusTooManyRequests {
+		t.Error("other clients must have their own bucket")
+	}
+	if rr := send("/delete_event", "", "10.0.0.1:1234"); rr.Code == http.StatusTooManyRequests {
+		t.Error("other routes must use their own quota")
+	}
+	clock = clock.Add(time.Second)
+	if rr := send("/create_event", form, "10.0.0.1:1234"); rr.Code == http.StatusTooManyRequests {
+		t.Error("bucket must refill over time")
+	}
+
+	// Лимит событий на пользователя
+	store = limitStore(newMemoryStore(), 2)
+	for i := 0; i < 3; i++ {
+		rr := post(createEventHandler, "title=T&user_id=1&start_time=2024-07-25T15:00:00Z&end_time=2024-07-25T16:00:00Z")
+		if want := map[bool]int{true: http.StatusCreated, false: http.StatusForbidden}[i < 2]; rr.Code != want {
+			t.Errorf("create %d: got %d want %d", i, rr.Code, want)
+		}
+	}
+
+	// Смена владельца проверяется по лимиту нового владельца
+	ctx := context.Background()
+	start := time.Date(2024, 7, 26, 15, 0, 0, 0, time.UTC)
+	moved := Event{ID: "moved", Title: "T", UserID: "2", StartTime: start, EndTime: start.Add(time.Hour)}
+	addEvent(t, moved)
+	moved.UserID = "1"
+	if err := store.Update(ctx, moved); !errors.Is(err, ErrEventLimit) {
+		t.Errorf("update to a full owner: got %v", err)
+	}
+	if err := store.Apply(ctx, []storeOp{{Op: changeUpdate, Event: moved}}); !errors.Is(err, ErrEventLimit) {
+		t.Errorf("batch update to a full owner: got %v", err)
+	}
+	moved.Title = "T2"
+	moved.UserID = "2"
+	if err := store.Update(ctx, moved); err != nil {
+		t.Errorf("update without owner change: %v", err)
+	}
+	owned, _ := store.ListByUser(ctx, "1")
+	if err := store.Apply(ctx, []storeOp{{Op: changeDelete, ID: owned[0].ID}, {Op: changeUpdate, Event: Event{
+		ID: "moved", Title: "T", UserID: "1", StartTime: start, EndTime: start.Add(time.Hour)}}}); err != nil {
+		t.Errorf("batch that frees a slot first: %v", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	setup(t)
+
+	day := func(d, h int) time.Time { return time.Date(2024, 7, d, h, 0, 0, 0, time.UTC) }
+	addEvent(t, Event{ID: "a", Title: "Team meeting", UserID: "1", StartTime: day(22, 10), EndTime: day(22, 11)})
+	addEvent(t, Event{ID: "b", Title: "Planning: team sync", UserID: "1", StartTime: day(23, 10), EndTime: day(23, 13)})
+	addEvent(t, Event{ID: "c", Title: "Team lunch", UserID: "2", StartTime: day(24, 12), EndTime: day(24, 13),
+		Attendees: []Attendee{{UserID: "1", Role: roleViewer, RSVP: rsvpAccepted}}})
+	addEvent(t, Event{ID: "d", Title: "Retro", UserID: "1", StartTime: day(1, 9), EndTime: day(1, 10), RRule: "FREQ=WEEKLY"})
+
+	// Индекс слов обновляется при изменении названия
+	if err := store.Update(context.Background(), Event{ID: "a", Title: "Team standup", UserID: "1", StartTime: day(22, 10), EndTime: day(22, 11)}); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := store.SearchTitle(context.Background(), []string{"meeting"}); len(events) != 0 {
+		t.Errorf("stale token must be removed from the index: %v", events)
+	}
+
+	search := func(query string) SearchResponse {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		searchHandler(rr, httptest.NewRequest("GET", "/search?"+query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("search %q: got %d: %s", query, rr.Code, rr.Body.String())
+		}
+		var response SearchResponse
+		if err := fromJSON(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	ids := func(response SearchResponse) string {
+		var ids []string
+		for _, event := range response.Events {
+			ids = append(ids, event.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	for query, want := range map[string]string{
+		"q=TEAM":                    "a,b,c",
+		"q=team+sync":               "b",
+		"contains=stand":            "a",
+		"q=team&user_id=2":          "c",
+		"user_id=1&min_duration=2h": "b",
+		"user_id=1&max_duration=1h": "d,a,c",
+		"user_id=1&from=2024-07-29T00:00:00Z&to=2024-07-30T00:00:00Z": "d",
+		"q=team&sort=-start": "c,b,a",
+		"q=nothing":          "",
+	} {
+		if got := ids(search(query)); got != want {
+			t.Errorf("search %q: got %q want %q", query, got, want)
+		}
+	}
+
+	// Постраничная выдача
+	page := search("user_id=1&limit=2")
+	if ids(page) != "d,a" || page.NextCursor == "" {
+		t.Fatalf("first page: got %q cursor %q", ids(page), page.NextCursor)
+	}
+	page = search("user_id=1&limit=2&cursor=" + page.NextCursor)
+	if ids(page) != "b,c" || page.NextCursor != "" {
+		t.Errorf("second page: got %q cursor %q", ids(page), page.NextCursor)
+	}
+
+	for _, query := range []string{"cursor=bogus", "limit=0", "sort=title", "from=2024-07-01T00:00:00Z"} {
+		rr := httptest.NewRecorder()
+		searchHandler(rr, httptest.NewRequest("GET", "/search?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("search %q: got %d want 400", query, rr.Code)
+		}
+	}
+}
+
+// sseEvent событие потока Server-Sent Events
+type sseEvent struct {
+	id, event, data string
+}
+
+// readSSE читает n событий потока, пропуская комментарии
+func readSSE(t *testing.T, reader *bufio.Reader, n int) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	for len(events) < n {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if current != (sseEvent{}) {
+				events = append(events, current)
+			}
+			current = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			current.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return events
+}
+
+func TestChangeFeed(t *testing.T) {
+	setup(t)
+	feed = newChangeFeed(3)
+	store = observeStore(newMemoryStore(), feed.onChange)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+	defer feed.Close()
+
+	subscribe := func(query, lastEventID string) (*bufio.Reader, func()) {
+		req, _ := http.NewRequest("GET", server.URL+"/changes?"+query, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("subscribe: got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+
+	stream, closeStream := subscribe("user_id=2", "")
+	defer closeStream()
+
+	ctx := context.Background()
+	event := Event{ID: "1", Title: "Sync", UserID: "1",
+		StartTime: time.Date(2024, 7, 25, 10, 0, 0, 0, time.UTC), EndTime: time.Date(2024, 7, 25, 11, 0, 0, 0, time.UTC)}
+	addEvent(t, event)
+	event.Attendees = []Attendee{{UserID: "2", Role: roleViewer, RSVP: rsvpNeedsAction}}
+	if err := store.Update(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Создание не касается пользователя 2, удаление касается: он был участником
+	events := readSSE(t, stream, 2)
+	if events[0].event != changeUpdate || events[1].event != changeDelete || !strings.Contains(events[1].data, `"event_id":"1"`) {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	first, _ := strconv.ParseUint(events[0].id, 10, 64)
+	if second, _ := strconv.ParseUint(events[1].id, 10, 64); second != first+1 {
+		t.Errorf("sequence must increase by one: %s, %s", events[0].id, events[1].id)
+	}
+
+	// Возобновление с журнала
+	resumed, closeResumed := subscribe("", events[0].id)
+	defer closeResumed()
+	if got := readSSE(t, resumed, 1); got[0].id != events[1].id {
+		t.Errorf("resume: got %+v", got)
+	}
+
+	// Изменение, вытесненное из журнала, приводит к reset
+	for i := 2; i <= 4; i++ {
+		event.ID = fmt.Sprint(i)
+		addEvent(t, event)
+	}
+	stale, closeStale := subscribe("", events[0].id)
+	defer closeStale()
+	if got := readSSE(t, stale, 4); got[0].event != "reset" || got[1].event != changeCreate {
+		t.Errorf("stale resume: got %+v", got)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	setup(t)
+	dir := t.TempDir()
+	path := dir + "/history.jsonl"
+	h, err := openHistoryStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history = h
+	store = observeStore(newMemoryStore(), history.onChange)
+	mux := newMux()
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr
+	}
+	versions := func(id string) []EventVersion {
+		t.Helper()
+		rr := do("GET", "/event_history?id="+id)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("history: got %d: %s", rr.Code, rr.Body.String())
+		}
+		var response HistoryResponse
+		if err := fromJSON(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Versions
+	}
+
+	ctx := context.Background()
+	event := Event{ID: "1", Title: "Draft", UserID: "1",
+		StartTime: time.Date(2024, 7, 25, 10, 0, 0, 0, time.UTC), EndTime: time.Date(2024, 7, 25, 11, 0, 0, 0, time.UTC)}
+	addEvent(t, event)
+	event.Title = "Final"
+	if err := store.Update(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	got := versions("1")
+	if len(got) != 2 || got[0].Op != changeCreate || got[1].Op != changeUpdate ||
+		got[1].Old.Title != "Draft" || got[1].New.Title != "Final" || got[1].Version != 2 {
+		t.Fatalf("unexpected history %+v", got)
+	}
+
+	// Возврат к первой версии записывается как новая версия
+	if rr := do("POST", "/revert_event?id=1&version=1"); rr.Code != http.StatusOK {
+		t.Fatalf("revert: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if current, _ := store.Get(ctx, "1"); current.Title != "Draft" {
+		t.Errorf("revert: got title %q", current.Title)
+	}
+	if got := versions("1"); len(got) != 3 || got[2].New.Title != "Draft" {
+		t.Errorf("revert must add a version: %+v", got)
+	}
+
+	// Удаленное событие восстанавливается из истории
+	if err := store.Delete(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if rr := do("POST", "/revert_event?id=1&version=4"); rr.Code != http.StatusBadRequest {
+		t.Errorf("revert to deletion: got %d", rr.Code)
+	}
+	if rr := do("POST", "/revert_event?id=1&version=9"); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown version: got %d", rr.Code)
+	}
+	if rr := do("POST", "/revert_event?id=1&version=2"); rr.Code != http.StatusOK {
+		t.Fatalf("restore: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if current, err := store.Get(ctx, "1"); err != nil || current.Title != "Final" {
+		t.Errorf("restore: got %+v, %v", current, err)
+	}
+
+	// История переживает перезапуск
+	if err := history.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if history, err = openHistoryStore(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	if got := versions("1"); len(got) != 5 || got[4].Op != changeCreate {
+		t.Errorf("reloaded history: %+v", got)
+	}
+
+	// После срока хранения удаленное событие восстановить нельзя
+	store = observeStore(newMemoryStore(), history.onChange)
+	event.ID = "2"
+	addEvent(t, event)
+	if err := store.Delete(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+	history.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if rr := do("POST", "/revert_event?id=2&version=1"); rr.Code != http.StatusNotFound {
+		t.Errorf("expired restore: got %d", rr.Code)
+	}
+	if rr := do("GET", "/event_history?id=2"); rr.Code != http.StatusNotFound {
+		t.Errorf("expired history: got %d", rr.Code)
+	}
+
+	// Журнал сжимается, когда вытесненных версий становится больше живых
+	history.now = time.Now
+	event.ID = "3"
+	addEvent(t, event)
+	for i := 0; i < historyCompactMin+maxEventVersions; i++ {
+		event.Title = fmt.Sprintf("Edit %d", i)
+		if err := store.Update(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > historyCompactMin {
+		t.Errorf("history journal was not compacted: %d records", lines)
+	}
+	if err := history.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if history, err = openHistoryStore(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	if got := versions("3"); len(got) != maxEventVersions || got[len(got)-1].New.Title != event.Title {
+		t.Errorf("compacted history: %d versions", len(got))
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"listen": ":9000", "storage": "file", "log_level": "debug",
+		"rate_limits": "default=1:1", "timeouts": {"write": "1m"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+
+	// Значения по умолчанию < файл < окружение < флаги
+	config, err := loadConfig([]string{"-config", path, "-storage-dir", "flagdir", "-reject-overlap"},
+		env(map[string]string{"STORAGE_DIR": "envdir", "LOG_LEVEL": "warn"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":9000" || config.Storage != storageFile || config.StorageDir != "flagdir" ||
+		config.LogLevel != "warn" || !config.RejectOverlap || config.RateLimits != "default=1:1" ||
+		config.Timeouts.Write != Duration(time.Minute) || config.Timeouts.Read != Duration(readTimeout) ||
+		config.MaxBodyBytes != defaultMaxBodyBytes {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	if config.MetricsListen != "" {
+		t.Errorf("metrics must be disabled by default, got %q", config.MetricsListen)
+	}
+
+	// Файл из окружения; LISTEN_ADDR важнее PORT
+	config, err = loadConfig(nil, env(map[string]string{"CONFIG_FILE": path, "PORT": "7000", "LISTEN_ADDR": "127.0.0.1:7001", "METRICS_LISTEN": "127.0.0.1:9090"}))
+	if err != nil || config.Listen != "127.0.0.1:7001" || config.Storage != storageFile || config.MetricsListen != "127.0.0.1:9090" {
+		t.Errorf("config from env: %+v, %v", config, err)
+	}
+
+	// Ошибки сообщаются все сразу
+	_, err = loadConfig([]string{"-port", "x", "-metrics-listen", "9090", "-storage", "disk", "-tls-cert", path, "-read-timeout", "0s"}, env(nil))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"listen port", "metrics_listen address", "storage backend", "tls_key", "timeout read"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q must mention %q", err, want)
+		}
+	}
+
+	if _, err := loadConfig([]string{"-metrics-listen", ":8080"}, env(nil)); err == nil || !strings.Contains(err.Error(), "metrics_listen") {
+		t.Errorf("metrics on the API address: got %v", err)
+	}
+	if _, err := loadConfig(nil, env(map[string]string{"MAX_BODY_BYTES": "lots"})); err == nil || !strings.Contains(err.Error(), "MAX_BODY_BYTES") {
+		t.Errorf("bad env value: got %v", err)
+	}
+	if err := os.WriteFile(path, []byte(`{"listen_addr": ":9000"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig([]string{"-config", path}, env(nil)); err == nil {
+		t.Error("unknown config field must be rejected")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	setup(t)
+	var changes []storeChange
+	store = observeStore(newMemoryStore(), func(change storeChange) { changes = append(changes, change) })
+	mux := newMux()
+
+	batch := func(query, body string) (int, BatchResponse) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/batch?"+query, strings.NewReader(body)))
+		var response BatchResponse
+		if err := fromJSON(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode %s: %v", rr.Body.String(), err)
+		}
+		return rr.Code, response
+	}
+
+	ctx := context.Background()
+	day := func(h int) time.Time { return time.Date(2024, 7, 25, h, 0, 0, 0, time.UTC) }
+	addEvent(t, Event{ID: "a", Title: "Keep", UserID: "1", StartTime: day(8), EndTime: day(9)})
+	addEvent(t, Event{ID: "b", Title: "Drop", UserID: "1", StartTime: day(10), EndTime: day(11), RRule: "FREQ=DAILY"})
+	addEvent(t, Event{ID: "b-1", Title: "Moved", UserID: "1", StartTime: day(12), EndTime: day(13), SeriesID: "b"})
+	changes = nil
+
+	code, response := batch("", `[
+		{"op": "create", "user_id": "1", "event": {"title": "New", "start_time": "2024-07-26T10:00:00Z", "end_time": "2024-07-26T11:00:00Z"}},
+		{"op": "update", "id": "a", "event": {"title": "Renamed"}},
+		{"op": "delete", "id": "b"}
+	]`)
+	if code != http.StatusOK || !response.Committed || len(response.Results) != 3 {
+		t.Fatalf("batch: got %d %+v", code, response)
+	}
+	created := response.Results[0]
+	if created.Status != http.StatusCreated || created.ID == "" || created.Event.Title != "New" ||
+		response.Results[1].Event.Title != "Renamed" || response.Results[2].Status != http.StatusNoContent {
+		t.Errorf("unexpected results %+v", response.Results)
+	}
+	if _, err := store.Get(ctx, "b-1"); err == nil {
+		t.Error("deleting a series must delete its overrides")
+	}
+	if len(changes) != 4 || changes[1].Old.Title != "Keep" || changes[3].ID != "b-1" {
+		t.Errorf("observers must see each change: %+v", changes)
+	}
+
+	// Ошибка одной операции отменяет весь пакет
+	changes = nil
+	code, response = batch("", `[
+		{"op": "update", "id": "a", "event": {"title": "Lost"}},
+		{"op": "delete", "id": "missing"},
+		{"op": "create", "user_id": "1", "event": {"title": ""}}
+	]`)
+	if code != http.StatusNotFound || response.Committed {
+		t.Fatalf("aborted batch: got %d %+v", code, response)
+	}
+	if response.Results[0].Status != http.StatusFailedDependency || response.Results[1].Status != http.StatusNotFound ||
+		response.Results[2].Status != http.StatusUnprocessableEntity || response.Results[0].Event != nil {
+		t.Errorf("unexpected results %+v", response.Results)
+	}
+	if event, _ := store.Get(ctx, "a"); event.Title != "Renamed" || len(changes) != 0 {
+		t.Errorf("aborted batch must not change the store: %+v, %d changes", event, len(changes))
+	}
+
+	// Операции видят результаты предыдущих; пересечения проверяются по итогу пакета
+	code, response = batch("reject_overlap=true", `[
+		{"op": "update", "id": "a", "event": {"start_time": "2024-07-26T10:30:00Z", "end_time": "2024-07-26T11:30:00Z"}},
+		{"op": "delete", "id": "a"},
+		{"op": "create", "user_id": "1", "event": {"title": "Clash", "start_time": "2024-07-26T10:30:00Z", "end_time": "2024-07-26T11:30:00Z"}}
+	]`)
+	if code != http.StatusConflict || response.Results[2].Status != http.StatusConflict ||
+		len(response.Results[2].Conflicts) != 1 || response.Results[2].Conflicts[0] != created.ID {
+		t.Fatalf("conflict: got %d %+v", code, response)
+	}
+	if code, response = batch("", `[{"op": "delete", "id": "a"}, {"op": "update", "id": "a", "event": {}}]`); code != http.StatusNotFound {
+		t.Errorf("update after delete: got %d %+v", code, response)
+	}
+
+	// Изменение серии не возвращает перенесенные и удаленные повторения
+	moved := day(10).AddDate(0, 0, 1)
+	addEvent(t, Event{ID: "s", Title: "Series", UserID: "1", StartTime: day(10), EndTime: day(11),
+		RRule: "FREQ=DAILY;COUNT=3", ExDates: []time.Time{moved}})
+	if code, response = batch("", `[{"op": "update", "id": "s", "event": {"title": "Daily", "exdates": []}}]`); code != http.StatusOK {
+		t.Fatalf("series update: got %d %+v", code, response)
+	}
+	if event, _ := store.Get(ctx, "s"); event.Title != "Daily" || len(event.ExDates) != 1 || !event.ExDates[0].Equal(moved) {
+		t.Errorf("series update must keep server exdates: %+v", event)
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/batch", strings.NewReader(`[{"op": "create", "bogus": 1}]`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown field: got %d", rr.Code)
+	}
+}
+
+func TestFileStoreBatch(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := openFileStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	event := Event{ID: "1", Title: "One", UserID: "1", StartTime: time.Date(2024, 7, 25, 10, 0, 0, 0, time.UTC), EndTime: time.Date(2024, 7, 25, 11, 0, 0, 0, time.UTC)}
+	second := event
+	second.ID = "2"
+	if err := fs.Apply(ctx, []storeOp{{Op: changeCreate, Event: event}, {Op: changeCreate, Event: second}, {Op: changeDelete, ID: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	var opErr *batchError
+	if err := fs.Apply(ctx, []storeOp{{Op: changeDelete, ID: "2"}, {Op: changeUpdate, Event: event}}); !errors.As(err, &opErr) || opErr.Index != 1 {
+		t.Fatalf("expected failure of operation 1, got %v", err)
+	}
+	fs.Close()
+
+	// Недописанный пакет отбрасывается целиком
+	wal, err := os.OpenFile(dir+"/"+walFileName, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteString(`{"op":"batch","records":[{"op":"delete","id":"2"},{"op":"put","event":{"id":"3"`)
+	wal.Close()
+
+	fs, err = openFileStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	all, _ := fs.All(ctx)
+	if len(all) != 1 || all[0].ID != "2" {
+		t.Errorf("replayed state: %+v", all)
+	}
+}
+
+func TestEventIDs(t *testing.T) {
+	now := time.Date(2024, 7, 25, 10, 0, 0, 0, time.UTC)
+	g := &idGenerator{now: func() time.Time { return now }, entropy: bytes.NewReader(bytes.Repeat([]byte{0xff}, 20))}
+
+	// Внутри миллисекунды ID растут; переполнение суффикса переносит в
+	// следующую миллисекунду, часы назад не нарушают порядок
+	first := g.next()
+	second := g.next()
+	now = now.Add(-time.Second)
+	third := g.next()
+	if !(first < second && second < third) {
+		t.Errorf("ids must increase: %s %s %s", first, second, third)
+	}
+	if second[:10] == first[:10] {
+		t.Errorf("suffix overflow must advance the time part: %s %s", first, second)
+	}
+
+	g = newIDGenerator()
+	seen := make(map[string]bool)
+	previous := ""
+	for i := 0; i < 10000; i++ {
+		id := g.next()
+		if seen[id] || id <= previous || !validID(id) {
+			t.Fatalf("bad id %q after %q", id, previous)
+		}
+		seen[id] = true
+		previous = id
+	}
+	if encodeID(0, [10]byte{}) != "00000000000000000000000000" || encodeID(1<<48-1, [10]byte{}) != "7ZZZZZZZZZ0000000000000000" {
+		t.Errorf("unexpected encoding of time bounds")
+	}
+
+	for id, want := range map[string]bool{
+		"01J3KXJ6Q8ZC3V5N9W0RYTD2MB": true,
+		"1721901600000000000":        true,
+		"8ZZZZZZZZZZZZZZZZZZZZZZZZZ": false,
+		"01J3KXJ6Q8ZC3V5N9W0RYTD2MU": false,
+		"01j3kxj6q8zc3v5n9w0rytd2mb": false,
+		"12345678901234567890":       false,
+		"seed-1":                     false,
+		"":                           false,
+	} {
+		if validID(id) != want {
+			t.Errorf("validID(%q) = %v, want %v", id, !want, want)
+		}
+	}
+
+	setup(t)
+	rr := post(createEventHandler, "title=T&user_id=1&start_time=2024-07-25T15:00:00Z&end_time=2024-07-25T16:00:00Z")
+	all, _ := store.All(context.Background())
+	if rr.Code != http.StatusCreated || len(all) != 1 || len(all[0].ID) != idLen {
+		t.Errorf("create must assign a ULID: %d %+v", rr.Code, all)
+	}
+
+	rr = httptest.NewRecorder()
+	deleteEventHandler(rr, httptest.NewRequest("POST", "/delete_event?id=../x", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("malformed id: got %d", rr.Code)
+	}
+}
+
+func TestMeetingSuggestions(t *testing.T) {
+	setup(t)
+
+	suggest := func(query string) MeetingSuggestions {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		suggestMeetingHandler(rr, httptest.NewRequest("GET", "/suggest_meeting?"+query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("suggest %q: got %d: %s", query, rr.Code, rr.Body.String())
+		}
+		var response MeetingSuggestions
+		if err := fromJSON(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	// Москва 09–18 (06–15 UTC), Нью-Йорк 09–17 (13–21 UTC); у второго 23 июля выходной
+	if rr := post(userSettingsHandler, "user_id=1&tz=Europe/Moscow&working_hours=mon-fri+09:00-18:00"); rr.Code != http.StatusOK {
+		t.Fatalf("settings: got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := post(userSettingsHandler, "user_id=2&tz=America/New_York&holidays=2024-07-23"); rr.Code != http.StatusOK {
+		t.Fatal(rr.Body.String())
+	}
+	rr := post(userSettingsHandler, "user_id=2&working_hours=mon-fri+09:00-17:00")
+	if want := `{"tz":"America/New_York","working_hours":[{"days":["mon","tue","wed","thu","fri"],"start":"09:00","end":"17:00"}],"holidays":["2024-07-23"]}`; rr.Body.String() != want {
+		t.Errorf("partial update must keep other settings: got %s", rr.Body.String())
+	}
+	for _, form := range []string{"working_hours=mon-fri+18:00-09:00", "working_hours=funday+09:00-17:00", "working_hours=mon", "holidays=2024-13-01"} {
+		if rr := post(userSettingsHandler, "user_id=3&"+form); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", form, rr.Code)
+		}
+	}
+
+	addEvent(t, Event{ID: "1", Title: "Busy", UserID: "1",
+		StartTime: time.Date(2024, 7, 22, 13, 0, 0, 0, time.UTC), EndTime: time.Date(2024, 7, 22, 14, 0, 0, 0, time.UTC)})
+
+	// Общее время в понедельник — 14:00–15:00 UTC; лучший слот с запасом с обеих сторон
+	window := "user_ids=1,2&duration=30m&from=2024-07-20T00:00:00Z&to=2024-07-24T00:00:00Z"
+	got := suggest(window)
+	if len(got.Slots) != 1 || !got.Slots[0].Start.Equal(time.Date(2024, 7, 22, 14, 15, 0, 0, time.UTC)) || got.Slots[0].Score <= 0 {
+		t.Fatalf("unexpected slots %+v", got.Slots)
+	}
+
+	// Без выходного добавляется вторник; слоты не пересекаются и ранжированы
+	post(userSettingsHandler, "user_id=2&holidays=")
+	got = suggest(window + "&limit=5")
+	if len(got.Slots) < 3 {
+		t.Fatalf("expected slots on Tuesday too: %+v", got.Slots)
+	}
+	for i := 1; i < len(got.Slots); i++ {
+		if got.Slots[i].Score > got.Slots[i-1].Score {
+			t.Errorf("slots must be ranked: %+v", got.Slots)
+		}
+		for _, other := range got.Slots[:i] {
+			if got.Slots[i].Start.Before(other.End) && other.Start.Before(got.Slots[i].End) {
+				t.Errorf("slots overlap: %+v", got.Slots)
+			}
+		}
+	}
+
+	// Выходные по умолчанию нерабочие
+	if got := suggest("user_ids=3&duration=1h&from=2024-07-20T00:00:00Z&to=2024-07-22T00:00:00Z"); len(got.Slots) != 0 {
+		t.Errorf("weekend: got %+v", got.Slots)
+	}
+
+	rr = httptest.NewRecorder()
+	suggestMeetingHandler(rr, httptest.NewRequest("GET", "/suggest_meeting?user_ids=1&duration=0s&from=2024-07-20T00:00:00Z&to=2024-07-24T00:00:00Z", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("zero duration: got %d", rr.Code)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	setup(t)
+	mux := newMux()
+	handler := validationMiddleware(mux)
+
+	// Документ описывает каждый маршрут mux
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+	var doc struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid document: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("openapi version %q", doc.OpenAPI)
+	}
+	for _, route := range apiRoutes {
+		path := strings.NewReplacer("{user_id}", "1", "{id}", "2").Replace(route.Path)
+		if _, pattern := mux.Handler(httptest.NewRequest("GET", path, nil)); pattern == "" {
+			t.Errorf("%s is described but not served", route.Path)
+		}
+		if len(doc.Paths[route.Path]) != len(route.Operations) {
+			t.Errorf("%s: got %d operations in the document", route.Path, len(doc.Paths[route.Path]))
+		}
+	}
+	for _, name := range []string{"Event", "EventInput", "JSONResponse", "BatchOperation", "FreeBusy"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("missing schema %s", name)
+		}
+	}
+	var event struct {
+		Required   []string                   `json:"required"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	json.Unmarshal(doc.Components.Schemas["Event"], &event)
+	if string(event.Properties["start_time"]) != `{"format":"date-time","type":"string"}` || !strings.Contains(strings.Join(event.Required, ","), "title") {
+		t.Errorf("unexpected Event schema %s", doc.Components.Schemas["Event"])
+	}
+
+	do := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	const form = "application/x-www-form-urlencoded"
+
+	// Ошибки проверки одинаковы для всех обработчиков
+	tests := []struct {
+		method, target, contentType, body string
+		status                            int
+		error                             string
+	}{
+		{"POST", "/create_event", form, "user_id=1&start_time=2024-07-25T15:00:00Z&end_time=2024-07-25T16:00:00Z", 400, "missing parameter title"},
+		{"POST", "/create_event", form, "title=A&start_time=2024-07-25&end_time=2024-07-25T16:00:00Z", 400, "invalid parameter start_time: must be an RFC 3339 timestamp"},
+		{"POST", "/create_event", form, "title=A&start_time=2024-07-25T15:00:00Z&end_time=2024-07-25T16:00:00Z&reminders=15m,soon", 400, "invalid parameter reminders: must be a duration such as 30m"},
+		{"POST", "/create_event", "application/json", `{"title":"A"}`, 415, `unsupported content type "application/json"`},
+		{"GET", "/create_event", "", "", 405, "method not allowed"},
+		{"GET", "/events_for_day?user_id=1", "", "", 400, "missing parameter date"},
+		{"GET", "/events_for_week?date=2024-07-25&tz=Mars/Olympus", "", "", 400, "invalid parameter tz: must be an IANA time zone such as Europe/Moscow"},
+		{"POST", "/delete_event", form, "id=../etc", 400, "invalid parameter id: must be an event ID"},
+		{"POST", "/respond_invite", form, "id=1&attendee=2&rsvp=maybe", 400, "invalid parameter rsvp: must be one of accepted, declined, tentative"},
+		{"POST", "/revert_event", form, "id=1&version=last", 400, "invalid parameter version: must be an integer"},
+		{"GET", "/search?sort=title", "", "", 400, "invalid parameter sort: must be one of start, -start"},
+		{"GET", "/free_busy?user_ids=1&from=2024-07-25T00:00:00Z", "", "", 400, "missing parameter to"},
+		{"GET", "/v2/users/1/events/bad-id", "", "", 400, "invalid parameter id: must be an event ID"},
+		{"POST", "/v2/users/1/events", "text/plain", "title", 415, `unsupported content type "text/plain"`},
+		{"DELETE", "/v2/users/1/events", "", "", 405, "method not allowed"},
+		{"POST", "/batch?reject_overlap=maybe", "application/json", "[]", 400, "invalid parameter reject_overlap: must be true or false"},
+	}
+	for _, tt := range tests {
+		rr := do(tt.method, tt.target, tt.contentType, tt.body)
+		var response JSONResponse
+		fromJSON(rr.Body.Bytes(), &response)
+		if rr.Code != tt.status || response.Error != tt.error {
+			t.Errorf("%s %s: got %d %q, want %d %q", tt.method, tt.target, rr.Code, response.Error, tt.status, tt.error)
+		}
+	}
+	if rr := do("PUT", "/user_settings", "", ""); rr.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("Allow: got %q", rr.Header().Get("Allow"))
+	}
+
+	// Корректные запросы доходят до обработчиков
+	rr = do("POST", "/create_event", form, "title=A&user_id=1&start_time=2024-07-25T15:00:00Z&end_time=2024-07-25T16:00:00Z&reminders=15m,1h")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("GET", "/events_for_day?user_id=1&date=2024-07-25", "", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"title":"A"`) {
+		t.Errorf("events_for_day: got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("POST", "/v2/users/1/events", "application/json; charset=utf-8", `{"title":"B","start_time":"2024-07-26T10:00:00Z","end_time":"2024-07-26T11:00:00Z"}`); rr.Code != http.StatusCreated {
+		t.Errorf("v2 create: got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("HEAD", "/healthz", "", ""); rr.Code == http.StatusMethodNotAllowed {
+		t.Error("HEAD must be allowed where GET is")
+	}
+	if rr := do("GET", "/unknown", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown path: got %d", rr.Code)
+	}
+}
+
+func TestRPC(t *testing.T) {
+	setup(t)
+	handler := validationMiddleware(newMux())
+
+	call := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/rpc", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	type response struct {
+		JSONRPC string          `json:"jsonrpc"`
+		Result  json.RawMessage `json:"result"`
+		Error   *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Data    struct {
+				Status    int      `json:"status"`
+				Conflicts []string `json:"conflicts"`
+			} `json:"data"`
+		} `json:"error"`
+		ID json.RawMessage `json:"id"`
+	}
+	single := func(body string) response {
+		t.Helper()
+		rr := call(body)
+		var r response
+		if err := json.Unmarshal(rr.Body.Bytes(), &r); err != nil || r.JSONRPC != "2.0" {
+			t.Fatalf("%s: got %d %s", body, rr.Code, rr.Body.String())
+		}
+		return r
+	}
+
+	created := single(`{"jsonrpc":"2.0","method":"createEvent","params":{"title":"Standup","user_id":"1","start_time":"2024-07-25T09:00:00Z","end_time":"2024-07-25T09:15:00Z","reminders":["5m"]},"id":1}`)
+	if created.Error != nil || string(created.Result) != `{"result":"event created"}` || string(created.ID) != "1" {
+		t.Fatalf("create: %+v", created)
+	}
+
+	day := single(`{"jsonrpc":"2.0","method":"eventsForDay","params":{"user_id":"1","date":"2024-07-25"},"id":"day"}`)
+	var events []Event
+	if err := json.Unmarshal(day.Result, &events); err != nil || len(events) != 1 || events[0].Title != "Standup" || string(day.ID) != `"day"` {
+		t.Fatalf("events for day: %s", day.Result)
+	}
+	id := events[0].ID
+
+	// Ошибки проверки совпадают с ответами HTTP-маршрутов
+	errorTests := []struct {
+		body    string
+		code    int
+		message string
+	}{
+		{`{"jsonrpc":"2.0","method":"createEvent","params":{"user_id":"1"},"id":1}`, rpcInvalidParams, "missing parameter title"},
+		{`{"jsonrpc":"2.0","method":"eventsForWeek","params":{"date":"25.07.2024"},"id":1}`, rpcInvalidParams, "invalid parameter date: must be a date as YYYY-MM-DD"},
+		{`{"jsonrpc":"2.0","method":"updateEvent","params":{"id":"` + id + `","title":"X","user_id":"1","start_time":"2024-07-25T10:00:00Z","end_time":"2024-07-25T09:00:00Z"},"id":1}`, rpcInvalidParams, "end_time cannot be before start_time"},
+		{`{"jsonrpc":"2.0","method":"deleteEvent","params":{"id":"42"},"id":1}`, -32004, "event not found"},
+		{`{"jsonrpc":"2.0","method":"createEvent","params":{"title":"Overlap","user_id":"1","start_time":"2024-07-25T09:10:00Z","end_time":"2024-07-25T09:30:00Z","reject_overlap":true},"id":1}`, -32009, "event overlaps existing events"},
+		{`{"jsonrpc":"2.0","method":"createEvent","params":["Standup"],"id":1}`, rpcInvalidParams, "params must be an object"},
+		{`{"jsonrpc":"2.0","method":"dropTables","id":1}`, rpcMethodNotFound, "method not found: dropTables"},
+		{`{"method":"eventsForDay","id":1}`, rpcInvalidRequest, "invalid request"},
+	}
+	for _, tt := range errorTests {
+		r := single(tt.body)
+		if r.Error == nil || r.Error.Code != tt.code || r.Error.Message != tt.message {
+			t.Errorf("%s: got %+v", tt.body, r.Error)
+		}
+	}
+	if r := single(errorTests[4].body); len(r.Error.Data.Conflicts) != 1 || r.Error.Data.Status != http.StatusConflict {
+		t.Errorf("conflict data: %+v", r.Error.Data)
+	}
+	if r := single(`{"jsonrpc":"2.0","method":`); r.Error == nil || r.Error.Code != rpcParseError || string(r.ID) != "null" {
+		t.Errorf("parse error: %+v", r)
+	}
+
+	// Уведомление выполняется без ответа
+	rr := call(`{"jsonrpc":"2.0","method":"updateEvent","params":{"id":"` + id + `","title":"Daily","user_id":"1","start_time":"2024-07-25T09:00:00Z","end_time":"2024-07-25T09:15:00Z"}}`)
+	if rr.Code != http.StatusNoContent || rr.Body.Len() != 0 {
+		t.Errorf("notification: got %d %s", rr.Code, rr.Body.String())
+	}
+	if event, _ := store.Get(context.Background(), id); event.Title != "Daily" {
+		t.Errorf("notification was not executed: %+v", event)
+	}
+
+	// Пакет: ответы только на вызовы с id, в том числе id: null
+	rr = call(`[
+		{"jsonrpc":"2.0","method":"eventsForMonth","params":{"user_id":"1","date":"2024-07-01"},"id":null},
+		{"jsonrpc":"2.0","method":"deleteEvent","params":{"id":"` + id + `"}},
+		{"jsonrpc":"2.0","method":"eventsForDay","params":{"user_id":"1","date":"2024-07-25"},"id":2},
+		1
+	]`)
+	var batch []response
+	if err := json.Unmarshal(rr.Body.Bytes(), &batch); err != nil || len(batch) != 3 {
+		t.Fatalf("batch: got %d %s", rr.Code, rr.Body.String())
+	}
+	if string(batch[0].ID) != "null" || batch[0].Error != nil || !strings.Contains(string(batch[0].Result), "Daily") {
+		t.Errorf("batch call with null id: %+v", batch[0])
+	}
+	if string(batch[1].ID) != "2" || string(batch[1].Result) != "null" {
+		t.Errorf("calls must run in order: %+v", batch[1])
+	}
+	if batch[2].Error == nil || batch[2].Error.Code != rpcInvalidRequest {
+		t.Errorf("invalid batch element: %+v", batch[2])
+	}
+	if r := single(`[]`); r.Error == nil || r.Error.Code != rpcInvalidRequest {
+		t.Errorf("empty batch: %+v", r)
+	}
+	rr = call(`[{"jsonrpc":"2.0","method":"eventsForDay","params":{"user_id":"1","date":"2024-07-25"}}]`)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("batch of notifications: got %d", rr.Code)
+	}
+}
+
+func TestCalendars(t *testing.T) {
+	setup(t)
+	handler := validationMiddleware(newMux())
+
+	do := func(method, target, form, actor string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(form))
+		if form != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if actor != "" {
+			req = req.WithContext(withUser(req.Context(), actor))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	createCalendar := func(form string) Calendar {
+		t.Helper()
+		rr := do("POST", "/create_calendar", form, "")
+		var c Calendar
+		if rr.Code != http.StatusCreated || fromJSON(rr.Body.Bytes(), &c) != nil {
+			t.Fatalf("create calendar %q: got %d %s", form, rr.Code, rr.Body.String())
+		}
+		return c
+	}
+	dayTitles := func(query, actor string) []string {
+		t.Helper()
+		rr := do("GET", "/events_for_day?date=2024-07-25&"+query, "", actor)
+		var events []Event
+		if rr.Code != http.StatusOK || fromJSON(rr.Body.Bytes(), &events) != nil {
+			t.Fatalf("events_for_day %q: got %d %s", query, rr.Code, rr.Body.String())
+		}
+		var titles []string
+		for _, event := range events {
+			titles = append(titles, event.Title)
+		}
+		return titles
+	}
+
+	work := createCalendar("user_id=1&name=Work&color=%23FF8800")
+	if work.Visibility != visibilityPrivate || work.Color != "#FF8800" || !validID(work.ID) {
+		t.Errorf("unexpected calendar %+v", work)
+	}
+	home := createCalendar("user_id=1&name=Home&visibility=public")
+	other := createCalendar("user_id=2&name=Other")
+	for _, form := range []string{"user_id=1&name=X&color=red", "user_id=1&name=X&visibility=secret", "user_id=1&name=+"} {
+		if rr := do("POST", "/create_calendar", form, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", form, rr.Code)
+		}
+	}
+	rr := do("GET", "/calendars?user_id=1", "", "")
+	if want := `[{"id":"` + home.ID + `","user_id":"1","name":"Home","visibility":"public"},{"id":"` + work.ID + `","user_id":"1","name":"Work","color":"#FF8800","visibility":"private"}]`; rr.Body.String() != want {
+		t.Errorf("calendars: got %s", rr.Body.String())
+	}
+	if rr := do("GET", "/calendars?user_id=1", "", "2"); !strings.Contains(rr.Body.String(), "Home") || strings.Contains(rr.Body.String(), "Work") {
+		t.Errorf("other users must see only public calendars: %s", rr.Body.String())
+	}
+
+	// События в календарях и фильтр events_for_*
+	event := "user_id=1&start_time=2024-07-25T10:00:00Z&end_time=2024-07-25T11:00:00Z&title="
+	for _, form := range []string{event + "Review&calendar_id=" + work.ID, event + "Gym&calendar_id=" + home.ID, event + "Errand"} {
+		if rr := do("POST", "/create_event", form, ""); rr.Code != http.StatusCreated {
+			t.Fatalf("%s: got %d %s", form, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := do("POST", "/create_event", event+"X&calendar_id="+other.ID, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("calendar of another user: got %d", rr.Code)
+	}
+	if rr := do("POST", "/create_event", event+"X&calendar_id=1", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown calendar: got %d", rr.Code)
+	}
+	if got := dayTitles("user_id=1", ""); len(got) != 3 {
+		t.Errorf("all calendars: got %v", got)
+	}
+	if got := dayTitles("user_id=1&calendar_id="+work.ID, ""); len(got) != 1 || got[0] != "Review" {
+		t.Errorf("work calendar: got %v", got)
+	}
+	if got := dayTitles("user_id=1&calendar_id="+work.ID+","+home.ID, ""); len(got) != 2 {
+		t.Errorf("two calendars: got %v", got)
+	}
+	if got := dayTitles("user_id=1&calendar_id=default", ""); len(got) != 1 || got[0] != "Errand" {
+		t.Errorf("default calendar: got %v", got)
+	}
+	if got := dayTitles("user_id=1&calendar_id=default,"+work.ID, ""); len(got) != 2 {
+		t.Errorf("default and work calendars: got %v", got)
+	}
+	if rr := do("GET", "/events_for_day?date=2024-07-25&user_id=1&calendar_id=nope", "", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid calendar_id: got %d", rr.Code)
+	}
+
+	// Открытый календарь виден всем, закрытый — только владельцу
+	if got := dayTitles("user_id=1", "2"); len(got) != 1 || got[0] != "Gym" {
+		t.Errorf("user 2 must see only the public calendar: got %v", got)
+	}
+	if rr := do("POST", "/update_calendar", "id="+work.ID+"&visibility=public", "2"); rr.Code != http.StatusForbidden {
+		t.Errorf("update by another user: got %d", rr.Code)
+	}
+	rr = do("POST", "/update_calendar", "id="+work.ID+"&visibility=public", "1")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"name":"Work","color":"#FF8800","visibility":"public"`) {
+		t.Errorf("partial update: got %d %s", rr.Code, rr.Body.String())
+	}
+	if got := dayTitles("user_id=1", "2"); len(got) != 2 {
+		t.Errorf("public work calendar: got %v", got)
+	}
+
+	// Повторения серии следуют за календарем серии
+	series := Event{ID: newEventID(), Title: "Standup", UserID: "1", CalendarID: work.ID, RRule: "FREQ=DAILY",
+		StartTime: time.Date(2024, 7, 22, 9, 0, 0, 0, time.UTC), EndTime: time.Date(2024, 7, 22, 9, 15, 0, 0, time.UTC)}
+	addEvent(t, series)
+	if rr := do("POST", "/update_event", "id="+series.ID+"&recurrence_id=2024-07-25T09:00:00Z&"+event+"Late+standup", ""); rr.Code != http.StatusOK {
+		t.Fatalf("override: got %d %s", rr.Code, rr.Body.String())
+	}
+	overrideCalendar := func() string {
+		events, _ := store.ListByUser(context.Background(), "1")
+		for _, e := range events {
+			if e.SeriesID == series.ID {
+				return e.CalendarID
+			}
+		}
+		return "missing"
+	}
+	if got := overrideCalendar(); got != work.ID {
+		t.Errorf("override must be created in the series calendar, got %q", got)
+	}
+	req := httptest.NewRequest("PATCH", "/v2/users/1/events/"+series.ID, strings.NewReader(`{"calendar_id":"`+home.ID+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || overrideCalendar() != home.ID {
+		t.Errorf("moving a series must move its overrides: got %d, override in %q", rr.Code, overrideCalendar())
+	}
+
+	// Удаление календаря с переносом и с удалением событий
+	rr = do("POST", "/delete_calendar", "id="+work.ID+"&events=keep", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "1 events moved") {
+		t.Errorf("delete keeping events: got %d %s", rr.Code, rr.Body.String())
+	}
+	if got := dayTitles("user_id=1", ""); len(got) != 4 {
+		t.Errorf("events must be kept: got %v", got)
+	}
+	if _, err := calendars.Get(work.ID); !errors.Is(err, ErrCalendarNotFound) {
+		t.Errorf("calendar must be deleted: %v", err)
+	}
+	if rr := do("POST", "/delete_calendar", "id="+home.ID, "2"); rr.Code != http.StatusForbidden {
+		t.Errorf("delete by another user: got %d", rr.Code)
+	}
+	rr = do("POST", "/delete_calendar", "id="+home.ID, "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "3 events deleted") {
+		t.Errorf("cascading delete: got %d %s", rr.Code, rr.Body.String())
+	}
+	if got := dayTitles("user_id=1", ""); len(got) != 2 || overrideCalendar() != "missing" {
+		t.Errorf("series, override and Gym must be deleted: got %v", got)
+	}
+	if rr := do("POST", "/delete_calendar", "id="+home.ID, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("deleted calendar: got %d", rr.Code)
+	}
+
+	// Если события удалить не удалось, календарь восстанавливается
+	spare := createCalendar("user_id=1&name=Spare")
+	fs, err := openFileStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = fs
+	addEvent(t, Event{ID: newEventID(), Title: "Spare", UserID: "1", CalendarID: spare.ID,
+		StartTime: time.Date(2024, 7, 25, 10, 0, 0, 0, time.UTC), EndTime: time.Date(2024, 7, 25, 11, 0, 0, 0, time.UTC)})
+	fs.Close()
+	if rr := do("POST", "/delete_calendar", "id="+spare.ID, ""); rr.Code == http.StatusOK {
+		t.Errorf("delete with a failing store: got %d", rr.Code)
+	}
+	if _, err := calendars.Get(spare.ID); err != nil {
+		t.Errorf("calendar must be restored after a failed delete: %v", err)
+	}
+
+	// Календари сохраняются в файл
+	path := t.TempDir() + "/calendars.json"
+	saved, err := openCalendarStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved.Put(other)
+	reopened, err := openCalendarStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reopened.Get(other.ID); err != nil || got != other {
+		t.Errorf("reopened: got %+v, %v", got, err)
+	}
+
+	// Изменения, которые не удалось записать, не попадают в память
+	reopened.path = t.TempDir() + "/missing/calendars.json"
+	renamed := other
+	renamed.Name = "Renamed"
+	if err := reopened.Put(renamed); err == nil {
+		t.Fatal("expected write error on put")
+	}
+	if err := reopened.Delete(other.ID); err == nil {
+		t.Fatal("expected write error on delete")
+	}
+	if got, err := reopened.Get(other.ID); err != nil || got != other {
+		t.Errorf("failed writes must not change calendars: got %+v, %v", got, err)
+	}
+}
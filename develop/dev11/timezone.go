@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// requestLocation определяет часовой пояс запроса: параметр tz (имя IANA),
+// иначе часовой пояс пользователя по умолчанию, иначе UTC
+func requestLocation(r *http.Request, userID string) (*time.Location, error) {
+	if tz := r.FormValue("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tz: %v", err)
+		}
+		return loc, nil
+	}
+	return settings.location(userID), nil
+}
+
+// dayWindow возвращает границы календарного дня date в его часовом поясе.
+// Границы строятся через time.Date, поэтому дни перехода на летнее время
+// имеют длину 23 или 25 часов.
+func dayWindow(date time.Time) (time.Time, time.Time) {
+	y, m, d := date.Date()
+	loc := date.Location()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc), time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+}
+
+// isoWeekWindow возвращает границы недели ISO 8601 (с понедельника), в
+// которую попадает date
+func isoWeekWindow(date time.Time) (time.Time, time.Time) {
+	y, m, d := date.Date()
+	loc := date.Location()
+	d -= (int(date.Weekday()) + 6) % 7
+	return time.Date(y, m, d, 0, 0, 0, 0, loc), time.Date(y, m, d+7, 0, 0, 0, 0, loc)
+}
+
+// monthWindow возвращает границы календарного месяца, в который попадает date
+func monthWindow(date time.Time) (time.Time, time.Time) {
+	y, m, _ := date.Date()
+	loc := date.Location()
+	return time.Date(y, m, 1, 0, 0, 0, 0, loc), time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+}
+
+// inLocation переводит время событий в часовой пояс loc для ответа
+func inLocation(events []Event, loc *time.Location) {
+	for i := range events {
+		events[i].StartTime = events[i].StartTime.In(loc)
+		events[i].EndTime = events[i].EndTime.In(loc)
+		if events[i].RecurrenceID != nil {
+			recurrenceID := events[i].RecurrenceID.In(loc)
+			events[i].RecurrenceID = &recurrenceID
+		}
+	}
+}
@@ -2,7 +2,10 @@ module L2
 
 go 1.21
 
-require github.com/beevik/ntp v1.4.3
+require (
+	github.com/beevik/ntp v1.4.3
+	golang.org/x/crypto v0.23.0
+)
 
 require (
 	golang.org/x/net v0.25.0 // indirect